@@ -0,0 +1,372 @@
+package accesslog
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/logging"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// Supported log formats
+const (
+	FormatJSON     = "json"
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+)
+
+// Record describes one proxied request
+type Record struct {
+	Time            time.Time
+	ClientIP        string
+	Host            string
+	Method          string
+	Path            string
+	Protocol        string
+	Status          int
+	Bytes           int64
+	Upstream        string
+	UpstreamLatency time.Duration
+	Duration        time.Duration
+	RequestID       string
+	Referer         string
+	UserAgent       string
+}
+
+// jsonRecord is the JSON representation of a record
+type jsonRecord struct {
+	Time              string  `json:"time"`
+	ClientIP          string  `json:"client_ip"`
+	Host              string  `json:"host"`
+	Method            string  `json:"method"`
+	Path              string  `json:"path"`
+	Protocol          string  `json:"protocol"`
+	Status            int     `json:"status"`
+	Bytes             int64   `json:"bytes"`
+	Upstream          string  `json:"upstream,omitempty"`
+	UpstreamLatencyMS float64 `json:"upstream_latency_ms,omitempty"`
+	DurationMS        float64 `json:"duration_ms"`
+	RequestID         string  `json:"request_id,omitempty"`
+	Referer           string  `json:"referer,omitempty"`
+	UserAgent         string  `json:"user_agent,omitempty"`
+}
+
+// ValidateFormat checks that a log format is supported
+func ValidateFormat(format string) error {
+	switch format {
+	case FormatJSON, FormatCommon, FormatCombined:
+		return nil
+	}
+	return fmt.Errorf("unsupported format %q, expected json, common or combined", format)
+}
+
+// Format renders a record as a single line without the trailing newline
+func Format(format string, rec *Record) []byte {
+	switch format {
+	case FormatCommon, FormatCombined:
+		var b strings.Builder
+		bytes := "-"
+		if rec.Bytes > 0 {
+			bytes = strconv.FormatInt(rec.Bytes, 10)
+		}
+		fmt.Fprintf(&b, "%s - - [%s] \"%s %s %s\" %d %s",
+			orDash(rec.ClientIP), rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			rec.Method, rec.Path, rec.Protocol, rec.Status, bytes)
+		if format == FormatCombined {
+			fmt.Fprintf(&b, " %s %s", strconv.Quote(orDash(rec.Referer)), strconv.Quote(orDash(rec.UserAgent)))
+		}
+		return []byte(b.String())
+	default:
+		line, _ := json.Marshal(jsonRecord{
+			Time:              rec.Time.UTC().Format(time.RFC3339Nano),
+			ClientIP:          rec.ClientIP,
+			Host:              rec.Host,
+			Method:            rec.Method,
+			Path:              rec.Path,
+			Protocol:          rec.Protocol,
+			Status:            rec.Status,
+			Bytes:             rec.Bytes,
+			Upstream:          rec.Upstream,
+			UpstreamLatencyMS: milliseconds(rec.UpstreamLatency),
+			DurationMS:        milliseconds(rec.Duration),
+			RequestID:         rec.RequestID,
+			Referer:           rec.Referer,
+			UserAgent:         rec.UserAgent,
+		})
+		return line
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Logger writes records in one format to one sink
+type Logger struct {
+	format string
+	sink   Sink
+}
+
+// Log writes a record; a nil logger discards it
+func (l *Logger) Log(rec *Record) {
+	if l == nil {
+		return
+	}
+	if err := l.sink.Write(Format(l.format, rec)); err != nil {
+		logging.Logger(logging.Proxy).Error("Failed to write access log", "error", err)
+	}
+}
+
+// Options configures where and how records are written
+type Options struct {
+	Format string
+	// Output is "stdout", "file:<path>" or "syslog[:<network>://<address>]"; empty disables logging
+	Output string
+	// Dir is the directory of per-domain log files. Relative file paths of domains are resolved
+	// against it, and domains can only log to files when it is set.
+	Dir        string
+	MaxSizeMB  int
+	MaxBackups int
+}
+
+// retryInterval is how long an output that failed to open is not retried, so requests
+// don't try to open it one after another
+const retryInterval = time.Minute
+
+// errRecentlyFailed is returned for outputs that failed to open less than retryInterval ago
+var errRecentlyFailed = errors.New("output recently failed to open")
+
+// Manager hands out loggers for the global settings and per-domain overrides.
+// Sinks are shared between loggers writing to the same output.
+type Manager struct {
+	defaults Options
+
+	mu      sync.Mutex
+	sinks   map[string]Sink
+	loggers map[string]*Logger
+	// failed holds when outputs last failed to open
+	failed map[string]time.Time
+	// outputs holds the output override of every domain that logged, so sinks no domain
+	// uses anymore can be closed
+	outputs map[string]string
+}
+
+// NewManager creates a manager with the global settings, opening the global output
+func NewManager(defaults Options) (*Manager, error) {
+	if defaults.Format == "" {
+		defaults.Format = FormatJSON
+	}
+	if err := ValidateFormat(defaults.Format); err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		defaults: defaults,
+		sinks:    make(map[string]Sink),
+		loggers:  make(map[string]*Logger),
+		failed:   make(map[string]time.Time),
+		outputs:  make(map[string]string),
+	}
+	if _, err := m.logger(defaults.Format, defaults.Output); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ValidateOverride checks that a domain may override the global output with output. Domains
+// may log to stdout, the global output and files inside the access log directory; syslog
+// targets and other files can only be configured globally.
+func (m *Manager) ValidateOverride(output string) error {
+	if err := ValidateOutput(output); err != nil {
+		return err
+	}
+	if output == "stdout" || output == m.defaults.Output {
+		return nil
+	}
+	path, ok := strings.CutPrefix(output, "file:")
+	if !ok {
+		return fmt.Errorf("syslog outputs can only be configured globally")
+	}
+	_, err := m.filePath(path)
+	return err
+}
+
+// filePath resolves the path of a per-domain log file against the access log directory,
+// returning an error if it is outside of it
+func (m *Manager) filePath(path string) (string, error) {
+	if m.defaults.Dir == "" {
+		return "", fmt.Errorf("file outputs require an access log directory")
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(m.defaults.Dir, path)
+	}
+	outside := fmt.Errorf("file must be inside the access log directory %s", m.defaults.Dir)
+	if !inside(m.defaults.Dir, path) {
+		return "", outside
+	}
+	dir, err := filepath.EvalSymlinks(m.defaults.Dir)
+	if err != nil {
+		return "", fmt.Errorf("access log directory is not accessible: %w", err)
+	}
+	// Symlinks must not lead out of the directory either, so the file, or its closest
+	// existing parent if it doesn't exist yet, is checked once resolved
+	for existing := path; ; existing = filepath.Dir(existing) {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("access log file is not accessible: %w", err)
+		}
+		// The directory itself is a valid parent, but not a valid file
+		if !inside(dir, resolved) && (existing == path || resolved != dir) {
+			return "", outside
+		}
+		return path, nil
+	}
+}
+
+// inside reports whether path is strictly inside dir
+func inside(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && filepath.IsLocal(rel)
+}
+
+// Logger returns the logger for a domain with the given overrides, falling back to the global
+// settings for empty values. It returns nil if logging is disabled. If the domain's output
+// can't be used, the global logger is returned with the error; outputs that failed to open
+// are retried after a minute, and the global logger is returned without an error meanwhile.
+func (m *Manager) Logger(domain string, override *models.AccessLogConfig) (*Logger, error) {
+	format, output := m.defaults.Format, m.defaults.Output
+	disabled := false
+	if override != nil {
+		format = cmp.Or(override.Format, format)
+		output = cmp.Or(override.Output, output)
+		disabled = override.Disabled
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if domain != "" {
+		if disabled {
+			m.track(domain, "")
+		} else {
+			m.track(domain, output)
+		}
+	}
+	if disabled {
+		return nil, nil
+	}
+	logger, err := m.logger(format, output)
+	if err != nil {
+		fallback, _ := m.logger(m.defaults.Format, m.defaults.Output)
+		if errors.Is(err, errRecentlyFailed) {
+			err = nil
+		}
+		return fallback, err
+	}
+	return logger, nil
+}
+
+// logger returns the logger for a format and output, opening the output if no logger
+// uses it yet. The caller must hold the lock.
+func (m *Manager) logger(format, output string) (*Logger, error) {
+	if output == "" {
+		return nil, nil
+	}
+	key := format + "|" + output
+	if logger, ok := m.loggers[key]; ok {
+		return logger, nil
+	}
+	sink, ok := m.sinks[output]
+	if !ok {
+		if failedAt, ok := m.failed[output]; ok && time.Since(failedAt) < retryInterval {
+			return nil, errRecentlyFailed
+		}
+		var err error
+		sink, err = m.open(output)
+		if err != nil {
+			m.failed[output] = time.Now()
+			return nil, err
+		}
+		delete(m.failed, output)
+		m.sinks[output] = sink
+	}
+	logger := &Logger{format: format, sink: sink}
+	m.loggers[key] = logger
+	return logger, nil
+}
+
+// open opens the sink of an output. Outputs other than the global one are checked to be
+// allowed for domains, and relative file paths are resolved against the access log directory.
+func (m *Manager) open(output string) (Sink, error) {
+	if output != m.defaults.Output {
+		if err := m.ValidateOverride(output); err != nil {
+			return nil, err
+		}
+		if path, ok := strings.CutPrefix(output, "file:"); ok {
+			path, err := m.filePath(path)
+			if err != nil {
+				return nil, err
+			}
+			output = "file:" + path
+		}
+	}
+	return OpenSink(output, m.defaults.MaxSizeMB, m.defaults.MaxBackups)
+}
+
+// track records the output a domain logs to, closing the sink of its previous output if no
+// other domain uses it anymore. The caller must hold the lock.
+func (m *Manager) track(domain, output string) {
+	previous, ok := m.outputs[domain]
+	if ok && previous == output {
+		return
+	}
+	m.outputs[domain] = output
+	if !ok || previous == "" || previous == m.defaults.Output {
+		return
+	}
+	for _, used := range m.outputs {
+		if used == previous {
+			return
+		}
+	}
+	delete(m.failed, previous)
+	sink, ok := m.sinks[previous]
+	if !ok {
+		return
+	}
+	for key, logger := range m.loggers {
+		if logger.sink == sink {
+			delete(m.loggers, key)
+		}
+	}
+	delete(m.sinks, previous)
+	if err := sink.Close(); err != nil {
+		logging.Logger(logging.Proxy).Warn("Failed to close access log", "output", previous, "error", err)
+	}
+}
+
+// Close closes all sinks
+func (m *Manager) Close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, sink := range m.sinks {
+		sink.Close()
+	}
+}
@@ -0,0 +1,187 @@
+package accesslog
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// newTestManager returns a manager logging globally to a file, with a per-domain log directory
+func newTestManager(t *testing.T) (*Manager, string) {
+	t.Helper()
+	base := t.TempDir()
+	dir := filepath.Join(base, "domains")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(Options{Output: "file:" + filepath.Join(base, "global.log"), Dir: dir})
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	t.Cleanup(m.Close)
+	return m, dir
+}
+
+// readLog returns the contents of a log file, or an empty string if it doesn't exist
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFormat(t *testing.T) {
+	rec := &Record{
+		Time:      time.Date(2025, 1, 15, 10, 0, 0, 0, time.UTC),
+		ClientIP:  "192.0.2.1",
+		Host:      "app.example.com",
+		Method:    "GET",
+		Path:      "/page",
+		Protocol:  "HTTP/1.1",
+		Status:    200,
+		Bytes:     512,
+		UserAgent: "curl/8.0",
+	}
+	tests := []struct {
+		format, want string
+	}{
+		{FormatCommon, `192.0.2.1 - - [15/Jan/2025:10:00:00 +0000] "GET /page HTTP/1.1" 200 512`},
+		{FormatCombined, `192.0.2.1 - - [15/Jan/2025:10:00:00 +0000] "GET /page HTTP/1.1" 200 512 "-" "curl/8.0"`},
+		{FormatJSON, `{"time":"2025-01-15T10:00:00Z","client_ip":"192.0.2.1","host":"app.example.com","method":"GET",` +
+			`"path":"/page","protocol":"HTTP/1.1","status":200,"bytes":512,"duration_ms":0,"user_agent":"curl/8.0"}`},
+	}
+	for _, tt := range tests {
+		if got := string(Format(tt.format, rec)); got != tt.want {
+			t.Errorf("Format(%s) = %s, want %s", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestValidateOverride(t *testing.T) {
+	m, dir := newTestManager(t)
+	outside := t.TempDir()
+	// A symlink inside the log directory must not lead out of it
+	if err := os.Symlink(outside, filepath.Join(dir, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		output string
+		ok     bool
+	}{
+		{"stdout", true},
+		{m.defaults.Output, true},
+		{"file:app.log", true},
+		{"file:teams/app.log", true},
+		{"file:" + filepath.Join(dir, "app.log"), true},
+		{"file:../app.log", false},
+		{"file:" + filepath.Join(outside, "app.log"), false},
+		{"file:/etc/cron.d/proxy", false},
+		{"file:escape/app.log", false},
+		{"file:" + dir, false},
+		{"syslog", false},
+		{"syslog:udp://logs.example.com:514", false},
+		{"kafka://logs", false},
+	}
+	for _, tt := range tests {
+		if err := m.ValidateOverride(tt.output); (err == nil) != tt.ok {
+			t.Errorf("ValidateOverride(%s) error = %v, want success %v", tt.output, err, tt.ok)
+		}
+	}
+
+	// Without a log directory, domains can't log to files
+	m, err := NewManager(Options{Output: "stdout"})
+	if err != nil {
+		t.Fatalf("NewManager: %v", err)
+	}
+	if err := m.ValidateOverride("file:/var/log/app.log"); err == nil {
+		t.Error("ValidateOverride accepted a file without a log directory")
+	}
+}
+
+func TestDomainOverrides(t *testing.T) {
+	m, dir := newTestManager(t)
+	rec := &Record{Method: "GET", Path: "/", Status: 200}
+
+	first, err := m.Logger("app.example.com", &models.AccessLogConfig{Output: "file:first.log"})
+	if err != nil {
+		t.Fatalf("Logger: %v", err)
+	}
+	first.Log(rec)
+	if got := readLog(t, filepath.Join(dir, "first.log")); !strings.Contains(got, `"path":"/"`) {
+		t.Fatalf("first.log = %q, want the record", got)
+	}
+	// Another domain sharing the output keeps its sink open when the first one moves on
+	if _, err := m.Logger("other.example.com", &models.AccessLogConfig{Output: "file:first.log"}); err != nil {
+		t.Fatalf("Logger: %v", err)
+	}
+
+	second, err := m.Logger("app.example.com", &models.AccessLogConfig{Output: "file:second.log", Format: FormatCommon})
+	if err != nil {
+		t.Fatalf("Logger: %v", err)
+	}
+	second.Log(rec)
+	if _, ok := m.sinks["file:first.log"]; !ok {
+		t.Fatal("sink closed while another domain uses it")
+	}
+	if _, err := m.Logger("other.example.com", nil); err != nil {
+		t.Fatalf("Logger: %v", err)
+	}
+	if _, ok := m.sinks["file:first.log"]; ok {
+		t.Error("sink still open after no domain uses it")
+	}
+	if err := first.sink.Write([]byte("late")); err == nil {
+		t.Error("write to the replaced sink succeeded, want it closed")
+	}
+
+	// Disabling logging for a domain releases its output too
+	if logger, err := m.Logger("app.example.com", &models.AccessLogConfig{Disabled: true}); logger != nil || err != nil {
+		t.Fatalf("Logger = %v, %v for a disabled domain, want nil", logger, err)
+	}
+	if _, ok := m.sinks["file:second.log"]; ok {
+		t.Error("sink still open after the domain disabled logging")
+	}
+}
+
+func TestFailedOutputs(t *testing.T) {
+	m, dir := newTestManager(t)
+	global, err := m.Logger("", nil)
+	if err != nil || global == nil {
+		t.Fatalf("Logger = %v, %v, want the global logger", global, err)
+	}
+	// A directory can't be opened as a log file
+	if err := os.Mkdir(filepath.Join(dir, "taken.log"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	override := &models.AccessLogConfig{Output: "file:taken.log"}
+	logger, err := m.Logger("app.example.com", override)
+	if err == nil || logger != global {
+		t.Fatalf("Logger = %v, %v, want the global logger and an error", logger, err)
+	}
+	// The failure is remembered instead of being retried and reported for every request
+	logger, err = m.Logger("app.example.com", override)
+	if err != nil || logger != global {
+		t.Fatalf("Logger = %v, %v after a failure, want the global logger without an error", logger, err)
+	}
+
+	// Outputs that aren't allowed for domains fall back the same way
+	if logger, err := m.Logger("app.example.com", &models.AccessLogConfig{Output: "syslog"}); err == nil || logger != global {
+		t.Errorf("Logger = %v, %v for syslog, want the global logger and an error", logger, err)
+	}
+
+	// Once the retry interval passed, the output is opened again
+	if err := os.Remove(filepath.Join(dir, "taken.log")); err != nil {
+		t.Fatal(err)
+	}
+	m.failed["file:taken.log"] = time.Now().Add(-retryInterval)
+	logger, err = m.Logger("app.example.com", override)
+	if err != nil || logger == global {
+		t.Errorf("Logger = %v, %v after the retry interval, want the domain's logger", logger, err)
+	}
+}
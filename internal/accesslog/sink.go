@@ -0,0 +1,136 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Sink receives formatted access log lines
+type Sink interface {
+	Write(line []byte) error
+	Close() error
+}
+
+// ValidateOutput checks that an output specification is well formed without opening it
+func ValidateOutput(output string) error {
+	switch {
+	case output == "stdout", output == "syslog", strings.HasPrefix(output, "syslog:"):
+		return nil
+	case strings.HasPrefix(output, "file:"):
+		if path := strings.TrimPrefix(output, "file:"); path == "" || !filepath.IsAbs(path) && !filepath.IsLocal(path) {
+			return fmt.Errorf("invalid file path in %q", output)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported output %q, expected stdout, file:<path> or syslog", output)
+}
+
+// OpenSink opens the sink for an output specification
+func OpenSink(output string, maxSizeMB, maxBackups int) (Sink, error) {
+	if err := ValidateOutput(output); err != nil {
+		return nil, err
+	}
+	switch {
+	case output == "stdout":
+		return &writerSink{f: os.Stdout}, nil
+	case strings.HasPrefix(output, "file:"):
+		return newRotatingFile(strings.TrimPrefix(output, "file:"), int64(maxSizeMB)<<20, maxBackups)
+	default:
+		return newSyslogSink(strings.TrimPrefix(strings.TrimPrefix(output, "syslog"), ":"))
+	}
+}
+
+// writerSink writes lines to an already open file
+type writerSink struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (s *writerSink) Write(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.f.Write(append(line, '\n'))
+	return err
+}
+
+func (s *writerSink) Close() error {
+	return nil
+}
+
+// rotatingFile writes lines to a file, rotating it to path.1, path.2, ... when it
+// would grow beyond maxBytes
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func newRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create access log directory: %w", err)
+	}
+	r := &rotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat access log: %w", err)
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(line []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	line = append(line, '\n')
+	if r.maxBytes > 0 && r.size > 0 && r.size+int64(len(line)) > r.maxBytes {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.f.Write(line)
+	r.size += int64(n)
+	return err
+}
+
+// rotate shifts existing backups up by one and starts a new file; the caller must hold the lock
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	if r.maxBackups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxBackups))
+		for i := r.maxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+		}
+		if err := os.Rename(r.path, r.path+".1"); err != nil {
+			return fmt.Errorf("failed to rotate access log: %w", err)
+		}
+	} else if err := os.Truncate(r.path, 0); err != nil {
+		return fmt.Errorf("failed to truncate access log: %w", err)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,54 @@
+package accesslog
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		ok     bool
+	}{
+		{"stdout", true},
+		{"file:/var/log/proxy/access.log", true},
+		{"file:access.log", true},
+		{"syslog", true},
+		{"syslog:udp://logs.example.com:514", true},
+		{"file:", false},
+		{"file:../access.log", false},
+		{"stderr", false},
+	}
+	for _, tt := range tests {
+		if err := ValidateOutput(tt.output); (err == nil) != tt.ok {
+			t.Errorf("ValidateOutput(%s) error = %v, want success %v", tt.output, err, tt.ok)
+		}
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "access.log")
+	// Each line is 10 bytes with its newline, so every file holds two of them
+	f, err := newRotatingFile(path, 25, 2)
+	if err != nil {
+		t.Fatalf("newRotatingFile: %v", err)
+	}
+	defer f.Close()
+	for _, line := range []string{"line 0001", "line 0002", "line 0003", "line 0004", "line 0005", "line 0006", "line 0007"} {
+		if err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+
+	// The oldest file beyond the two backups was removed
+	for file, want := range map[string]string{
+		path:        "line 0007\n",
+		path + ".1": "line 0005\nline 0006\n",
+		path + ".2": "line 0003\nline 0004\n",
+		path + ".3": "",
+	} {
+		if got := readLog(t, file); got != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !windows && !plan9
+
+package accesslog
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+// syslogSink sends lines to the local syslog daemon or a remote one
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogSink connects to syslog. An empty address uses the local daemon;
+// otherwise it is a URL such as udp://logs.example.com:514.
+func newSyslogSink(address string) (Sink, error) {
+	network, raddr := "", ""
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %q, expected e.g. udp://host:514", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_LOCAL0, "simple-proxy")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) Write(line []byte) error {
+	return s.w.Info(string(line))
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
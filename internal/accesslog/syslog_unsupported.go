@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package accesslog
+
+import "fmt"
+
+// newSyslogSink reports that syslog is unavailable on this platform
+func newSyslogSink(address string) (Sink, error) {
+	return nil, fmt.Errorf("syslog output is not supported on this platform")
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// ListAPIKeys handles GET /api/keys. Hashes are never returned.
+func (h *Handlers) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	if !requireUnrestricted(w, r) {
+		return
+	}
+	keys, err := h.db.ListAPIKeys()
+	if err != nil {
+		http.Error(w, "Failed to retrieve api keys: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// CreateAPIKey handles POST /api/keys. The key is only returned in this response. Keys
+// restricted to some domains can only create keys with a subset of their scopes and domains.
+func (h *Handlers) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req models.CreateAPIKeyRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Missing required fields: name", http.StatusBadRequest)
+		return
+	}
+	if err := auth.ValidateScopes(req.Scopes); err != nil {
+		http.Error(w, "Invalid scopes: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := auth.ValidateDomainPatterns(req.Domains); err != nil {
+		http.Error(w, "Invalid domains: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !auth.FromContext(r.Context()).Covers(req.Scopes, req.Domains) {
+		logger().WarnContext(r.Context(), "API key creation denied", "name", req.Name, "scopes", req.Scopes,
+			"domains", req.Domains, "remote_addr", r.RemoteAddr)
+		http.Error(w, "Forbidden: key can't grant scopes or domains it doesn't have", http.StatusForbidden)
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		http.Error(w, "Invalid expires_at: must be in the future", http.StatusBadRequest)
+		return
+	}
+
+	key, id, hash := auth.GenerateKey()
+	created, err := h.db.CreateAPIKey(id, hash, req)
+	if err != nil {
+		http.Error(w, "Failed to create api key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Logged at warn so new credentials are recorded even when the API subsystem is quiet
+	logger().WarnContext(r.Context(), "API key created", "new_key_id", created.ID, "name", created.Name,
+		"scopes", created.Scopes, "domains", created.Domains, "remote_addr", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(models.CreateAPIKeyResponse{APIKey: *created, Key: key})
+}
+
+// RevokeAPIKey handles DELETE /api/keys/:id. Revoked keys stay listed, so they can still be
+// matched with the key_id of earlier log entries.
+func (h *Handlers) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !requireUnrestricted(w, r) {
+		return
+	}
+	id := mux.Vars(r)["id"]
+	key, err := h.db.RevokeAPIKey(id)
+	if err != nil {
+		http.Error(w, "Failed to revoke api key: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if key == nil {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	logger().WarnContext(r.Context(), "API key revoked", "revoked_key_id", key.ID, "name", key.Name, "remote_addr", r.RemoteAddr)
+
+	w.WriteHeader(http.StatusNoContent)
+}
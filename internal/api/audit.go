@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+	"github.com/itsnoxius/simple-proxy/internal/database"
+	"github.com/itsnoxius/simple-proxy/internal/requestid"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+const (
+	// defaultAuditLimit is the number of audit records returned when no limit is given
+	defaultAuditLimit = 100
+	// maxAuditLimit bounds the number of audit records returned at once
+	maxAuditLimit = 1000
+)
+
+// actor returns who made a request, to be recorded in the audit log along with the
+// changes it makes. Changes are written together with their audit entries, so a change
+// that can't be audited fails.
+func actor(r *http.Request) models.Actor {
+	actor := models.Actor{
+		SourceIP:  sourceIP(r),
+		RequestID: requestid.FromContext(r.Context()),
+	}
+	if principal := auth.FromContext(r.Context()); principal != nil {
+		actor.Name = principal.Name
+		actor.KeyID = principal.KeyID
+	}
+	return actor
+}
+
+// sourceIP returns the address of the client connection without its port
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ListAudit handles GET /api/audit. Records can be filtered by domain, actor and a time
+// range (since, until as RFC 3339 timestamps), and are returned newest first. limit
+// bounds the number of records; pass the smallest id returned as before_id for the next page.
+func (h *Handlers) ListAudit(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := database.AuditQuery{
+		Domain: query.Get("domain"),
+		Actor:  query.Get("actor"),
+		Limit:  defaultAuditLimit,
+	}
+	for name, t := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				http.Error(w, "Invalid "+name+": expected an RFC 3339 timestamp", http.StatusBadRequest)
+				return
+			}
+			*t = parsed
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			http.Error(w, "Invalid limit: must be between 1 and "+strconv.Itoa(maxAuditLimit), http.StatusBadRequest)
+			return
+		}
+		q.Limit = limit
+	}
+	if value := query.Get("before_id"); value != "" {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || id < 1 {
+			http.Error(w, "Invalid before_id", http.StatusBadRequest)
+			return
+		}
+		q.BeforeID = id
+	}
+
+	// Keys restricted to some domains only see the records of those
+	principal := auth.FromContext(r.Context())
+	if q.Domain != "" && !principal.AllowsDomain(q.Domain) {
+		http.Error(w, "Forbidden: key is not allowed to access domain "+q.Domain, http.StatusForbidden)
+		return
+	}
+	if principal.Restricted() {
+		q.DomainPatterns = principal.Domains
+	}
+
+	records, err := h.db.ListAudit(q)
+	if err != nil {
+		http.Error(w, "Failed to retrieve audit log: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(records)
+}
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/itsnoxius/simple-proxy/internal/database"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// batchError fails an operation of a batch with the status it would have had as a single request
+type batchError struct {
+	status int
+	err    error
+}
+
+func (e *batchError) Error() string {
+	return e.err.Error()
+}
+
+// ApplyBatch handles POST /api/config/batch, applying create, update, upsert and delete
+// operations in order in a single transaction. In atomic mode nothing is applied unless
+// every operation succeeds; in best-effort mode failing operations are skipped. The
+// response reports the outcome of every operation.
+func (h *Handlers) ApplyBatch(w http.ResponseWriter, r *http.Request) {
+	var req models.BatchRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	mode := cmp.Or(req.Mode, models.BatchAtomic)
+	if mode != models.BatchAtomic && mode != models.BatchBestEffort {
+		http.Error(w, "Invalid mode: must be "+models.BatchAtomic+" or "+models.BatchBestEffort, http.StatusBadRequest)
+		return
+	}
+	if len(req.Operations) == 0 {
+		http.Error(w, "Missing required fields: operations", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]models.BatchResult, len(req.Operations))
+	var ops []models.BatchOperation
+	var indexes []int
+	for i, op := range req.Operations {
+		results[i] = models.BatchResult{Op: op.Op, Domain: op.Domain}
+		switch {
+		case op.Op != models.BatchCreate && op.Op != models.BatchUpdate && op.Op != models.BatchUpsert && op.Op != models.BatchDelete:
+			results[i].Status, results[i].Error = http.StatusBadRequest, "Invalid op: must be create, update, upsert or delete"
+		case op.Domain == "":
+			results[i].Status, results[i].Error = http.StatusBadRequest, "Missing required fields: domain"
+		default:
+			ops = append(ops, op)
+			indexes = append(indexes, i)
+		}
+	}
+	atomic := mode == models.BatchAtomic
+	if atomic && len(ops) < len(req.Operations) {
+		writeBatch(w, mode, results, http.StatusBadRequest)
+		return
+	}
+
+	// Operations are checked against the state left by the ones before them
+	outcomes, snapshot, err := h.db.ApplyBatch(actor(r), ops, atomic, func(op models.BatchOperation, before, after *models.Domain) error {
+		if err := h.checkDomainAccess(r, op.Domain, privilegedChanges(before, after)); err != nil {
+			return &batchError{status: http.StatusForbidden, err: err}
+		}
+		if after != nil {
+			if err := h.validateConfig(after, r); err != nil {
+				return &batchError{status: http.StatusBadRequest, err: err}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to apply batch: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusOK
+	for j, outcome := range outcomes {
+		result := &results[indexes[j]]
+		if outcome.Err != nil {
+			result.Status, result.Error = operationError(outcome.Err)
+			status = result.Status
+			continue
+		}
+		change := outcome.Change
+		result.Result = change.After
+		switch {
+		case change.Before == nil:
+			result.Status = http.StatusCreated
+		case change.After == nil:
+			result.Status = http.StatusNoContent
+		default:
+			result.Status = http.StatusOK
+		}
+	}
+	if atomic && status != http.StatusOK {
+		logger().InfoContext(r.Context(), "Domain batch rolled back", "operations", len(ops), "status", status,
+			"remote_addr", r.RemoteAddr)
+		writeBatch(w, mode, results, status)
+		return
+	}
+
+	for _, outcome := range outcomes {
+		change := outcome.Change
+		if outcome.Err != nil || database.SameConfig(change.Before, change.After) {
+			continue
+		}
+		h.cache.Purge(change.Domain, "", "")
+	}
+	snapshotID := setSnapshotHeader(w, snapshot)
+	response := writeBatch(w, mode, results, http.StatusOK)
+	logger().InfoContext(r.Context(), "Domain batch applied", "mode", mode, "applied", response.Applied,
+		"failed", response.Failed, "snapshot_id", snapshotID, "remote_addr", r.RemoteAddr)
+}
+
+// writeBatch writes the results of a batch. A failed atomic batch applies nothing, so
+// results of operations that would have succeeded are reported as not applied.
+func writeBatch(w http.ResponseWriter, mode string, results []models.BatchResult, status int) models.BatchResponse {
+	response := models.BatchResponse{Mode: mode, Results: results}
+	for i := range results {
+		if status != http.StatusOK && results[i].Error == "" {
+			results[i].Status = http.StatusFailedDependency
+			results[i].Error = "Not applied: another operation of the atomic batch failed"
+			results[i].Result = nil
+		}
+		if results[i].Error != "" {
+			response.Failed++
+		} else {
+			response.Applied++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+	return response
+}
+
+// operationError returns the HTTP status and message of a failed batch operation
+func operationError(err error) (int, string) {
+	var oe *batchError
+	switch {
+	case errors.As(err, &oe):
+		return oe.status, oe.Error()
+	case errors.Is(err, database.ErrDomainNotFound):
+		return http.StatusNotFound, "Domain not found"
+	case errors.Is(err, database.ErrDomainExists):
+		return http.StatusConflict, "Domain already exists"
+	case errors.Is(err, database.ErrVersionMismatch):
+		return http.StatusPreconditionFailed, "Precondition failed: version doesn't match"
+	default:
+		return http.StatusInternalServerError, "Failed to apply operation: " + err.Error()
+	}
+}
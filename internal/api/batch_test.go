@@ -0,0 +1,177 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/itsnoxius/simple-proxy/internal/accesslog"
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+	"github.com/itsnoxius/simple-proxy/internal/cache"
+	"github.com/itsnoxius/simple-proxy/internal/database"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// admin is a principal granted every scope on every domain
+var admin = &auth.Principal{Name: "test", Scopes: []string{auth.ScopeAdmin}}
+
+// newTestHandlers returns handlers backed by a temporary database holding the given domains
+func newTestHandlers(t *testing.T, domains ...string) (*Handlers, *database.DB) {
+	t.Helper()
+	db, err := database.New(filepath.Join(t.TempDir(), "proxy.db"))
+	if err != nil {
+		t.Fatalf("database.New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, domain := range domains {
+		if _, err := db.CreateDomain(models.Actor{}, models.CreateDomainRequest{Domain: domain, IP: "10.0.0.1", Port: 80}); err != nil {
+			t.Fatalf("CreateDomain(%s): %v", domain, err)
+		}
+	}
+	accessLogs, err := accesslog.NewManager(accesslog.Options{})
+	if err != nil {
+		t.Fatalf("accesslog.NewManager: %v", err)
+	}
+	return NewHandlers(db, cache.New(cache.NewMemoryStore(1<<20)), accessLogs, "", nil, ""), db
+}
+
+// call sends a request with a JSON body to a handler as principal
+func call(handler http.HandlerFunc, principal *auth.Principal, method, target, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r = r.WithContext(auth.NewContext(r.Context(), principal))
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+// domainNames returns the names of the stored domains, sorted
+func domainNames(t *testing.T, db *database.DB) string {
+	t.Helper()
+	domains, err := db.GetAllDomains()
+	if err != nil {
+		t.Fatalf("GetAllDomains: %v", err)
+	}
+	names := make([]string, len(domains))
+	for i, d := range domains {
+		names[i] = d.Domain
+	}
+	return strings.Join(names, " ")
+}
+
+func TestApplyBatch(t *testing.T) {
+	restricted := &auth.Principal{Name: "team", Scopes: []string{auth.ScopeDomainsWrite}, Domains: []string{"*.team.example.com"}}
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		body      string
+		status    int
+		// results are the expected statuses of the operations
+		results  []int
+		domains  string
+		snapshot bool
+	}{
+		{
+			name:      "atomic",
+			principal: admin,
+			body: `{"operations": [{"op": "create", "domain": "b.example.com", "ip": "10.0.0.2", "port": 80},
+				{"op": "update", "domain": "a.example.com", "ip": "10.0.0.3", "port": 80},
+				{"op": "delete", "domain": "a.example.com"}]}`,
+			status:   http.StatusOK,
+			results:  []int{http.StatusCreated, http.StatusOK, http.StatusNoContent},
+			domains:  "b.example.com",
+			snapshot: true,
+		},
+		{
+			name:      "atomic failure applies nothing",
+			principal: admin,
+			body: `{"operations": [{"op": "create", "domain": "b.example.com", "ip": "10.0.0.2", "port": 80},
+				{"op": "create", "domain": "a.example.com", "ip": "10.0.0.2", "port": 80}]}`,
+			status:  http.StatusConflict,
+			results: []int{http.StatusFailedDependency, http.StatusConflict},
+			domains: "a.example.com",
+		},
+		{
+			name:      "invalid operation fails atomic batch before applying",
+			principal: admin,
+			body: `{"operations": [{"op": "create", "domain": "b.example.com", "ip": "10.0.0.2", "port": 80},
+				{"op": "rename", "domain": "a.example.com"}]}`,
+			status:  http.StatusBadRequest,
+			results: []int{http.StatusFailedDependency, http.StatusBadRequest},
+			domains: "a.example.com",
+		},
+		{
+			name:      "best effort skips failures",
+			principal: admin,
+			body: `{"mode": "best-effort", "operations": [{"op": "delete", "domain": "c.example.com"},
+				{"op": "upsert", "domain": "b.example.com", "ip": "10.0.0.2", "port": 80},
+				{"op": "create", "domain": "c.example.com"}]}`,
+			status:   http.StatusOK,
+			results:  []int{http.StatusNotFound, http.StatusCreated, http.StatusBadRequest},
+			domains:  "a.example.com b.example.com",
+			snapshot: true,
+		},
+		{
+			name:      "best effort without changes keeps no snapshot",
+			principal: admin,
+			body: `{"mode": "best-effort", "operations": [{"op": "upsert", "domain": "a.example.com", "ip": "10.0.0.1", "port": 80},
+				{"op": "delete", "domain": "c.example.com"}]}`,
+			status:  http.StatusOK,
+			results: []int{http.StatusOK, http.StatusNotFound},
+			domains: "a.example.com",
+		},
+		{
+			name:      "restricted key",
+			principal: restricted,
+			body: `{"mode": "best-effort", "operations": [{"op": "delete", "domain": "a.example.com"},
+				{"op": "create", "domain": "app.team.example.com", "ip": "10.0.0.2", "port": 80}]}`,
+			status:   http.StatusOK,
+			results:  []int{http.StatusForbidden, http.StatusCreated},
+			domains:  "a.example.com app.team.example.com",
+			snapshot: true,
+		},
+		{
+			name:      "invalid mode",
+			principal: admin,
+			body:      `{"mode": "eventually", "operations": [{"op": "delete", "domain": "a.example.com"}]}`,
+			status:    http.StatusBadRequest,
+			domains:   "a.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, db := newTestHandlers(t, "a.example.com")
+			w := call(h.ApplyBatch, tt.principal, http.MethodPost, "/api/config/batch", tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.results != nil {
+				var response models.BatchResponse
+				if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+					t.Fatalf("invalid response: %v", err)
+				}
+				var got []int
+				for _, result := range response.Results {
+					got = append(got, result.Status)
+				}
+				if !slices.Equal(got, tt.results) {
+					t.Errorf("result statuses = %v, want %v", got, tt.results)
+				}
+			}
+			if got := domainNames(t, db); got != tt.domains {
+				t.Errorf("domains = %q, want %q", got, tt.domains)
+			}
+			snapshots, err := db.ListSnapshots()
+			if err != nil {
+				t.Fatalf("ListSnapshots: %v", err)
+			}
+			header := w.Header().Get("X-Snapshot-ID")
+			if kept := len(snapshots) == 1; kept != tt.snapshot || (header != "") != tt.snapshot {
+				t.Errorf("snapshot stored = %v with X-Snapshot-ID %q, want %v", kept, header, tt.snapshot)
+			}
+		})
+	}
+}
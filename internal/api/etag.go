@@ -0,0 +1,66 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// etag returns the entity tag of a domain mapping. Besides the version it hashes the
+// mapping as served, including when it was created, so the tag of a deleted mapping doesn't
+// match one recreated under the same name at the same version.
+func etag(d *models.Domain) string {
+	data, _ := json.Marshal(d)
+	sum := sha256.Sum256(data)
+	return `"` + strconv.FormatInt(d.Version, 10) + "-" + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// writeDomain writes a domain mapping as JSON along with its ETag
+func writeDomain(w http.ResponseWriter, status int, d *models.Domain) {
+	w.Header().Set("ETag", etag(d))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(d)
+}
+
+// expectedVersion checks the If-Match header and a version given in the request body
+// against the stored mapping, writing 412 Precondition Failed if either doesn't match.
+// It returns the version the write must be conditional on, or 0 without preconditions.
+func expectedVersion(w http.ResponseWriter, r *http.Request, existing *models.Domain, version int64) (int64, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" && version == 0 {
+		return 0, true
+	}
+
+	if header != "" && !matchesETag(header, existing) {
+		http.Error(w, "Precondition failed: domain has been modified, current version is "+
+			strconv.FormatInt(existing.Version, 10), http.StatusPreconditionFailed)
+		return 0, false
+	}
+	if version != 0 && version != existing.Version {
+		http.Error(w, "Precondition failed: version "+strconv.FormatInt(version, 10)+
+			" doesn't match current version "+strconv.FormatInt(existing.Version, 10), http.StatusPreconditionFailed)
+		return 0, false
+	}
+	return existing.Version, true
+}
+
+// matchesETag reports whether an If-Match header matches the ETag of a mapping. Entity
+// tags are compared strongly, so weak tags never match.
+func matchesETag(header string, d *models.Domain) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	current := etag(d)
+	for tag := range strings.SplitSeq(header, ",") {
+		if strings.TrimSpace(tag) == current {
+			return true
+		}
+	}
+	return false
+}
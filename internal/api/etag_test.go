@@ -0,0 +1,56 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+)
+
+func TestIfMatch(t *testing.T) {
+	h, _ := newTestHandlers(t)
+	vars := map[string]string{"domain": "app.example.com"}
+	update := func(ifMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/api/config/app.example.com", strings.NewReader(`{"ip": "10.0.0.3", "port": 80}`))
+		r = r.WithContext(auth.NewContext(r.Context(), admin))
+		r.Header.Set("If-Match", ifMatch)
+		w := httptest.NewRecorder()
+		withVars(h.UpdateDomain, vars)(w, r)
+		return w
+	}
+
+	w := call(h.CreateDomain, admin, http.MethodPost, "/api/config", `{"domain": "app.example.com", "ip": "10.0.0.1", "port": 80}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", w.Code, w.Body)
+	}
+	stale := w.Header().Get("ETag")
+
+	// A mapping recreated under the same name starts at the same version again
+	if w := call(withVars(h.DeleteDomain, vars), admin, http.MethodDelete, "/api/config/app.example.com", ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete status = %d: %s", w.Code, w.Body)
+	}
+	w = call(h.CreateDomain, admin, http.MethodPost, "/api/config", `{"domain": "app.example.com", "ip": "10.0.0.2", "port": 80}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("recreate status = %d: %s", w.Code, w.Body)
+	}
+	current := w.Header().Get("ETag")
+	if current == stale {
+		t.Fatalf("recreated mapping has the ETag %s of the deleted one", current)
+	}
+
+	if w := update(stale); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("update with the deleted mapping's ETag: status = %d, want 412: %s", w.Code, w.Body)
+	}
+	w = update(current)
+	if w.Code != http.StatusOK {
+		t.Fatalf("update with the current ETag: status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if w.Header().Get("ETag") == current {
+		t.Error("ETag unchanged by the update")
+	}
+	if w := update(current); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("update with the replaced ETag: status = %d, want 412: %s", w.Code, w.Body)
+	}
+}
@@ -1,31 +1,81 @@
 package api
 
 import (
+	"bytes"
+	"cmp"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"mime"
 	"net/http"
 	"net/url"
+	"reflect"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/itsnoxius/simple-proxy/internal/accesslog"
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+	"github.com/itsnoxius/simple-proxy/internal/cache"
+	"github.com/itsnoxius/simple-proxy/internal/compress"
 	"github.com/itsnoxius/simple-proxy/internal/database"
+	"github.com/itsnoxius/simple-proxy/internal/jsonpatch"
+	"github.com/itsnoxius/simple-proxy/internal/logging"
+	"github.com/itsnoxius/simple-proxy/internal/mirror"
+	"github.com/itsnoxius/simple-proxy/internal/proxy"
+	"github.com/itsnoxius/simple-proxy/internal/static"
 	"github.com/itsnoxius/simple-proxy/pkg/models"
 )
 
 // Handlers contains HTTP handlers for the API
 type Handlers struct {
-	db        *database.DB
-	apiKey    string
-	authToken string
+	db         *database.DB
+	cache      *cache.Cache
+	accessLogs *accesslog.Manager
+	// apiKey is the bootstrap key from PROXY_API_KEY, which is granted every scope
+	apiKey string
+	// jwt validates JWT bearer tokens; nil when JWT authentication is disabled
+	jwt *auth.JWTVerifier
+	// staticRoot is the directory static roots must be inside; when empty, only unrestricted
+	// admins may set static roots
+	staticRoot string
 }
 
 // NewHandlers creates a new handlers instance
-func NewHandlers(db *database.DB, apiKey string) *Handlers {
+func NewHandlers(db *database.DB, responseCache *cache.Cache, accessLogs *accesslog.Manager, apiKey string,
+	jwt *auth.JWTVerifier, staticRoot string) *Handlers {
 	return &Handlers{
-		db:        db,
-		apiKey:    apiKey,
-		authToken: "Bearer " + apiKey,
+		db:         db,
+		cache:      responseCache,
+		accessLogs: accessLogs,
+		apiKey:     apiKey,
+		jwt:        jwt,
+		staticRoot: staticRoot,
+	}
+}
+
+// logger returns the API subsystem logger
+func logger() *slog.Logger {
+	return logging.Logger(logging.API)
+}
+
+// requestDomain returns the request's host without a port
+func requestDomain(r *http.Request) string {
+	// Strip port from host if present (e.g., "example.com:80" -> "example.com")
+	if idx := strings.LastIndex(r.Host, ":"); idx != -1 {
+		return r.Host[:idx]
+	}
+	return r.Host
+}
+
+// HostMatcher matches requests for the API domain, so admin routes outside /api don't
+// shadow the same paths on proxied domains
+func HostMatcher(allowedDomain string) mux.MatcherFunc {
+	return func(r *http.Request, _ *mux.RouteMatch) bool {
+		return requestDomain(r) == allowedDomain
 	}
 }
 
@@ -33,14 +83,8 @@ func NewHandlers(db *database.DB, apiKey string) *Handlers {
 func DomainMiddleware(allowedDomain string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			host := r.Host
-			// Strip port from host if present (e.g., "example.com:80" -> "example.com")
-			domainName := host
-			if idx := strings.LastIndex(host, ":"); idx != -1 {
-				domainName = host[:idx]
-			}
-
-			if domainName != allowedDomain {
+			if requestDomain(r) != allowedDomain {
+				logger().DebugContext(r.Context(), "Rejected API request for other domain", "host", r.Host, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
 				http.Error(w, "Forbidden: API access restricted to specific domain", http.StatusForbidden)
 				return
 			}
@@ -49,18 +93,127 @@ func DomainMiddleware(allowedDomain string) func(http.Handler) http.Handler {
 	}
 }
 
-// AuthMiddleware validates API key authentication
+// AuthMiddleware validates API key or JWT authentication and adds the authenticated
+// principal to the request context. Keys are compared in constant time.
 func (h *Handlers) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader != h.authToken {
+		principal, reason := h.authenticate(r)
+		if principal == nil {
+			logger().WarnContext(r.Context(), "Unauthorized API request", "method", r.Method, "path", r.URL.Path,
+				"remote_addr", r.RemoteAddr, "reason", reason)
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
+		r = r.WithContext(auth.NewContext(r.Context(), principal))
+		logger().DebugContext(r.Context(), "API request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticate returns the principal of a request's credentials, or nil and the reason
+// they were rejected
+func (h *Handlers) authenticate(r *http.Request) (*auth.Principal, string) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, "missing credentials"
+	}
+	if h.apiKey != "" && auth.Equal(token, h.apiKey) {
+		return &auth.Principal{Name: "bootstrap", Scopes: []string{auth.ScopeAdmin}}, ""
+	}
+
+	if h.jwt != nil && auth.LooksLikeJWT(token) {
+		principal, err := h.jwt.Verify(r.Context(), token)
+		if err != nil {
+			return nil, "invalid token: " + err.Error()
+		}
+		return principal, ""
+	}
+
+	id, secret, ok := auth.ParseKey(token)
+	if !ok {
+		return nil, "invalid key"
+	}
+	key, hash, err := h.db.GetAPIKey(id)
+	if err != nil {
+		logger().ErrorContext(r.Context(), "Failed to look up API key", "key_id", id, "error", err)
+		return nil, "key lookup failed"
+	}
+	// Unknown keys are still hashed and compared, so they take as long to reject as wrong secrets
+	if key == nil {
+		auth.Equal(auth.HashSecret(secret), "")
+		return nil, "invalid key"
+	}
+	if !auth.Equal(auth.HashSecret(secret), hash) {
+		return nil, "invalid key"
+	}
+	if key.RevokedAt != nil {
+		return nil, "key " + key.ID + " is revoked"
+	}
+	if key.ExpiresAt != nil && !time.Now().Before(*key.ExpiresAt) {
+		return nil, "key " + key.ID + " is expired"
+	}
+	return &auth.Principal{Name: key.Name, KeyID: key.ID, Scopes: key.Scopes, Domains: key.Domains}, ""
+}
+
+// Require returns middleware serving requests only to principals granted scope
+func Require(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !auth.FromContext(r.Context()).Can(scope) {
+				logger().WarnContext(r.Context(), "Forbidden API request", "method", r.Method, "path", r.URL.Path,
+					"scope", scope, "remote_addr", r.RemoteAddr)
+				http.Error(w, "Forbidden: missing scope "+scope, http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Unrestricted is middleware rejecting keys restricted to some domains, for endpoints
+// that affect the whole process
+func Unrestricted(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requireUnrestricted(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// authorizeDomain checks that the principal may change a domain with the given options.
+// On failure a 403 is written and false is returned.
+func (h *Handlers) authorizeDomain(w http.ResponseWriter, r *http.Request, domain string, options models.DomainOptions) bool {
+	if err := h.checkDomainAccess(r, domain, options); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// checkDomainAccess returns an error if the principal may not change a domain with the
+// given options. Certificate settings additionally require the certs scope, and static
+// settings require an unrestricted admin unless static roots are confined to STATIC_ROOT.
+func (h *Handlers) checkDomainAccess(r *http.Request, domain string, options models.DomainOptions) error {
+	principal := auth.FromContext(r.Context())
+	if !principal.AllowsDomain(domain) {
+		logger().WarnContext(r.Context(), "Forbidden API request for domain", "method", r.Method, "path", r.URL.Path,
+			"domain", domain, "remote_addr", r.RemoteAddr)
+		return fmt.Errorf("Forbidden: key is not allowed to access domain %s", domain)
+	}
+	if (options.UpstreamTLS != nil || options.ClientAuth != nil) && !principal.Can(auth.ScopeCerts) {
+		logger().WarnContext(r.Context(), "Forbidden API request", "method", r.Method, "path", r.URL.Path,
+			"scope", auth.ScopeCerts, "remote_addr", r.RemoteAddr)
+		return fmt.Errorf("Forbidden: missing scope %s to change upstream_tls or client_auth", auth.ScopeCerts)
+	}
+	// Unconfined static roots can expose any file the proxy can read
+	if !options.Static.IsZero() && h.staticRoot == "" && (!principal.Can(auth.ScopeAdmin) || principal.Restricted()) {
+		logger().WarnContext(r.Context(), "Forbidden API request", "method", r.Method, "path", r.URL.Path,
+			"scope", auth.ScopeAdmin, "remote_addr", r.RemoteAddr)
+		return fmt.Errorf("Forbidden: static requires an unrestricted key with scope %s unless STATIC_ROOT is set", auth.ScopeAdmin)
+	}
+	return nil
+}
+
 // ListDomains handles GET /api/config
 func (h *Handlers) ListDomains(w http.ResponseWriter, r *http.Request) {
 	domains, err := h.db.GetAllDomains()
@@ -68,6 +221,9 @@ func (h *Handlers) ListDomains(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Failed to retrieve domains: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if principal := auth.FromContext(r.Context()); principal.Restricted() {
+		domains = slices.DeleteFunc(domains, func(d models.Domain) bool { return !principal.AllowsDomain(d.Domain) })
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(domains)
@@ -81,6 +237,9 @@ func (h *Handlers) GetDomain(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid domain parameter", http.StatusBadRequest)
 		return
 	}
+	if !h.authorizeDomain(w, r, domain, models.DomainOptions{}) {
+		return
+	}
 
 	domainModel, err := h.db.GetDomain(domain)
 	if err != nil {
@@ -93,8 +252,7 @@ func (h *Handlers) GetDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(domainModel)
+	writeDomain(w, http.StatusOK, domainModel)
 }
 
 // CreateDomain handles POST /api/config
@@ -106,8 +264,15 @@ func (h *Handlers) CreateDomain(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate required fields
-	if req.Domain == "" || req.IP == "" || req.Port == 0 {
-		http.Error(w, "Missing required fields: domain, ip, port", http.StatusBadRequest)
+	if req.Domain == "" {
+		http.Error(w, "Missing required fields: domain", http.StatusBadRequest)
+		return
+	}
+	if !h.authorizeDomain(w, r, req.Domain, req.DomainOptions) {
+		return
+	}
+	if err := validateBackend(req.IP, req.Port, req.Target, req.DomainOptions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -116,15 +281,19 @@ func (h *Handlers) CreateDomain(w http.ResponseWriter, r *http.Request) {
 		req.Protocol = "http"
 	}
 
-	domain, err := h.db.CreateDomain(req)
+	if err := h.validateOptions(req.Domain, req.DomainOptions, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	domain, err := h.db.CreateDomain(actor(r), req)
 	if err != nil {
 		http.Error(w, "Failed to create domain: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	logger().InfoContext(r.Context(), "Domain created", "domain", domain.Domain, "remote_addr", r.RemoteAddr)
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(domain)
+	writeDomain(w, http.StatusCreated, domain)
 }
 
 // UpdateDomain handles PUT /api/config/:domain
@@ -141,10 +310,36 @@ func (h *Handlers) UpdateDomain(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !h.authorizeDomain(w, r, domain, req.DomainOptions) {
+		return
+	}
+
+	existing, err := h.db.GetDomain(domain)
+	if err != nil {
+		http.Error(w, "Failed to retrieve domain: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.Error(w, "Domain not found", http.StatusNotFound)
+		return
+	}
+	version, ok := expectedVersion(w, r, existing, req.Version)
+	if !ok {
+		return
+	}
+
+	// Static and upstreams settings omitted from the request are kept, so validate against the stored ones
+	backendOptions := req.DomainOptions
+	if backendOptions.Static == nil {
+		backendOptions.Static = existing.Static
+	}
+	if backendOptions.Upstreams == nil {
+		backendOptions.Upstreams = existing.Upstreams
+	}
 
 	// Validate required fields
-	if req.IP == "" || req.Port == 0 {
-		http.Error(w, "Missing required fields: ip, port", http.StatusBadRequest)
+	if err := validateBackend(req.IP, req.Port, req.Target, backendOptions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
@@ -153,7 +348,19 @@ func (h *Handlers) UpdateDomain(w http.ResponseWriter, r *http.Request) {
 		req.Protocol = "http"
 	}
 
-	domainModel, err := h.db.UpdateDomain(domain, req)
+	// Responses leave client keys out, so settings sent back with the same certificate keep the stored key
+	req.UpstreamTLS.KeepClientKey(existing.UpstreamTLS)
+
+	if err := h.validateOptions(domain, req.DomainOptions, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	domainModel, err := h.db.UpdateDomain(actor(r), domain, req, version)
+	if errors.Is(err, database.ErrVersionMismatch) {
+		http.Error(w, "Precondition failed: domain has been modified", http.StatusPreconditionFailed)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Failed to update domain: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -164,8 +371,164 @@ func (h *Handlers) UpdateDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(domainModel)
+	logger().InfoContext(r.Context(), "Domain updated", "domain", domain, "remote_addr", r.RemoteAddr)
+
+	// Cached responses may no longer match the new backend
+	h.cache.Purge(domain, "", "")
+
+	writeDomain(w, http.StatusOK, domainModel)
+}
+
+// PatchDomain handles PATCH /api/config/:domain, changing only the given fields of a domain
+// without resending the rest of its configuration, e.g. to step canary weights during a
+// rollout. The body is an RFC 7396 merge patch of the domain document, or an RFC 6902 JSON
+// Patch when sent as application/json-patch+json. Changing the domain field renames it.
+func (h *Handlers) PatchDomain(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	domain, err := url.PathUnescape(vars["domain"])
+	if err != nil {
+		http.Error(w, "Invalid domain parameter", http.StatusBadRequest)
+		return
+	}
+	if !h.authorizeDomain(w, r, domain, models.DomainOptions{}) {
+		return
+	}
+
+	mediaType := "application/json"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, err = mime.ParseMediaType(contentType); err != nil {
+			http.Error(w, "Invalid Content-Type: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if mediaType != "application/json" && mediaType != jsonpatch.MergePatchType && mediaType != jsonpatch.PatchType {
+		http.Error(w, "Unsupported Content-Type: use "+jsonpatch.MergePatchType+" or "+jsonpatch.PatchType, http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	existing, err := h.db.GetDomain(domain)
+	if err != nil {
+		http.Error(w, "Failed to retrieve domain: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.Error(w, "Domain not found", http.StatusNotFound)
+		return
+	}
+	document, err := json.Marshal(existing)
+	if err != nil {
+		http.Error(w, "Failed to encode domain: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	doc, err := jsonpatch.Decode(document)
+	if err != nil {
+		http.Error(w, "Failed to encode domain: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// version, created_at and updated_at are read-only; a version in a merge patch must
+	// match the stored one like an If-Match header, and JSON Patches can test it instead
+	var bodyVersion int64
+	if mediaType == jsonpatch.PatchType {
+		var operations []jsonpatch.Operation
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&operations); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if doc, err = jsonpatch.Apply(doc, operations); err != nil {
+			status := http.StatusBadRequest
+			if errors.Is(err, jsonpatch.ErrTestFailed) {
+				status = http.StatusConflict
+			}
+			http.Error(w, "Invalid patch: "+err.Error(), status)
+			return
+		}
+	} else {
+		patch, err := jsonpatch.Decode(body)
+		if err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if members, ok := patch.(map[string]interface{}); ok {
+			if version, ok := members["version"].(json.Number); ok {
+				if bodyVersion, err = version.Int64(); err != nil {
+					http.Error(w, "Invalid version: "+err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			delete(members, "version")
+		}
+		doc = jsonpatch.MergePatch(doc, patch)
+	}
+	version, ok := expectedVersion(w, r, existing, bodyVersion)
+	if !ok {
+		return
+	}
+
+	var patched models.Domain
+	if document, err = json.Marshal(doc); err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(document))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&patched)
+	}
+	if err != nil {
+		http.Error(w, "Invalid patch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if patched.Domain == "" {
+		http.Error(w, "Missing required fields: domain", http.StatusBadRequest)
+		return
+	}
+	// The patched document was encoded without the client key, so keep it unless the certificate changed
+	patched.UpstreamTLS.KeepClientKey(existing.UpstreamTLS)
+	renamed := patched.Domain != domain
+	if !h.authorizeDomain(w, r, domain, privilegedChanges(existing, &patched)) {
+		return
+	}
+	// The new name is mapped with all of the domain's settings, as if it were created
+	if renamed && !h.authorizeDomain(w, r, patched.Domain, patched.DomainOptions) {
+		return
+	}
+	if err := h.validateConfig(&patched, r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	change, err := h.db.ReplaceDomain(actor(r), domain, &patched, version)
+	switch {
+	case errors.Is(err, database.ErrVersionMismatch):
+		http.Error(w, "Precondition failed: domain has been modified", http.StatusPreconditionFailed)
+		return
+	case errors.Is(err, database.ErrDomainExists):
+		http.Error(w, "Domain already exists: "+patched.Domain, http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Failed to update domain: "+err.Error(), http.StatusInternalServerError)
+		return
+	case change == nil:
+		http.Error(w, "Domain not found", http.StatusNotFound)
+		return
+	}
+
+	if renamed {
+		logger().InfoContext(r.Context(), "Domain renamed", "domain", domain, "new_domain", patched.Domain,
+			"remote_addr", r.RemoteAddr)
+		h.cache.Purge(domain, "", "")
+		h.cache.Purge(patched.Domain, "", "")
+		w.Header().Set("Location", "/api/config/"+url.PathEscape(patched.Domain))
+	} else if !database.SameConfig(change.Before, change.After) {
+		logger().InfoContext(r.Context(), "Domain patched", "domain", domain, "remote_addr", r.RemoteAddr)
+		h.cache.Purge(domain, "", "")
+	}
+
+	writeDomain(w, http.StatusOK, change.After)
 }
 
 // DeleteDomain handles DELETE /api/config/:domain
@@ -176,9 +539,30 @@ func (h *Handlers) DeleteDomain(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid domain parameter", http.StatusBadRequest)
 		return
 	}
+	if !h.authorizeDomain(w, r, domain, models.DomainOptions{}) {
+		return
+	}
 
-	if err := h.db.DeleteDomain(domain); err != nil {
-		if err.Error() == "domain not found" {
+	existing, err := h.db.GetDomain(domain)
+	if err != nil {
+		http.Error(w, "Failed to retrieve domain: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing == nil {
+		http.Error(w, "Domain not found", http.StatusNotFound)
+		return
+	}
+	version, ok := expectedVersion(w, r, existing, 0)
+	if !ok {
+		return
+	}
+
+	if err := h.db.DeleteDomain(actor(r), domain, version); err != nil {
+		if errors.Is(err, database.ErrVersionMismatch) {
+			http.Error(w, "Precondition failed: domain has been modified", http.StatusPreconditionFailed)
+			return
+		}
+		if errors.Is(err, database.ErrDomainNotFound) {
 			http.Error(w, "Domain not found", http.StatusNotFound)
 			return
 		}
@@ -186,9 +570,41 @@ func (h *Handlers) DeleteDomain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	logger().InfoContext(r.Context(), "Domain deleted", "domain", domain, "remote_addr", r.RemoteAddr)
+	h.cache.Purge(domain, "", "")
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// PurgeCache handles POST /api/cache/purge
+func (h *Handlers) PurgeCache(w http.ResponseWriter, r *http.Request) {
+	var req models.PurgeCacheRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Refuse to purge everything by accident
+	if req.Domain == "" && req.Path == "" && req.Prefix == "" {
+		http.Error(w, "Missing required fields: domain, path or prefix", http.StatusBadRequest)
+		return
+	}
+	// Keys restricted to some domains may only purge those
+	if principal := auth.FromContext(r.Context()); principal.Restricted() && req.Domain == "" {
+		http.Error(w, "Forbidden: key is restricted to some domains, so domain is required", http.StatusForbidden)
+		return
+	}
+	if req.Domain != "" && !h.authorizeDomain(w, r, req.Domain, models.DomainOptions{}) {
+		return
+	}
+
+	purged := h.cache.Purge(req.Domain, req.Path, req.Prefix)
+	logger().InfoContext(r.Context(), "Cache purged", "domain", req.Domain, "path", req.Path, "prefix", req.Prefix, "purged", purged)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
+
 // BulkCreateDomains handles POST /api/config/bulk
 func (h *Handlers) BulkCreateDomains(w http.ResponseWriter, r *http.Request) {
 	// Read the body once
@@ -218,23 +634,161 @@ func (h *Handlers) BulkCreateDomains(w http.ResponseWriter, r *http.Request) {
 
 	// Validate all domains have required fields
 	for i, domain := range domains {
-		if domain.Domain == "" || domain.IP == "" || domain.Port == 0 {
-			http.Error(w, fmt.Sprintf("Missing required fields in domain at index %d: domain, ip, port", i), http.StatusBadRequest)
+		if domain.Domain == "" {
+			http.Error(w, fmt.Sprintf("Missing required fields in domain at index %d: domain", i), http.StatusBadRequest)
+			return
+		}
+		if !h.authorizeDomain(w, r, domain.Domain, domain.DomainOptions) {
+			return
+		}
+		if err := validateBackend(domain.IP, domain.Port, domain.Target, domain.DomainOptions); err != nil {
+			http.Error(w, fmt.Sprintf("%v in domain at index %d", err, i), http.StatusBadRequest)
 			return
 		}
 		// Set default protocol if not provided
 		if domain.Protocol == "" {
 			domains[i].Protocol = "http"
 		}
+		if err := h.validateOptions(domain.Domain, domain.DomainOptions, r); err != nil {
+			http.Error(w, fmt.Sprintf("%v in domain at index %d", err, i), http.StatusBadRequest)
+			return
+		}
 	}
 
-	createdDomains, err := h.db.BulkCreateDomains(domains)
+	createdDomains, snapshot, err := h.db.BulkCreateDomains(actor(r), domains)
 	if err != nil {
 		http.Error(w, "Failed to create domains: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	snapshotID := setSnapshotHeader(w, snapshot)
+	logger().InfoContext(r.Context(), "Domains created in bulk", "count", len(createdDomains), "snapshot_id", snapshotID,
+		"remote_addr", r.RemoteAddr)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(createdDomains)
 }
+
+// privilegedChanges returns the certificate and static settings a change from before to
+// after touches, for authorizeDomain. Removed certificate settings are returned as empty
+// configs; removed static settings are left out, as anyone may turn static serving off.
+func privilegedChanges(before, after *models.Domain) models.DomainOptions {
+	var old, changed models.DomainOptions
+	if before != nil {
+		old = before.DomainOptions
+	}
+	if after != nil {
+		changed = after.DomainOptions
+	}
+	var options models.DomainOptions
+	if !reflect.DeepEqual(old.UpstreamTLS, changed.UpstreamTLS) {
+		options.UpstreamTLS = cmp.Or(changed.UpstreamTLS, &models.UpstreamTLSConfig{})
+	}
+	if !reflect.DeepEqual(old.ClientAuth, changed.ClientAuth) {
+		options.ClientAuth = cmp.Or(changed.ClientAuth, &models.ClientAuthConfig{})
+	}
+	if !reflect.DeepEqual(old.Static, changed.Static) {
+		options.Static = changed.Static
+	}
+	return options
+}
+
+// validateConfig checks that a complete domain mapping, e.g. from a revision, can be loaded
+func (h *Handlers) validateConfig(d *models.Domain, r *http.Request) error {
+	if err := validateBackend(d.IP, d.Port, d.Target, d.DomainOptions); err != nil {
+		return err
+	}
+	return h.validateOptions(d.Domain, d.DomainOptions, r)
+}
+
+// validateBackend checks that a domain has either an ip and port or a socket target, but not both.
+// Static domains serve files themselves and need neither, and multi-target domains list
+// their backends in upstreams.
+func validateBackend(ip string, port int, target string, options models.DomainOptions) error {
+	if !options.Static.IsZero() {
+		if ip != "" || port != 0 || target != "" || !options.Upstreams.IsZero() {
+			return fmt.Errorf("Invalid static: ip, port, target and upstreams cannot be combined with static")
+		}
+		return nil
+	}
+	if !options.Upstreams.IsZero() {
+		if ip != "" || port != 0 || target != "" {
+			return fmt.Errorf("Invalid upstreams: ip, port and target cannot be combined with upstreams")
+		}
+		return nil
+	}
+	if target == "" {
+		if ip == "" || port == 0 {
+			return fmt.Errorf("Missing required fields: ip, port (or target)")
+		}
+		return nil
+	}
+	if ip != "" || port != 0 {
+		return fmt.Errorf("Invalid target: ip and port cannot be combined with target")
+	}
+	if _, err := proxy.UnixSocketPath(target); err != nil {
+		return fmt.Errorf("Invalid target: %w", err)
+	}
+	return nil
+}
+
+// validateOptions checks that a domain's optional settings can be loaded and logs
+// an audit warning whenever upstream certificate verification is being disabled
+func (h *Handlers) validateOptions(domain string, options models.DomainOptions, r *http.Request) error {
+	if cfg := options.UpstreamTLS; cfg != nil {
+		if _, err := proxy.BuildUpstreamTLSConfig(cfg); err != nil {
+			return fmt.Errorf("Invalid upstream_tls: %w", err)
+		}
+		if cfg.InsecureSkipVerify {
+			logger().WarnContext(r.Context(), "insecure_skip_verify enabled by API request", "domain", domain, "remote_addr", r.RemoteAddr)
+		}
+	}
+	if cfg := options.Static; !cfg.IsZero() {
+		if err := static.Validate(cfg, h.staticRoot); err != nil {
+			return fmt.Errorf("Invalid static: %w", err)
+		}
+	}
+	if cfg := options.Cache; cfg != nil {
+		if cfg.DefaultTTL < 0 || cfg.MaxObjectSize < 0 || cfg.StaleWhileRevalidate < 0 || cfg.StaleIfError < 0 {
+			return fmt.Errorf("Invalid cache: durations and sizes must not be negative")
+		}
+	}
+	if cfg := options.Compression; cfg != nil {
+		if err := compress.Validate(cfg); err != nil {
+			return fmt.Errorf("Invalid compression: %w", err)
+		}
+	}
+	if cfg := options.AccessLog; cfg != nil {
+		if cfg.Format != "" {
+			if err := accesslog.ValidateFormat(cfg.Format); err != nil {
+				return fmt.Errorf("Invalid access_log: %w", err)
+			}
+		}
+		if cfg.Output != "" {
+			if err := h.accessLogs.ValidateOverride(cfg.Output); err != nil {
+				return fmt.Errorf("Invalid access_log: %w", err)
+			}
+		}
+	}
+	if cfg := options.Mirror; cfg != nil && *cfg != (models.MirrorConfig{}) {
+		if err := mirror.Validate(cfg); err != nil {
+			return fmt.Errorf("Invalid mirror: %w", err)
+		}
+	}
+	if cfg := options.Canary; cfg != nil && *cfg != (models.CanaryConfig{}) {
+		if err := proxy.ValidateCanary(cfg); err != nil {
+			return fmt.Errorf("Invalid canary: %w", err)
+		}
+	}
+	if cfg := options.Upstreams; !cfg.IsZero() {
+		if err := proxy.ValidateUpstreams(cfg); err != nil {
+			return fmt.Errorf("Invalid upstreams: %w", err)
+		}
+	}
+	if cfg := options.ClientAuth; cfg != nil && !cfg.IsZero() {
+		if err := proxy.ValidateClientAuth(cfg); err != nil {
+			return fmt.Errorf("Invalid client_auth: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+)
+
+// withVars passes route variables to a handler called without the router
+func withVars(handler http.HandlerFunc, vars map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, mux.SetURLVars(r, vars))
+	}
+}
+
+func TestStaticRootAccess(t *testing.T) {
+	allowed := t.TempDir()
+	site := filepath.Join(allowed, "site")
+	if err := os.Mkdir(site, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writer := &auth.Principal{Name: "deploy", Scopes: []string{auth.ScopeDomainsWrite}}
+	restrictedAdmin := &auth.Principal{Name: "team", Scopes: []string{auth.ScopeAdmin}, Domains: []string{"*.example.com"}}
+	tests := []struct {
+		name       string
+		staticRoot string
+		principal  *auth.Principal
+		root       string
+		status     int
+	}{
+		{"unconfined admin", "", admin, site, http.StatusCreated},
+		{"unconfined domains:write key", "", writer, site, http.StatusForbidden},
+		{"unconfined restricted admin", "", restrictedAdmin, site, http.StatusForbidden},
+		{"confined", allowed, writer, site, http.StatusCreated},
+		{"confined proc", allowed, admin, "/proc/self", http.StatusBadRequest},
+		{"confined filesystem root", allowed, admin, "/", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, db := newTestHandlers(t)
+			h.staticRoot = tt.staticRoot
+			body := fmt.Sprintf(`{"domain": "www.example.com", "static": {"root": %q}}`, tt.root)
+			w := call(h.CreateDomain, tt.principal, http.MethodPost, "/api/config", body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			want := ""
+			if tt.status == http.StatusCreated {
+				want = "www.example.com"
+			}
+			if got := domainNames(t, db); got != want {
+				t.Errorf("domains %q, want %q", got, want)
+			}
+		})
+	}
+
+	// Keys that may not set static roots can still change other settings of static domains
+	h, _ := newTestHandlers(t)
+	if w := call(h.CreateDomain, admin, http.MethodPost, "/api/config",
+		fmt.Sprintf(`{"domain": "www.example.com", "static": {"root": %q}}`, site)); w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", w.Code, w.Body)
+	}
+	patch := withVars(h.PatchDomain, map[string]string{"domain": "www.example.com"})
+	if w := call(patch, writer, http.MethodPatch, "/api/config/www.example.com", `{"cache": {"enabled": true}}`); w.Code != http.StatusOK {
+		t.Errorf("patching cache: status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if w := call(patch, writer, http.MethodPatch, "/api/config/www.example.com",
+		`{"static": {"root": "/"}}`); w.Code != http.StatusForbidden {
+		t.Errorf("patching static root: status = %d, want 403: %s", w.Code, w.Body)
+	}
+}
+
+func TestAccessLogOutputOverride(t *testing.T) {
+	tests := []struct {
+		output string
+		status int
+	}{
+		{"stdout", http.StatusCreated},
+		{"syslog:udp://logs.example.com:514", http.StatusBadRequest},
+		{"file:/etc/cron.d/proxy", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		h, _ := newTestHandlers(t)
+		body := fmt.Sprintf(`{"domain": "app.example.com", "ip": "10.0.0.1", "port": 80, "access_log": {"output": %q}}`, tt.output)
+		if w := call(h.CreateDomain, admin, http.MethodPost, "/api/config", body); w.Code != tt.status {
+			t.Errorf("output %s: status = %d, want %d: %s", tt.output, w.Code, tt.status, w.Body)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/itsnoxius/simple-proxy/internal/logging"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// GetLogging handles GET /api/logging
+func (h *Handlers) GetLogging(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.LoggingConfig{Levels: logging.Levels()})
+}
+
+// UpdateLogging handles PUT /api/logging. All levels are validated before any is applied.
+func (h *Handlers) UpdateLogging(w http.ResponseWriter, r *http.Request) {
+	if !requireUnrestricted(w, r) {
+		return
+	}
+	var req models.UpdateLoggingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Level == "" && len(req.Levels) == 0 {
+		http.Error(w, "Missing required fields: level or levels", http.StatusBadRequest)
+		return
+	}
+
+	var level slog.Level
+	if req.Level != "" {
+		var err error
+		if level, err = logging.ParseLevel(req.Level); err != nil {
+			http.Error(w, "Invalid level: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	levels := make(map[string]slog.Level, len(req.Levels))
+	for subsystem, name := range req.Levels {
+		if !slices.Contains(logging.Subsystems, subsystem) {
+			http.Error(w, "Invalid levels: unknown subsystem "+subsystem, http.StatusBadRequest)
+			return
+		}
+		subsystemLevel, err := logging.ParseLevel(name)
+		if err != nil {
+			http.Error(w, "Invalid levels: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		levels[subsystem] = subsystemLevel
+	}
+
+	if req.Level != "" {
+		logging.SetAllLevels(level)
+	}
+	for subsystem, subsystemLevel := range levels {
+		logging.SetLevel(subsystem, subsystemLevel)
+	}
+	current := logging.Levels()
+	// Logged at warn so the change is recorded even when the API subsystem is quiet
+	logger().WarnContext(r.Context(), "Log levels changed", "levels", current, "remote_addr", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.LoggingConfig{Levels: current})
+}
@@ -0,0 +1,235 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// GetHistory handles GET /api/config/:domain/history, listing the revisions of a domain
+// newest first
+func (h *Handlers) GetHistory(w http.ResponseWriter, r *http.Request) {
+	domain, err := url.PathUnescape(mux.Vars(r)["domain"])
+	if err != nil {
+		http.Error(w, "Invalid domain parameter", http.StatusBadRequest)
+		return
+	}
+	if !h.authorizeDomain(w, r, domain, models.DomainOptions{}) {
+		return
+	}
+
+	revisions, err := h.db.ListRevisions(domain)
+	if err != nil {
+		http.Error(w, "Failed to retrieve history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(revisions) == 0 {
+		http.Error(w, "Domain not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(revisions)
+}
+
+// RollbackDomain handles POST /api/config/:domain/rollback, restoring a prior revision of a
+// domain. The rollback is recorded as a new revision, so it can be undone as well.
+func (h *Handlers) RollbackDomain(w http.ResponseWriter, r *http.Request) {
+	domain, err := url.PathUnescape(mux.Vars(r)["domain"])
+	if err != nil {
+		http.Error(w, "Invalid domain parameter", http.StatusBadRequest)
+		return
+	}
+	// Keys for other domains may not learn which revisions exist
+	if !h.authorizeDomain(w, r, domain, models.DomainOptions{}) {
+		return
+	}
+
+	// The body is optional; without a revision the change before the latest is undone
+	var req models.RollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Revision < 0 {
+		http.Error(w, "Invalid revision: must be positive", http.StatusBadRequest)
+		return
+	}
+
+	revision, err := h.db.GetRevision(domain, req.Revision)
+	if err != nil {
+		http.Error(w, "Failed to retrieve revision: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if revision == nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+	current, err := h.db.GetDomain(domain)
+	if err != nil {
+		http.Error(w, "Failed to retrieve domain: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !h.authorizeDomain(w, r, domain, privilegedChanges(current, revision.Config)) {
+		return
+	}
+	// Settings valid when the revision was made may not be anymore, e.g. removed certificate files
+	if config := revision.Config; config != nil {
+		if err := h.validateConfig(config, r); err != nil {
+			http.Error(w, fmt.Sprintf("Revision %d can't be restored: %v", revision.Revision, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	change, err := h.db.RollbackDomain(actor(r), revision)
+	if err != nil {
+		http.Error(w, "Failed to roll back domain: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger().InfoContext(r.Context(), "Domain rolled back", "domain", domain, "revision", revision.Revision,
+		"changed", change != nil, "remote_addr", r.RemoteAddr)
+	after := current
+	if change != nil {
+		after = change.After
+		h.cache.Purge(domain, "", "")
+	}
+
+	if after == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeDomain(w, http.StatusOK, after)
+}
+
+// ListSnapshots handles GET /api/snapshots
+func (h *Handlers) ListSnapshots(w http.ResponseWriter, r *http.Request) {
+	if !requireUnrestricted(w, r) {
+		return
+	}
+	snapshots, err := h.db.ListSnapshots()
+	if err != nil {
+		http.Error(w, "Failed to retrieve snapshots: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+// GetSnapshot handles GET /api/snapshots/:id, returning the snapshot with its domains
+func (h *Handlers) GetSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !requireUnrestricted(w, r) {
+		return
+	}
+	snapshot, ok := h.snapshot(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// CreateSnapshot handles POST /api/snapshots, saving a copy of the whole routing table
+func (h *Handlers) CreateSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !requireUnrestricted(w, r) {
+		return
+	}
+	var req models.CreateSnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	snapshot, err := h.db.CreateSnapshot(req.Name, false)
+	if err != nil {
+		http.Error(w, "Failed to create snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger().InfoContext(r.Context(), "Snapshot created", "snapshot_id", snapshot.ID, "name", snapshot.Name,
+		"domains", snapshot.DomainCount, "remote_addr", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// RestoreSnapshot handles POST /api/snapshots/:id/restore, making the routing table match a
+// snapshot in one transaction. Domains added since the snapshot are deleted.
+func (h *Handlers) RestoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	if !requireUnrestricted(w, r) {
+		return
+	}
+	snapshot, ok := h.snapshot(w, r)
+	if !ok {
+		return
+	}
+	for i := range snapshot.Domains {
+		if err := h.validateConfig(&snapshot.Domains[i], r); err != nil {
+			http.Error(w, fmt.Sprintf("Snapshot can't be restored: %v in domain %s", err, snapshot.Domains[i].Domain),
+				http.StatusBadRequest)
+			return
+		}
+	}
+
+	changes, err := h.db.RestoreSnapshot(actor(r), snapshot)
+	if err != nil {
+		http.Error(w, "Failed to restore snapshot: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger().WarnContext(r.Context(), "Snapshot restored", "snapshot_id", snapshot.ID, "changed", len(changes),
+		"remote_addr", r.RemoteAddr)
+	for _, change := range changes {
+		h.cache.Purge(change.Domain, "", "")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"snapshot_id": snapshot.ID, "changes": changes})
+}
+
+// snapshot loads the snapshot named by the id route variable, writing an error if it fails
+func (h *Handlers) snapshot(w http.ResponseWriter, r *http.Request) (*models.Snapshot, bool) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid snapshot id", http.StatusBadRequest)
+		return nil, false
+	}
+	snapshot, err := h.db.GetSnapshot(id)
+	if err != nil {
+		http.Error(w, "Failed to retrieve snapshot: "+err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if snapshot == nil {
+		http.Error(w, "Snapshot not found", http.StatusNotFound)
+		return nil, false
+	}
+	return snapshot, true
+}
+
+// setSnapshotHeader returns the id of the automatic snapshot taken before a bulk change,
+// or 0 if none was kept, and sets the X-Snapshot-ID header to it
+func setSnapshotHeader(w http.ResponseWriter, snapshot *models.Snapshot) int64 {
+	if snapshot == nil {
+		return 0
+	}
+	w.Header().Set("X-Snapshot-ID", strconv.FormatInt(snapshot.ID, 10))
+	return snapshot.ID
+}
+
+// requireUnrestricted rejects keys restricted to some domains from endpoints covering the
+// whole routing table
+func requireUnrestricted(w http.ResponseWriter, r *http.Request) bool {
+	if auth.FromContext(r.Context()).Restricted() {
+		http.Error(w, "Forbidden: key is restricted to some domains", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+)
+
+func TestRollbackDomainAccess(t *testing.T) {
+	h, _ := newTestHandlers(t, "app.example.com", "other.example.org")
+	team := &auth.Principal{Name: "team", Scopes: []string{auth.ScopeDomainsWrite}, Domains: []string{"*.example.com"}}
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		domain    string
+		body      string
+		status    int
+	}{
+		{"own domain", team, "app.example.com", `{"revision": 1}`, http.StatusOK},
+		{"own domain without revision", team, "app.example.com", `{"revision": 99}`, http.StatusNotFound},
+		// Whether a revision exists is not revealed for other domains
+		{"other domain", team, "other.example.org", `{"revision": 1}`, http.StatusForbidden},
+		{"other domain without revision", team, "other.example.org", `{"revision": 99}`, http.StatusForbidden},
+		{"unknown domain", team, "missing.example.org", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rollback := withVars(h.RollbackDomain, map[string]string{"domain": tt.domain})
+			if w := call(rollback, tt.principal, http.MethodPost, "/api/config/"+tt.domain+"/rollback", tt.body); w.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// SyncState handles PUT /api/state, making the routing table match the complete list of
+// mappings in the body in one transaction. Unlisted domains are only deleted with
+// prune=true, and dry_run=true returns the diff without applying it.
+func (h *Handlers) SyncState(w http.ResponseWriter, r *http.Request) {
+	if !requireUnrestricted(w, r) {
+		return
+	}
+	query := r.URL.Query()
+	flags := map[string]bool{"dry_run": false, "prune": false}
+	for name := range flags {
+		if value := query.Get(name); value != "" {
+			flag, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "Invalid "+name+": expected true or false", http.StatusBadRequest)
+				return
+			}
+			flags[name] = flag
+		}
+	}
+	dryRun, prune := flags["dry_run"], flags["prune"]
+
+	var reqs []models.CreateDomainRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&reqs); err != nil {
+		http.Error(w, "Invalid request body: expected array of domains: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Responses leave client keys out, so settings sent back with the same certificate keep the stored key
+	current, err := h.db.GetAllDomains()
+	if err != nil {
+		http.Error(w, "Failed to retrieve domains: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stored := make(map[string]*models.Domain, len(current))
+	for i := range current {
+		stored[current[i].Domain] = &current[i]
+	}
+
+	desired := make([]models.Domain, len(reqs))
+	seen := make(map[string]bool, len(reqs))
+	for i, req := range reqs {
+		if req.Domain == "" {
+			http.Error(w, fmt.Sprintf("Missing required fields in domain at index %d: domain", i), http.StatusBadRequest)
+			return
+		}
+		if seen[req.Domain] {
+			http.Error(w, fmt.Sprintf("Duplicate domain %s at index %d", req.Domain, i), http.StatusBadRequest)
+			return
+		}
+		seen[req.Domain] = true
+		desired[i] = models.Domain{
+			Domain:        req.Domain,
+			IP:            req.IP,
+			Port:          req.Port,
+			Protocol:      cmp.Or(req.Protocol, "http"),
+			Target:        req.Target,
+			DomainOptions: req.DomainOptions,
+		}
+		if existing := stored[req.Domain]; existing != nil {
+			desired[i].UpstreamTLS.KeepClientKey(existing.UpstreamTLS)
+		}
+		if err := h.validateConfig(&desired[i], r); err != nil {
+			http.Error(w, fmt.Sprintf("%v in domain %s", err, req.Domain), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Certificate settings are only checked for domains whose settings change
+	var denied error
+	diff, snapshot, err := h.db.SyncDomains(actor(r), desired, prune, dryRun, func(before, after *models.Domain) error {
+		domain := cmp.Or(after, before).Domain
+		denied = h.checkDomainAccess(r, domain, privilegedChanges(before, after))
+		return denied
+	})
+	if denied != nil {
+		http.Error(w, denied.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to sync state: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	snapshotID := setSnapshotHeader(w, snapshot)
+	if !dryRun {
+		for _, changes := range [][]models.DomainChange{diff.Added, diff.Changed, diff.Removed} {
+			for _, change := range changes {
+				h.cache.Purge(change.Domain, "", "")
+			}
+		}
+	}
+	logger().InfoContext(r.Context(), "State synced", "dry_run", dryRun, "prune", prune, "added", len(diff.Added),
+		"changed", len(diff.Changed), "removed", len(diff.Removed), "unlisted", len(diff.Unlisted),
+		"snapshot_id", snapshotID, "remote_addr", r.RemoteAddr)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diff)
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+func TestSyncState(t *testing.T) {
+	const desired = `[{"domain": "a.example.com", "ip": "10.0.0.9", "port": 80},
+		{"domain": "b.example.com", "ip": "10.0.0.1", "port": 80},
+		{"domain": "c.example.com", "ip": "10.0.0.2", "port": 80}]`
+	tests := []struct {
+		name      string
+		principal *auth.Principal
+		query     string
+		body      string
+		status    int
+		// added, changed and removed count the domains in the returned diff
+		added, changed, removed int
+		domains                 string
+		snapshot                bool
+	}{
+		{"apply", admin, "", desired, http.StatusOK, 1, 1, 0,
+			"a.example.com b.example.com c.example.com d.example.com", true},
+		{"prune", admin, "?prune=true", desired, http.StatusOK, 1, 1, 1,
+			"a.example.com b.example.com c.example.com", true},
+		{"dry run", admin, "?dry_run=true&prune=true", desired, http.StatusOK, 1, 1, 1,
+			"a.example.com b.example.com d.example.com", false},
+		{"unchanged", admin, "", `[{"domain": "b.example.com", "ip": "10.0.0.1", "port": 80}]`, http.StatusOK, 0, 0, 0,
+			"a.example.com b.example.com d.example.com", false},
+		{"duplicate domain", admin, "", `[{"domain": "b.example.com", "ip": "10.0.0.1", "port": 80},
+			{"domain": "b.example.com", "ip": "10.0.0.2", "port": 80}]`, http.StatusBadRequest, 0, 0, 0,
+			"a.example.com b.example.com d.example.com", false},
+		{"invalid mapping", admin, "", `[{"domain": "e.example.com", "ip": "10.0.0.1"}]`, http.StatusBadRequest, 0, 0, 0,
+			"a.example.com b.example.com d.example.com", false},
+		{"invalid flag", admin, "?prune=maybe", desired, http.StatusBadRequest, 0, 0, 0,
+			"a.example.com b.example.com d.example.com", false},
+		{"restricted key", &auth.Principal{Name: "team", Scopes: []string{auth.ScopeAdmin}, Domains: []string{"*.example.com"}},
+			"", desired, http.StatusForbidden, 0, 0, 0, "a.example.com b.example.com d.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, db := newTestHandlers(t, "a.example.com", "b.example.com", "d.example.com")
+			w := call(h.SyncState, tt.principal, http.MethodPut, "/api/state"+tt.query, tt.body)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status == http.StatusOK {
+				var diff models.StateDiff
+				if err := json.NewDecoder(w.Body).Decode(&diff); err != nil {
+					t.Fatalf("invalid response: %v", err)
+				}
+				if len(diff.Added) != tt.added || len(diff.Changed) != tt.changed || len(diff.Removed) != tt.removed {
+					t.Errorf("diff added %d, changed %d, removed %d, want %d, %d, %d", len(diff.Added), len(diff.Changed),
+						len(diff.Removed), tt.added, tt.changed, tt.removed)
+				}
+			}
+			if got := domainNames(t, db); got != tt.domains {
+				t.Errorf("domains = %q, want %q", got, tt.domains)
+			}
+			snapshots, err := db.ListSnapshots()
+			if err != nil {
+				t.Fatalf("ListSnapshots: %v", err)
+			}
+			header := w.Header().Get("X-Snapshot-ID")
+			if kept := len(snapshots) == 1; kept != tt.snapshot || (header != "") != tt.snapshot {
+				t.Errorf("snapshot stored = %v with X-Snapshot-ID %q, want %v", kept, header, tt.snapshot)
+			}
+		})
+	}
+}
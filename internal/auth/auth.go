@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Scopes granted to API credentials
+const (
+	// ScopeRead allows reading domain mappings, log levels and metrics
+	ScopeRead = "read"
+	// ScopeDomainsWrite allows creating, changing and deleting domain mappings and purging the cache
+	ScopeDomainsWrite = "domains:write"
+	// ScopeCerts allows changing the certificate settings of domains (upstream_tls and client_auth)
+	ScopeCerts = "certs"
+	// ScopeAdmin allows everything, including managing API keys, log levels and profiling
+	ScopeAdmin = "admin"
+)
+
+// Scopes lists all valid scopes
+var Scopes = []string{ScopeRead, ScopeDomainsWrite, ScopeCerts, ScopeAdmin}
+
+// keyPrefix starts every API key, so keys are easy to recognize in leaked secrets
+const keyPrefix = "spk_"
+
+// Principal is the identity an API request was authenticated as
+type Principal struct {
+	// Name identifies the credential in logs
+	Name string
+	// KeyID is the ID of the API key used, empty for the bootstrap key
+	KeyID  string
+	Scopes []string
+	// Domains restricts the domains the principal may access to these path.Match
+	// patterns; when empty, all domains are allowed
+	Domains []string
+}
+
+// Can reports whether the principal was granted a scope. Admin implies every scope.
+func (p *Principal) Can(scope string) bool {
+	return p != nil && (slices.Contains(p.Scopes, ScopeAdmin) || slices.Contains(p.Scopes, scope))
+}
+
+// AllowsDomain reports whether the principal may access a domain
+func (p *Principal) AllowsDomain(domain string) bool {
+	if p == nil {
+		return false
+	}
+	if len(p.Domains) == 0 {
+		return true
+	}
+	for _, pattern := range p.Domains {
+		if ok, _ := path.Match(pattern, domain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Restricted reports whether the principal is limited to some domains
+func (p *Principal) Restricted() bool {
+	return p != nil && len(p.Domains) > 0
+}
+
+// Covers reports whether the principal holds every scope and domain a new credential
+// would be granted, so credentials can't be used to create more powerful ones. A
+// restricted principal only covers its own domain patterns and the domains they match.
+func (p *Principal) Covers(scopes, domains []string) bool {
+	if p == nil {
+		return false
+	}
+	for _, scope := range scopes {
+		if !p.Can(scope) {
+			return false
+		}
+	}
+	if !p.Restricted() {
+		return true
+	}
+	if len(domains) == 0 {
+		return false
+	}
+	for _, pattern := range domains {
+		if slices.Contains(p.Domains, pattern) {
+			continue
+		}
+		// Patterns can't be compared, so other patterns may match domains the principal can't access
+		if strings.ContainsAny(pattern, `*?[\`) || !p.AllowsDomain(pattern) {
+			return false
+		}
+	}
+	return true
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the authenticated principal
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal of a context, or nil if the request was not authenticated
+func FromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(contextKey{}).(*Principal)
+	return p
+}
+
+// ValidateScopes checks that scopes only contains known scopes
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return fmt.Errorf("unknown scope %q, expected one of %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	return nil
+}
+
+// ValidateDomainPatterns checks that domain patterns are valid path.Match patterns
+func ValidateDomainPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid domain pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// GenerateKey returns a new API key with its ID and the hash to store. Only the hash
+// of the secret part is stored, so keys can't be recovered from the database.
+func GenerateKey() (key, id, hash string) {
+	id = strings.ToLower(rand.Text()[:12])
+	secret := rand.Text()
+	return keyPrefix + id + "_" + secret, id, HashSecret(secret)
+}
+
+// ParseKey splits an API key into its ID and secret
+func ParseKey(key string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(key, keyPrefix)
+	if !ok {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(rest, "_")
+	return id, secret, ok && id != "" && secret != ""
+}
+
+// HashSecret returns the stored hash of an API key secret. Keys are random, so a
+// fast hash is sufficient.
+func HashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Equal compares two secrets in constant time
+func Equal(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
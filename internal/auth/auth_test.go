@@ -0,0 +1,36 @@
+package auth
+
+import "testing"
+
+func TestCovers(t *testing.T) {
+	admin := &Principal{Scopes: []string{ScopeAdmin}}
+	restricted := &Principal{Scopes: []string{ScopeAdmin}, Domains: []string{"*.example.com"}}
+	writer := &Principal{Scopes: []string{ScopeRead, ScopeDomainsWrite}, Domains: []string{"*.example.com"}}
+
+	tests := []struct {
+		name      string
+		principal *Principal
+		scopes    []string
+		domains   []string
+		want      bool
+	}{
+		{"unrestricted admin", admin, []string{ScopeAdmin}, nil, true},
+		{"unrestricted admin restricting", admin, []string{ScopeRead}, []string{"*.other.com"}, true},
+		{"nil principal", nil, []string{ScopeRead}, []string{"a.example.com"}, false},
+		{"restricted unrestricted key", restricted, []string{ScopeAdmin}, nil, false},
+		{"restricted own pattern", restricted, []string{ScopeAdmin}, []string{"*.example.com"}, true},
+		{"restricted matching domain", restricted, []string{ScopeRead}, []string{"api.example.com"}, true},
+		{"restricted other domain", restricted, []string{ScopeRead}, []string{"api.other.com"}, false},
+		{"restricted wider pattern", restricted, []string{ScopeRead}, []string{"*"}, false},
+		{"restricted pattern matching own", restricted, []string{ScopeRead}, []string{"a*.example.com"}, false},
+		{"missing scope", writer, []string{ScopeCerts}, []string{"*.example.com"}, false},
+		{"subset of scopes", writer, []string{ScopeRead}, []string{"*.example.com"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.principal.Covers(tt.scopes, tt.domains); got != tt.want {
+				t.Errorf("Covers(%v, %v) = %v, want %v", tt.scopes, tt.domains, got, tt.want)
+			}
+		})
+	}
+}
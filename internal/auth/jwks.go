@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// maxJWKSSize bounds the size of a fetched key set
+const maxJWKSSize = 1 << 20
+
+// jsonWebKey is a public key of a JSON Web Key Set (RFC 7517)
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// verificationKey is a parsed signing key along with the algorithms it may verify
+type verificationKey struct {
+	kid        string
+	key        crypto.PublicKey
+	algorithms []string
+}
+
+// loadJWKS reads a key set from a file path or an http(s) URL
+func loadJWKS(ctx context.Context, client *http.Client, source string) ([]*verificationKey, error) {
+	var data []byte
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS URL: %w", err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("failed to fetch JWKS: unexpected status %s", resp.Status)
+		}
+		if data, err = io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize)); err != nil {
+			return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(source); err != nil {
+			return nil, fmt.Errorf("failed to read JWKS: %w", err)
+		}
+	}
+	return parseJWKS(data)
+}
+
+// parseJWKS parses the signing keys of a key set. Keys meant for encryption and keys of
+// unsupported types are skipped.
+func parseJWKS(data []byte) ([]*verificationKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %w", err)
+	}
+	var keys []*verificationKey
+	for i, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.parse()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWKS key %d (kid %q): %w", i, jwk.Kid, err)
+		}
+		if key != nil {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS contains no usable signing keys")
+	}
+	return keys, nil
+}
+
+// parse returns the verification key of a JWK, or nil if its type or curve isn't supported
+func (k *jsonWebKey) parse() (*verificationKey, error) {
+	key := &verificationKey{kid: k.Kid}
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("invalid e")
+		}
+		if n.BitLen() < 2048 {
+			return nil, fmt.Errorf("RSA keys must have at least 2048 bits")
+		}
+		key.key = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		key.algorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"}
+	case "EC":
+		var curve elliptic.Curve
+		var alg string
+		switch k.Crv {
+		case "P-256":
+			curve, alg = elliptic.P256(), "ES256"
+		case "P-384":
+			curve, alg = elliptic.P384(), "ES384"
+		case "P-521":
+			curve, alg = elliptic.P521(), "ES512"
+		default:
+			return nil, nil
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		x, errX := base64.RawURLEncoding.DecodeString(k.X)
+		y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+		if errX != nil || errY != nil || len(x) != size || len(y) != size {
+			return nil, fmt.Errorf("invalid x or y")
+		}
+		pub, err := ecdsa.ParseUncompressedPublicKey(curve, append(append([]byte{4}, x...), y...))
+		if err != nil {
+			return nil, err
+		}
+		key.key = pub
+		key.algorithms = []string{alg}
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid x")
+		}
+		key.key = ed25519.PublicKey(x)
+		key.algorithms = []string{"EdDSA"}
+	default:
+		return nil, nil
+	}
+
+	// A key declaring its algorithm may only verify that one
+	if k.Alg != "" {
+		if !slices.Contains(key.algorithms, k.Alg) {
+			return nil, fmt.Errorf("algorithm %q doesn't match key type %s", k.Alg, k.Kty)
+		}
+		key.algorithms = []string{k.Alg}
+	}
+	return key, nil
+}
+
+// decodeBigInt decodes a base64url encoded unsigned big-endian integer
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
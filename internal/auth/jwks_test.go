@@ -0,0 +1,208 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testKeys are signing keys of every supported type, generated once since RSA keys are slow
+var testKeys = struct {
+	rsa     *rsa.PrivateKey
+	ecdsa   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}{}
+
+func init() {
+	var err error
+	if testKeys.rsa, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	if testKeys.ecdsa, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		panic(err)
+	}
+	if _, testKeys.ed25519, err = ed25519.GenerateKey(rand.Reader); err != nil {
+		panic(err)
+	}
+}
+
+// publicJWK returns the JWK of a signing key's public key
+func publicJWK(t *testing.T, kid string, key crypto.Signer) jsonWebKey {
+	t.Helper()
+	encode := base64.RawURLEncoding.EncodeToString
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return jsonWebKey{Kty: "RSA", Kid: kid, N: encode(pub.N.Bytes()), E: encode(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		point, err := pub.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jsonWebKey{Kty: "EC", Kid: kid, Crv: pub.Curve.Params().Name, X: encode(point[1 : 1+size]), Y: encode(point[1+size:])}
+	case ed25519.PublicKey:
+		return jsonWebKey{Kty: "OKP", Kid: kid, Crv: "Ed25519", X: encode(pub)}
+	}
+	t.Fatalf("unsupported key type %T", key)
+	return jsonWebKey{}
+}
+
+// marshalJWKS encodes a key set
+func marshalJWKS(t *testing.T, keys ...jsonWebKey) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string][]jsonWebKey{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaJWK := publicJWK(t, "rsa", testKeys.rsa)
+	ecJWK := publicJWK(t, "ec", testKeys.ecdsa)
+	edJWK := publicJWK(t, "ed", testKeys.ed25519)
+	with := func(k jsonWebKey, change func(*jsonWebKey)) jsonWebKey {
+		change(&k)
+		return k
+	}
+	smallRSA, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		keys []jsonWebKey
+		// want maps the key IDs of the parsed keys to the algorithms they may verify
+		want map[string][]string
+		// err is a substring of the expected error
+		err string
+	}{
+		{
+			name: "every key type",
+			keys: []jsonWebKey{rsaJWK, ecJWK, edJWK},
+			want: map[string][]string{
+				"rsa": {"RS256", "RS384", "RS512", "PS256", "PS384", "PS512"},
+				"ec":  {"ES256"},
+				"ed":  {"EdDSA"},
+			},
+		},
+		{
+			name: "declared algorithm",
+			keys: []jsonWebKey{with(rsaJWK, func(k *jsonWebKey) { k.Alg = "PS256" })},
+			want: map[string][]string{"rsa": {"PS256"}},
+		},
+		{
+			name: "encryption and unsupported keys skipped",
+			keys: []jsonWebKey{
+				with(rsaJWK, func(k *jsonWebKey) { k.Kid, k.Use = "enc", "enc" }),
+				{Kty: "oct", Kid: "hmac"},
+				with(edJWK, func(k *jsonWebKey) { k.Kid, k.Crv = "x25519", "X25519" }),
+				ecJWK,
+			},
+			want: map[string][]string{"ec": {"ES256"}},
+		},
+		{
+			name: "algorithm of another key type",
+			keys: []jsonWebKey{with(rsaJWK, func(k *jsonWebKey) { k.Alg = "ES256" })},
+			err:  `algorithm "ES256" doesn't match key type RSA`,
+		},
+		{
+			name: "curve of another algorithm",
+			keys: []jsonWebKey{with(ecJWK, func(k *jsonWebKey) { k.Alg = "ES384" })},
+			err:  `algorithm "ES384" doesn't match key type EC`,
+		},
+		{
+			name: "small RSA key",
+			keys: []jsonWebKey{publicJWK(t, "small", smallRSA)},
+			err:  "at least 2048 bits",
+		},
+		{
+			name: "point not on curve",
+			keys: []jsonWebKey{with(ecJWK, func(k *jsonWebKey) { k.Y = k.X })},
+			err:  `kid "ec"`,
+		},
+		{
+			name: "no signing keys",
+			keys: []jsonWebKey{{Kty: "oct", Kid: "hmac"}},
+			err:  "no usable signing keys",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseJWKS(marshalJWKS(t, tt.keys...))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJWKS: %v", err)
+			}
+			got := make(map[string][]string)
+			for _, key := range keys {
+				got[key.kid] = key.algorithms
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parsed keys %v, want %v", got, tt.want)
+			}
+			for kid, algorithms := range tt.want {
+				if !slices.Equal(got[kid], algorithms) {
+					t.Errorf("key %s algorithms = %v, want %v", kid, got[kid], algorithms)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadJWKS(t *testing.T) {
+	data := marshalJWKS(t, publicJWK(t, "ed", testKeys.ed25519))
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/jwks.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name, source string
+		ok           bool
+	}{
+		{"file", file, true},
+		{"url", server.URL + "/jwks.json", true},
+		{"missing file", file + ".missing", false},
+		{"error status", server.URL + "/missing.json", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := loadJWKS(context.Background(), server.Client(), tt.source)
+			if (err == nil) != tt.ok {
+				t.Fatalf("loadJWKS error = %v, want success %v", err, tt.ok)
+			}
+			if tt.ok && (len(keys) != 1 || keys[0].kid != "ed") {
+				t.Errorf("loaded %d keys, want the ed key", len(keys))
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	// Hash implementations used by the signature algorithms
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+const (
+	// clockLeeway tolerates clock differences with the identity provider
+	clockLeeway = time.Minute
+	// minRefreshInterval limits how often a token with an unknown key ID can trigger a refresh
+	minRefreshInterval = time.Minute
+	// jwksTimeout bounds fetching a key set
+	jwksTimeout = 10 * time.Second
+)
+
+// hashes maps the supported signature algorithms to their hash functions
+var hashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// JWTConfig configures the validation of JWT bearer tokens
+type JWTConfig struct {
+	// JWKS is the file path or http(s) URL of the identity provider's JSON Web Key Set
+	JWKS string
+	// Issuer and Audience must match the iss and aud claims
+	Issuer   string
+	Audience string
+	// ScopesClaim names the claim granting scopes, either a space separated string like
+	// the OAuth "scope" claim or a list like "roles" or "groups"
+	ScopesClaim string
+	// ScopeMap maps claim values to scopes. When empty, claim values naming a scope are
+	// granted as is.
+	ScopeMap map[string][]string
+	// NameClaim names the claim identifying the caller in logs, usually "sub"
+	NameClaim string
+	// Refresh is how often the key set is reloaded
+	Refresh time.Duration
+}
+
+// ParseScopeMap parses a mapping of claim values to scopes like
+// "proxy-admins=admin,deployers=read,deployers=domains:write"
+func ParseScopeMap(spec string) (map[string][]string, error) {
+	scopeMap := make(map[string][]string)
+	for part := range strings.SplitSeq(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		value, scope, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid mapping %q, expected value=scope", part)
+		}
+		if err := ValidateScopes([]string{scope}); err != nil {
+			return nil, err
+		}
+		scopeMap[value] = append(scopeMap[value], scope)
+	}
+	return scopeMap, nil
+}
+
+// JWTVerifier validates JWT bearer tokens against the keys of an identity provider
+type JWTVerifier struct {
+	cfg    JWTConfig
+	client *http.Client
+
+	// refreshMu serializes key set reloads, so concurrent requests don't all fetch it
+	refreshMu sync.Mutex
+
+	mu          sync.RWMutex
+	keys        []*verificationKey
+	loadedAt    time.Time
+	attemptedAt time.Time
+}
+
+// NewJWTVerifier creates a verifier. Keys are loaded on first use or by calling Refresh.
+func NewJWTVerifier(cfg JWTConfig) (*JWTVerifier, error) {
+	if cfg.JWKS == "" {
+		return nil, fmt.Errorf("a JWKS file or URL is required")
+	}
+	if cfg.Issuer == "" || cfg.Audience == "" {
+		return nil, fmt.Errorf("issuer and audience are required")
+	}
+	if cfg.ScopesClaim == "" {
+		cfg.ScopesClaim = "scope"
+	}
+	if cfg.NameClaim == "" {
+		cfg.NameClaim = "sub"
+	}
+	if cfg.Refresh <= 0 {
+		cfg.Refresh = time.Hour
+	}
+	return &JWTVerifier{cfg: cfg, client: &http.Client{Timeout: jwksTimeout}}, nil
+}
+
+// LooksLikeJWT reports whether a bearer token has the form of a JWT
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Refresh reloads the key set. On failure, the previous keys stay in use.
+func (v *JWTVerifier) Refresh(ctx context.Context) error {
+	v.refreshMu.Lock()
+	defer v.refreshMu.Unlock()
+	return v.refreshLocked(ctx)
+}
+
+func (v *JWTVerifier) refreshLocked(ctx context.Context) error {
+	v.mu.Lock()
+	v.attemptedAt = time.Now()
+	v.mu.Unlock()
+
+	keys, err := loadJWKS(ctx, v.client, v.cfg.JWKS)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.loadedAt = time.Now()
+	v.mu.Unlock()
+	return nil
+}
+
+// findKey returns the keys that may verify a token with the given key ID and algorithm.
+// The key set is reloaded when it is older than the refresh interval, or when no key
+// matches, since the identity provider may have rotated its keys.
+func (v *JWTVerifier) findKey(ctx context.Context, kid, alg string) ([]*verificationKey, error) {
+	v.mu.RLock()
+	stale := time.Since(v.loadedAt) > v.cfg.Refresh
+	keys := matchKeys(v.keys, kid, alg)
+	v.mu.RUnlock()
+	if !stale && len(keys) > 0 {
+		return keys, nil
+	}
+
+	v.refreshMu.Lock()
+	defer v.refreshMu.Unlock()
+	// Another request may have reloaded the keys while this one waited
+	v.mu.RLock()
+	stale = time.Since(v.loadedAt) > v.cfg.Refresh
+	keys = matchKeys(v.keys, kid, alg)
+	recent := time.Since(v.attemptedAt) < minRefreshInterval
+	v.mu.RUnlock()
+	if (!stale && len(keys) > 0) || recent {
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("no key matches kid %q and alg %s", kid, alg)
+		}
+		return keys, nil
+	}
+
+	refreshErr := v.refreshLocked(ctx)
+	v.mu.RLock()
+	keys = matchKeys(v.keys, kid, alg)
+	v.mu.RUnlock()
+	if len(keys) == 0 {
+		if refreshErr != nil {
+			return nil, fmt.Errorf("no key matches kid %q and alg %s: %w", kid, alg, refreshErr)
+		}
+		return nil, fmt.Errorf("no key matches kid %q and alg %s", kid, alg)
+	}
+	return keys, nil
+}
+
+// matchKeys returns the keys with a key ID that may verify an algorithm. Tokens without a
+// key ID are checked against every key supporting the algorithm.
+func matchKeys(keys []*verificationKey, kid, alg string) []*verificationKey {
+	var matched []*verificationKey
+	for _, key := range keys {
+		if (kid == "" || key.kid == kid) && slices.Contains(key.algorithms, alg) {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+// Verify validates a token's signature, issuer, audience and lifetime, and returns the
+// principal its claims map to
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (*Principal, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed header: %w", err)
+	}
+	if header.Alg != "EdDSA" && hashes[header.Alg] == 0 {
+		return nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature")
+	}
+
+	keys, err := v.findKey(ctx, header.Kid, header.Alg)
+	if err != nil {
+		return nil, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if verifySignature(key.key, header.Alg, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("invalid signature")
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed claims: %w", err)
+	}
+	if err := v.validateClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+
+	scopes := v.mapScopes(claims[v.cfg.ScopesClaim])
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("token grants no scopes in claim %q", v.cfg.ScopesClaim)
+	}
+	name, _ := claims[v.cfg.NameClaim].(string)
+	if name == "" {
+		return nil, fmt.Errorf("token has no %q claim", v.cfg.NameClaim)
+	}
+	return &Principal{Name: name, Scopes: scopes}, nil
+}
+
+// validateClaims checks the registered claims of a token
+func (v *JWTVerifier) validateClaims(claims map[string]any, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != v.cfg.Issuer {
+		return fmt.Errorf("unexpected issuer %q", iss)
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud != v.cfg.Audience {
+			return fmt.Errorf("unexpected audience %q", aud)
+		}
+	case []any:
+		if !slices.Contains(aud, any(v.cfg.Audience)) {
+			return fmt.Errorf("audience %q not in token", v.cfg.Audience)
+		}
+	default:
+		return fmt.Errorf("token has no audience")
+	}
+
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return fmt.Errorf("token has no expiry")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(clockLeeway)) {
+		return fmt.Errorf("token is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	return nil
+}
+
+// mapScopes returns the scopes granted by the value of the scopes claim
+func (v *JWTVerifier) mapScopes(claim any) []string {
+	var values []string
+	switch claim := claim.(type) {
+	case string:
+		values = strings.Fields(claim)
+	case []any:
+		for _, value := range claim {
+			if s, ok := value.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+
+	var scopes []string
+	for _, value := range values {
+		granted := []string{value}
+		if len(v.cfg.ScopeMap) > 0 {
+			granted = v.cfg.ScopeMap[value]
+		}
+		for _, scope := range granted {
+			if slices.Contains(Scopes, scope) && !slices.Contains(scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// verifySignature checks a signature made with alg
+func verifySignature(key crypto.PublicKey, alg string, signed, signature []byte) bool {
+	if alg == "EdDSA" {
+		pub, ok := key.(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, signed, signature)
+	}
+	hash := hashes[alg]
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(pub, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		// JWS encodes ECDSA signatures as the fixed size concatenation of r and s
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
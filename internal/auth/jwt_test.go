@@ -0,0 +1,279 @@
+package auth
+
+import (
+	"cmp"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "https://idp.example.com"
+	testAudience = "simple-proxy"
+)
+
+// jwksServer serves a key set that tests can replace, counting the fetches
+type jwksServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	jwks    []byte
+	status  int
+	fetches atomic.Int32
+}
+
+func newJWKSServer(t *testing.T, keys ...jsonWebKey) *jwksServer {
+	t.Helper()
+	s := &jwksServer{}
+	s.set(t, http.StatusOK, keys...)
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.fetches.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		w.WriteHeader(s.status)
+		w.Write(s.jwks)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// set replaces the served key set and response status
+func (s *jwksServer) set(t *testing.T, status int, keys ...jsonWebKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status, s.jwks = status, marshalJWKS(t, keys...)
+}
+
+// newTestVerifier returns a verifier of tokens issued for testAudience by testIssuer
+func newTestVerifier(t *testing.T, jwks string) *JWTVerifier {
+	t.Helper()
+	v, err := NewJWTVerifier(JWTConfig{JWKS: jwks, Issuer: testIssuer, Audience: testAudience})
+	if err != nil {
+		t.Fatalf("NewJWTVerifier: %v", err)
+	}
+	return v
+}
+
+// testClaims returns valid claims granting the read scope, with changes applied
+func testClaims(changes map[string]any) map[string]any {
+	claims := map[string]any{
+		"iss":   testIssuer,
+		"aud":   testAudience,
+		"sub":   "ci-deploy",
+		"scope": "read",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range changes {
+		if value == nil {
+			delete(claims, name)
+			continue
+		}
+		claims[name] = value
+	}
+	return claims
+}
+
+// signToken returns a JWT with the given header algorithm and key ID, signed by key
+func signToken(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	encode := func(v any) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." + encode(claims)
+
+	// Algorithms the verifier rejects are signed with SHA-256, so only the header is wrong
+	hash := cmp.Or(hashes[alg], crypto.SHA256)
+	var signature []byte
+	var err error
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	case *rsa.PrivateKey:
+		h := hash.New()
+		h.Write([]byte(signed))
+		if strings.HasPrefix(alg, "PS") {
+			signature, err = rsa.SignPSS(rand.Reader, key, hash, h.Sum(nil), &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+		}
+	case *ecdsa.PrivateKey:
+		h := hash.New()
+		h.Write([]byte(signed))
+		r, s, signErr := ecdsa.Sign(rand.Reader, key, h.Sum(nil))
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature, err = make([]byte, 2*size), signErr
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	server := newJWKSServer(t, publicJWK(t, "rsa", testKeys.rsa), publicJWK(t, "ec", testKeys.ecdsa),
+		publicJWK(t, "ed", testKeys.ed25519))
+	v := newTestVerifier(t, server.URL)
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		token string
+		// err is a substring of the expected error, empty if the token is valid
+		err string
+	}{
+		{"RS256", signToken(t, "RS256", "rsa", testKeys.rsa, testClaims(nil)), ""},
+		{"PS384", signToken(t, "PS384", "rsa", testKeys.rsa, testClaims(nil)), ""},
+		{"ES256", signToken(t, "ES256", "ec", testKeys.ecdsa, testClaims(nil)), ""},
+		{"EdDSA", signToken(t, "EdDSA", "ed", testKeys.ed25519, testClaims(nil)), ""},
+		{"without kid", signToken(t, "EdDSA", "", testKeys.ed25519, testClaims(nil)), ""},
+		{"audience list", signToken(t, "EdDSA", "ed", testKeys.ed25519,
+			testClaims(map[string]any{"aud": []string{"other", testAudience}})), ""},
+		{"expired within leeway", signToken(t, "EdDSA", "ed", testKeys.ed25519,
+			testClaims(map[string]any{"exp": now.Add(-30 * time.Second).Unix()})), ""},
+		{"alg none", func() string {
+			token := signToken(t, "EdDSA", "ed", testKeys.ed25519, testClaims(nil))
+			header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"ed"}`))
+			return header + token[strings.Index(token, "."):strings.LastIndex(token, ".")+1]
+		}(), `unsupported algorithm "none"`},
+		{"HMAC with the public key", signToken(t, "HS256", "rsa", testKeys.rsa, testClaims(nil)), `unsupported algorithm "HS256"`},
+		{"alg of another key type", signToken(t, "ES256", "rsa", testKeys.ecdsa, testClaims(nil)), `no key matches kid "rsa"`},
+		{"wrong kid", signToken(t, "EdDSA", "rotated", testKeys.ed25519, testClaims(nil)), `no key matches kid "rotated"`},
+		{"signed by another key", func() string {
+			_, other, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return signToken(t, "EdDSA", "ed", other, testClaims(nil))
+		}(), "invalid signature"},
+		{"tampered claims", func() string {
+			token := signToken(t, "EdDSA", "ed", testKeys.ed25519, testClaims(nil))
+			parts := strings.Split(token, ".")
+			admin, _ := json.Marshal(testClaims(map[string]any{"scope": "admin"}))
+			return parts[0] + "." + base64.RawURLEncoding.EncodeToString(admin) + "." + parts[2]
+		}(), "invalid signature"},
+		{"expired", signToken(t, "EdDSA", "ed", testKeys.ed25519,
+			testClaims(map[string]any{"exp": now.Add(-2 * time.Minute).Unix()})), "token is expired"},
+		{"no expiry", signToken(t, "EdDSA", "ed", testKeys.ed25519, testClaims(map[string]any{"exp": nil})), "no expiry"},
+		{"nbf in the future", signToken(t, "EdDSA", "ed", testKeys.ed25519,
+			testClaims(map[string]any{"nbf": now.Add(2 * time.Minute).Unix()})), "not valid yet"},
+		{"wrong audience", signToken(t, "EdDSA", "ed", testKeys.ed25519,
+			testClaims(map[string]any{"aud": "other"})), `unexpected audience "other"`},
+		{"audience list without ours", signToken(t, "EdDSA", "ed", testKeys.ed25519,
+			testClaims(map[string]any{"aud": []string{"other"}})), "not in token"},
+		{"no audience", signToken(t, "EdDSA", "ed", testKeys.ed25519, testClaims(map[string]any{"aud": nil})), "no audience"},
+		{"wrong issuer", signToken(t, "EdDSA", "ed", testKeys.ed25519,
+			testClaims(map[string]any{"iss": "https://evil.example.com"})), "unexpected issuer"},
+		{"no scopes", signToken(t, "EdDSA", "ed", testKeys.ed25519,
+			testClaims(map[string]any{"scope": "openid profile"})), "grants no scopes"},
+		{"no subject", signToken(t, "EdDSA", "ed", testKeys.ed25519, testClaims(map[string]any{"sub": nil})), `no "sub" claim`},
+		{"malformed", "a.b", "malformed token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := v.Verify(context.Background(), tt.token)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if p.Name != "ci-deploy" || !slices.Equal(p.Scopes, []string{ScopeRead}) {
+				t.Errorf("principal = %+v, want ci-deploy with the read scope", p)
+			}
+		})
+	}
+}
+
+func TestMapScopes(t *testing.T) {
+	tests := []struct {
+		name     string
+		scopeMap map[string][]string
+		claim    any
+		want     []string
+	}{
+		{"space separated", nil, "openid read domains:write", []string{ScopeRead, ScopeDomainsWrite}},
+		{"list", nil, []any{"certs", 42, "read", "certs"}, []string{ScopeCerts, ScopeRead}},
+		{"mapped", map[string][]string{"deployers": {ScopeRead, ScopeDomainsWrite}}, []any{"deployers", "read"},
+			[]string{ScopeRead, ScopeDomainsWrite}},
+		{"missing claim", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &JWTVerifier{cfg: JWTConfig{ScopeMap: tt.scopeMap}}
+			if got := v.mapScopes(tt.claim); !slices.Equal(got, tt.want) {
+				t.Errorf("mapScopes(%v) = %v, want %v", tt.claim, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWKSRefresh(t *testing.T) {
+	old := publicJWK(t, "old", testKeys.ecdsa)
+	current := publicJWK(t, "current", testKeys.ed25519)
+	server := newJWKSServer(t, old)
+	v := newTestVerifier(t, server.URL)
+	verify := func(kid string, key crypto.Signer, alg string) error {
+		_, err := v.Verify(context.Background(), signToken(t, alg, kid, key, testClaims(nil)))
+		return err
+	}
+	// backdate makes the loaded keys and the last reload attempt look older than they are
+	backdate := func(loaded, attempted time.Duration) {
+		v.mu.Lock()
+		v.loadedAt = v.loadedAt.Add(-loaded)
+		v.attemptedAt = v.attemptedAt.Add(-attempted)
+		v.mu.Unlock()
+	}
+	steps := []struct {
+		name    string
+		prepare func()
+		kid     string
+		ok      bool
+		fetches int32
+	}{
+		{"keys loaded on first use", func() {}, "old", true, 1},
+		{"unknown kid right after a reload", func() { server.set(t, http.StatusOK, old, current) }, "current", false, 1},
+		{"unknown kid reloads the keys", func() { backdate(0, minRefreshInterval) }, "current", true, 2},
+		{"known kid uses loaded keys", func() { server.set(t, http.StatusOK, current) }, "old", true, 2},
+		{"stale keys are reloaded", func() { backdate(2*time.Hour, minRefreshInterval) }, "old", false, 3},
+		{"failed reload keeps the keys", func() {
+			server.set(t, http.StatusInternalServerError)
+			backdate(2*time.Hour, minRefreshInterval)
+		}, "current", true, 4},
+	}
+	for _, step := range steps {
+		step.prepare()
+		var err error
+		if step.kid == "old" {
+			err = verify("old", testKeys.ecdsa, "ES256")
+		} else {
+			err = verify("current", testKeys.ed25519, "EdDSA")
+		}
+		if (err == nil) != step.ok {
+			t.Errorf("%s: Verify error = %v, want success %v", step.name, err, step.ok)
+		}
+		if got := server.fetches.Load(); got != step.fetches {
+			t.Errorf("%s: %d JWKS fetches, want %d", step.name, got, step.fetches)
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/logging"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// keySeparator separates the domain, request URI and Vary values in cache keys. The key
+// of just a domain and request URI holds the index entry listing the Vary header names
+// of its responses.
+const keySeparator = "\x00"
+
+// defaultMaxObjectSize limits the size of a single cached response body
+const defaultMaxObjectSize = 10 << 20
+
+// cacheableStatus lists the status codes that may be stored (RFC 9110 section 15.1)
+var cacheableStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// Cache is a shared HTTP response cache for proxied domains
+type Cache struct {
+	store  Store
+	flight flightGroup
+}
+
+// logger returns the cache subsystem logger
+func logger() *slog.Logger {
+	return logging.Logger(logging.Cache)
+}
+
+// New creates a cache backed by the given store
+func New(store Store) *Cache {
+	return &Cache{store: store}
+}
+
+// Serve serves a request for a domain from the cache when possible, calling next to
+// fetch responses from the backend. Concurrent misses for the same key are coalesced
+// into a single backend request.
+func (c *Cache) Serve(w http.ResponseWriter, r *http.Request, domain string, cfg *models.CacheConfig, next http.Handler) {
+	if !cacheableRequest(r) {
+		w.Header().Set("X-Cache", "BYPASS")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	primary := domain + keySeparator + r.URL.RequestURI()
+	key := c.variantKey(primary, r)
+	now := time.Now()
+
+	entry, found := c.store.Get(key)
+	if found && !hasDirective(r.Header, "no-cache") {
+		switch {
+		case now.Before(entry.FreshUntil):
+			writeEntry(w, r, entry)
+			return
+		case now.Before(entry.FreshUntil.Add(entry.StaleWhileRevalidate)):
+			writeEntry(w, r, entry)
+			c.revalidate(key, primary, r, cfg, next)
+			return
+		}
+	}
+
+	// HEAD responses have no body to store, so only GET requests populate the cache
+	if r.Method != http.MethodGet {
+		w.Header().Set("X-Cache", "MISS")
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	var stale *Entry
+	if found && now.Before(entry.FreshUntil.Add(entry.StaleIfError)) {
+		stale = entry
+	}
+
+	shared, leader, err := c.flight.do(r.Context(), key, func() *Entry {
+		cw := newCaptureWriter(w, maxObjectSize(cfg), stale != nil)
+		cw.Header().Set("X-Cache", "MISS")
+		next.ServeHTTP(cw, r)
+
+		if cw.intercepted {
+			logger().WarnContext(r.Context(), "Serving stale response after backend error", "domain", domain, "path", r.URL.RequestURI(), "status", cw.status)
+			writeEntry(w, r, stale)
+			return stale
+		}
+		return c.storeResponse(key, primary, r, cfg, cw)
+	})
+	if leader || err != nil {
+		return
+	}
+	// Until a response has been seen, requests differing in Vary headers share a key,
+	// so only use the shared response if it is for this request's variant
+	if shared != nil && shared.Key == c.variantKey(primary, r) {
+		writeEntry(w, r, shared)
+		return
+	}
+
+	// The leader's response could not be shared, so fetch our own
+	w.Header().Set("X-Cache", "MISS")
+	next.ServeHTTP(w, r)
+}
+
+// Purge removes cached responses and returns how many were removed. An empty domain
+// matches all domains; path matches a request path exactly (with any query string) and
+// prefix matches path prefixes.
+func (c *Cache) Purge(domain, path, prefix string) int {
+	purged := 0
+	c.store.Purge(func(key string) bool {
+		parts := strings.SplitN(key, keySeparator, 3)
+		if len(parts) < 2 {
+			return false
+		}
+		if domain != "" && parts[0] != domain {
+			return false
+		}
+		uri := parts[1]
+		if path != "" && uri != path && !strings.HasPrefix(uri, path+"?") {
+			return false
+		}
+		if prefix != "" && !strings.HasPrefix(uri, prefix) {
+			return false
+		}
+		// Vary index entries are removed along with the responses, but aren't counted
+		if len(parts) == 3 {
+			purged++
+		}
+		return true
+	})
+	return purged
+}
+
+// revalidate refreshes an entry in the background, unless a refresh is already running
+func (c *Cache) revalidate(key, primary string, r *http.Request, cfg *models.CacheConfig, next http.Handler) {
+	if c.flight.inProgress(key) {
+		return
+	}
+
+	// The refresh outlives the client request, so detach it from the request's cancellation
+	req := r.Clone(context.WithoutCancel(r.Context()))
+	req.Method = http.MethodGet
+	go func() {
+		defer func() {
+			if err := recover(); err != nil && err != http.ErrAbortHandler {
+				logger().ErrorContext(req.Context(), "Cache revalidation panicked", "path", req.URL.RequestURI(), "error", err)
+			}
+		}()
+		c.flight.do(req.Context(), key, func() *Entry {
+			cw := newCaptureWriter(&discardWriter{header: make(http.Header)}, maxObjectSize(cfg), false)
+			next.ServeHTTP(cw, req)
+			return c.storeResponse(key, primary, req, cfg, cw)
+		})
+	}()
+}
+
+// storeResponse stores a captured response if it is cacheable and returns the new entry
+func (c *Cache) storeResponse(key, primary string, r *http.Request, cfg *models.CacheConfig, cw *captureWriter) *Entry {
+	if cw.overflow || !cacheableStatus[cw.status] {
+		return nil
+	}
+	header := cw.Header().Clone()
+	header.Del("X-Cache")
+
+	policy, ok := responsePolicy(header, cfg)
+	if !ok {
+		return nil
+	}
+
+	// Responses that vary on new headers are stored under a key including those headers.
+	// The names are kept in the store, so they are evicted and purged like the responses.
+	now := time.Now()
+	varyNames := varyHeaderNames(header)
+	if !equalStrings(c.varyNames(primary), varyNames) {
+		c.store.Set(&Entry{Key: primary, Vary: varyNames, StoredAt: now})
+		key = primary + keySeparator + varyValues(varyNames, r)
+	}
+
+	entry := &Entry{
+		Key:                  key,
+		StatusCode:           cw.status,
+		Header:               header,
+		Body:                 cw.body.Bytes(),
+		StoredAt:             now,
+		FreshUntil:           now.Add(policy.freshness),
+		StaleWhileRevalidate: policy.staleWhileRevalidate,
+		StaleIfError:         policy.staleIfError,
+	}
+	c.store.Set(entry)
+	return entry
+}
+
+// variantKey returns the cache key for a request, including the values of the headers
+// the stored response varies on
+func (c *Cache) variantKey(primary string, r *http.Request) string {
+	return primary + keySeparator + varyValues(c.varyNames(primary), r)
+}
+
+// varyNames returns the Vary header names last stored for a domain and request URI
+func (c *Cache) varyNames(primary string) []string {
+	if index, ok := c.store.Get(primary); ok {
+		return index.Vary
+	}
+	return nil
+}
+
+// cachePolicy describes how long a response may be served from the cache
+type cachePolicy struct {
+	freshness            time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+}
+
+// responsePolicy determines whether a response may be stored in a shared cache and for how long
+func responsePolicy(header http.Header, cfg *models.CacheConfig) (cachePolicy, bool) {
+	directives := parseCacheControl(header.Values("Cache-Control"))
+	if _, ok := directives["no-store"]; ok {
+		return cachePolicy{}, false
+	}
+	if _, ok := directives["private"]; ok {
+		return cachePolicy{}, false
+	}
+	if _, ok := directives["no-cache"]; ok {
+		return cachePolicy{}, false
+	}
+	// Responses setting cookies are specific to one client
+	if header.Get("Set-Cookie") != "" {
+		return cachePolicy{}, false
+	}
+	for _, name := range varyHeaderNames(header) {
+		if name == "*" {
+			return cachePolicy{}, false
+		}
+	}
+
+	policy := cachePolicy{
+		staleWhileRevalidate: time.Duration(cfg.StaleWhileRevalidate) * time.Second,
+		staleIfError:         time.Duration(cfg.StaleIfError) * time.Second,
+	}
+	if seconds, ok := directiveSeconds(directives, "stale-while-revalidate"); ok {
+		policy.staleWhileRevalidate = seconds
+	}
+	if seconds, ok := directiveSeconds(directives, "stale-if-error"); ok {
+		policy.staleIfError = seconds
+	}
+
+	if seconds, ok := directiveSeconds(directives, "s-maxage"); ok {
+		policy.freshness = seconds
+	} else if seconds, ok := directiveSeconds(directives, "max-age"); ok {
+		policy.freshness = seconds
+	} else if expires := header.Get("Expires"); expires != "" {
+		// Invalid Expires values mean the response is already stale
+		if t, err := http.ParseTime(expires); err == nil {
+			date := time.Now()
+			if d, err := http.ParseTime(header.Get("Date")); err == nil {
+				date = d
+			}
+			policy.freshness = t.Sub(date)
+		}
+	} else if cfg.DefaultTTL > 0 {
+		policy.freshness = time.Duration(cfg.DefaultTTL) * time.Second
+	} else {
+		return cachePolicy{}, false
+	}
+
+	// Account for time the response already spent in upstream caches
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil {
+		policy.freshness -= time.Duration(age) * time.Second
+	}
+	if policy.freshness < 0 {
+		policy.freshness = 0
+	}
+	return policy, true
+}
+
+// cacheableRequest reports whether a request may be answered from the cache
+func cacheableRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	// Authenticated and upgrade requests are never shared
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return !hasDirective(r.Header, "no-store")
+}
+
+// writeEntry writes a cached response to the client
+func writeEntry(w http.ResponseWriter, r *http.Request, entry *Entry) {
+	header := w.Header()
+	for name, values := range entry.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	now := time.Now()
+	header.Set("Age", strconv.Itoa(int(now.Sub(entry.StoredAt).Seconds())))
+	if now.Before(entry.FreshUntil) {
+		header.Set("X-Cache", "HIT")
+	} else {
+		header.Set("X-Cache", "STALE")
+	}
+	w.WriteHeader(entry.StatusCode)
+	if r.Method != http.MethodHead {
+		w.Write(entry.Body)
+	}
+}
+
+// maxObjectSize returns the largest body a domain may store
+func maxObjectSize(cfg *models.CacheConfig) int {
+	if cfg.MaxObjectSize > 0 {
+		return cfg.MaxObjectSize
+	}
+	return defaultMaxObjectSize
+}
+
+// parseCacheControl parses Cache-Control header values into lowercase directives
+func parseCacheControl(values []string) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+			if name == "" {
+				continue
+			}
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+// directiveSeconds returns a directive's delta-seconds argument
+func directiveSeconds(directives map[string]string, name string) (time.Duration, bool) {
+	arg, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(arg)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// hasDirective reports whether a request carries a Cache-Control directive
+func hasDirective(header http.Header, name string) bool {
+	_, ok := parseCacheControl(header.Values("Cache-Control"))[name]
+	return ok
+}
+
+// varyHeaderNames returns the sorted, canonical header names listed in Vary
+func varyHeaderNames(header http.Header) []string {
+	var names []string
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// varyValues encodes a request's values of the given headers for use in a cache key
+func varyValues(names []string, r *http.Request) string {
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('=')
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// captureWriter forwards a response to the client while keeping a copy of it for the cache.
+// When interceptErrors is set, server error responses are swallowed so a stale entry can
+// be served in their place.
+type captureWriter struct {
+	w               http.ResponseWriter
+	header          http.Header
+	status          int
+	body            bytes.Buffer
+	limit           int
+	overflow        bool
+	interceptErrors bool
+	intercepted     bool
+	wroteHeader     bool
+}
+
+func newCaptureWriter(w http.ResponseWriter, limit int, interceptErrors bool) *captureWriter {
+	return &captureWriter{w: w, header: make(http.Header), limit: limit, interceptErrors: interceptErrors}
+}
+
+func (cw *captureWriter) Header() http.Header {
+	return cw.header
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	// Informational responses are passed through without ending the response
+	if status >= 100 && status < 200 {
+		copyHeader(cw.w.Header(), cw.header)
+		cw.w.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+	cw.status = status
+	if cw.interceptErrors && status >= 500 {
+		cw.intercepted = true
+		return
+	}
+	copyHeader(cw.w.Header(), cw.header)
+	cw.w.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.intercepted {
+		return len(b), nil
+	}
+	if !cw.overflow {
+		if cw.body.Len()+len(b) > cw.limit {
+			cw.overflow = true
+			cw.body = bytes.Buffer{}
+		} else {
+			cw.body.Write(b)
+		}
+	}
+	return cw.w.Write(b)
+}
+
+// Flush passes flushes through so streamed responses aren't delayed
+func (cw *captureWriter) Flush() {
+	if cw.intercepted {
+		return
+	}
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	http.NewResponseController(cw.w).Flush()
+}
+
+func copyHeader(dst, src http.Header) {
+	for name, values := range src {
+		dst[name] = values
+	}
+}
+
+// discardWriter is the response writer of background revalidations
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.header }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(int)             {}
+
+// flightGroup coalesces concurrent fetches of the same key
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done  chan struct{}
+	entry *Entry
+}
+
+// do runs fn unless a call for key is already running, in which case it waits for that
+// call's result. It reports whether fn was run by this caller.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() *Entry) (*Entry, bool, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-call.done:
+			return call.entry, false, nil
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.entry = fn()
+	return call.entry, true, nil
+}
+
+// inProgress reports whether a call for key is running
+func (g *flightGroup) inProgress(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.calls[key]
+	return ok
+}
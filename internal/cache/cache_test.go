@@ -0,0 +1,261 @@
+package cache
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// backend returns a handler answering with the given headers and a body counting its calls
+func backend(header http.Header) http.Handler {
+	var calls atomic.Int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, values := range header {
+			w.Header()[name] = values
+		}
+		fmt.Fprintf(w, "response %d", calls.Add(1))
+	})
+}
+
+// serve sends a request for a domain through the cache
+func serve(c *Cache, domain, target string, header http.Header, next http.Handler) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	c.Serve(w, r, domain, &models.CacheConfig{Enabled: true}, next)
+	return w
+}
+
+func TestResponsePolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    http.Header
+		cfg       models.CacheConfig
+		want      cachePolicy
+		cacheable bool
+	}{
+		{"no headers or default", http.Header{}, models.CacheConfig{}, cachePolicy{}, false},
+		{"default ttl", http.Header{}, models.CacheConfig{DefaultTTL: 30}, cachePolicy{freshness: 30 * time.Second}, true},
+		{"max-age", http.Header{"Cache-Control": {"max-age=60"}}, models.CacheConfig{DefaultTTL: 30},
+			cachePolicy{freshness: time.Minute}, true},
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, models.CacheConfig{},
+			cachePolicy{freshness: 2 * time.Minute}, true},
+		{"age subtracted", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"20"}}, models.CacheConfig{},
+			cachePolicy{freshness: 40 * time.Second}, true},
+		{"age beyond freshness", http.Header{"Cache-Control": {"max-age=60"}, "Age": {"90"}}, models.CacheConfig{},
+			cachePolicy{}, true},
+		{"stale extensions", http.Header{"Cache-Control": {"max-age=1, stale-while-revalidate=5, stale-if-error=9"}},
+			models.CacheConfig{StaleWhileRevalidate: 1, StaleIfError: 1},
+			cachePolicy{freshness: time.Second, staleWhileRevalidate: 5 * time.Second, staleIfError: 9 * time.Second}, true},
+		{"stale defaults", http.Header{"Cache-Control": {"max-age=1"}}, models.CacheConfig{StaleWhileRevalidate: 2, StaleIfError: 3},
+			cachePolicy{freshness: time.Second, staleWhileRevalidate: 2 * time.Second, staleIfError: 3 * time.Second}, true},
+		{"expires", http.Header{"Date": {"Mon, 01 Jan 2024 00:00:00 GMT"}, "Expires": {"Mon, 01 Jan 2024 00:05:00 GMT"}},
+			models.CacheConfig{}, cachePolicy{freshness: 5 * time.Minute}, true},
+		{"invalid expires", http.Header{"Expires": {"0"}}, models.CacheConfig{DefaultTTL: 30}, cachePolicy{}, true},
+		{"no-store", http.Header{"Cache-Control": {"no-store, max-age=60"}}, models.CacheConfig{}, cachePolicy{}, false},
+		{"private", http.Header{"Cache-Control": {"private"}}, models.CacheConfig{DefaultTTL: 30}, cachePolicy{}, false},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, models.CacheConfig{DefaultTTL: 30}, cachePolicy{}, false},
+		{"set-cookie", http.Header{"Set-Cookie": {"a=b"}}, models.CacheConfig{DefaultTTL: 30}, cachePolicy{}, false},
+		{"vary star", http.Header{"Vary": {"Accept, *"}}, models.CacheConfig{DefaultTTL: 30}, cachePolicy{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := responsePolicy(tt.header, &tt.cfg)
+			if ok != tt.cacheable {
+				t.Fatalf("cacheable = %v, want %v", ok, tt.cacheable)
+			}
+			if got != tt.want {
+				t.Errorf("policy = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheableRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		header http.Header
+		want   bool
+	}{
+		{"get", http.MethodGet, nil, true},
+		{"head", http.MethodHead, nil, true},
+		{"post", http.MethodPost, nil, false},
+		{"authorization", http.MethodGet, http.Header{"Authorization": {"Bearer x"}}, false},
+		{"upgrade", http.MethodGet, http.Header{"Upgrade": {"websocket"}}, false},
+		{"no-store", http.MethodGet, http.Header{"Cache-Control": {"no-store"}}, false},
+		{"no-cache", http.MethodGet, http.Header{"Cache-Control": {"no-cache"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/", nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			if got := cacheableRequest(r); got != tt.want {
+				t.Errorf("cacheableRequest = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVaryHeaderNames(t *testing.T) {
+	tests := []struct {
+		vary []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"accept-encoding"}, []string{"Accept-Encoding"}},
+		{[]string{"X-B, accept", "x-a"}, []string{"Accept", "X-A", "X-B"}},
+		{[]string{" , "}, nil},
+	}
+	for _, tt := range tests {
+		got := varyHeaderNames(http.Header{"Vary": tt.vary})
+		if !equalStrings(got, tt.want) {
+			t.Errorf("varyHeaderNames(%q) = %q, want %q", tt.vary, got, tt.want)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	// step is a request sent in order, with its expected X-Cache header and body
+	type step struct {
+		header http.Header
+		cache  string
+		body   string
+	}
+	tests := []struct {
+		name string
+		// header of the backend responses
+		header   http.Header
+		requests []step
+	}{
+		{
+			name:   "fresh response is reused",
+			header: http.Header{"Cache-Control": {"max-age=60"}},
+			requests: []step{
+				{nil, "MISS", "response 1"},
+				{nil, "HIT", "response 1"},
+			},
+		},
+		{
+			name:   "uncacheable response is fetched every time",
+			header: http.Header{"Cache-Control": {"no-store"}},
+			requests: []step{
+				{nil, "MISS", "response 1"},
+				{nil, "MISS", "response 2"},
+			},
+		},
+		{
+			name:   "request no-cache revalidates",
+			header: http.Header{"Cache-Control": {"max-age=60"}},
+			requests: []step{
+				{nil, "MISS", "response 1"},
+				{http.Header{"Cache-Control": {"no-cache"}}, "MISS", "response 2"},
+				{nil, "HIT", "response 2"},
+			},
+		},
+		{
+			name:   "authorized request bypasses",
+			header: http.Header{"Cache-Control": {"max-age=60"}},
+			requests: []step{
+				{nil, "MISS", "response 1"},
+				{http.Header{"Authorization": {"Bearer x"}}, "BYPASS", "response 2"},
+			},
+		},
+		{
+			name:   "variants are stored per vary value",
+			header: http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}},
+			requests: []step{
+				{http.Header{"Accept-Language": {"en"}}, "MISS", "response 1"},
+				{http.Header{"Accept-Language": {"de"}}, "MISS", "response 2"},
+				{http.Header{"Accept-Language": {"en"}}, "HIT", "response 1"},
+				{http.Header{"Accept-Language": {"de"}}, "HIT", "response 2"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(NewMemoryStore(1 << 20))
+			next := backend(tt.header)
+			for i, req := range tt.requests {
+				w := serve(c, "example.com", "/page", req.header, next)
+				if got := w.Header().Get("X-Cache"); got != req.cache {
+					t.Errorf("request %d: X-Cache = %q, want %q", i, got, req.cache)
+				}
+				if got := w.Body.String(); got != req.body {
+					t.Errorf("request %d: body = %q, want %q", i, got, req.body)
+				}
+			}
+		})
+	}
+}
+
+func TestPurge(t *testing.T) {
+	tests := []struct {
+		name                 string
+		domain, path, prefix string
+		want                 int
+	}{
+		{"all", "", "", "", 4},
+		{"domain", "a.example.com", "", "", 3},
+		{"path", "a.example.com", "/page", "", 2},
+		{"prefix", "", "", "/other", 2},
+		{"nothing", "c.example.com", "", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(NewMemoryStore(1 << 20))
+			next := backend(http.Header{"Cache-Control": {"max-age=60"}})
+			for _, target := range []string{"/page", "/page?q=1", "/other"} {
+				serve(c, "a.example.com", target, nil, next)
+			}
+			serve(c, "b.example.com", "/other", nil, next)
+
+			if got := c.Purge(tt.domain, tt.path, tt.prefix); got != tt.want {
+				t.Errorf("Purge(%q, %q, %q) = %d, want %d", tt.domain, tt.path, tt.prefix, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurgeRemovesVaryIndex(t *testing.T) {
+	store := NewMemoryStore(1 << 20).(*memoryStore)
+	c := New(store)
+	next := backend(http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}})
+	for _, language := range []string{"en", "de"} {
+		serve(c, "example.com", "/page", http.Header{"Accept-Language": {language}}, next)
+	}
+	if got := len(store.entries); got != 3 {
+		t.Fatalf("stored %d entries, want 2 variants and their index", got)
+	}
+
+	if got := c.Purge("example.com", "", ""); got != 2 {
+		t.Errorf("Purge = %d, want 2", got)
+	}
+	if got := len(store.entries); got != 0 {
+		t.Errorf("%d entries left after purge, want 0", got)
+	}
+}
+
+func TestVaryIndexIsEvicted(t *testing.T) {
+	store := NewMemoryStore(4 << 10).(*memoryStore)
+	c := New(store)
+	next := backend(http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}})
+	for i := range 1000 {
+		serve(c, "example.com", fmt.Sprintf("/page/%d", i), http.Header{"Accept-Language": {"en"}}, next)
+	}
+	if store.size > store.maxBytes {
+		t.Errorf("store size %d exceeds %d", store.size, store.maxBytes)
+	}
+	if got := len(store.entries); got >= 1000 {
+		t.Errorf("%d entries kept, want Vary index entries evicted with the responses", got)
+	}
+}
@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// diskFileExt marks files written by the disk store, so only those are ever loaded or removed
+const diskFileExt = ".cache"
+
+// diskStore keeps entries as files in a directory, with an in-memory LRU index
+type diskStore struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+}
+
+// diskIndexEntry is the in-memory index record of a file on disk
+type diskIndexEntry struct {
+	key  string
+	size int64
+}
+
+// NewDiskStore creates a store persisting entries in dir, limited to maxBytes on disk.
+// Entries written by a previous run are loaded, least recently modified first in line for eviction.
+func NewDiskStore(dir string, maxBytes int64) (Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	s := &diskStore{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load rebuilds the index from files left by a previous run
+func (s *diskStore) load() error {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+diskFileExt))
+	if err != nil {
+		return fmt.Errorf("failed to list cache directory: %w", err)
+	}
+
+	type loaded struct {
+		key  string
+		size int64
+		mod  int64
+	}
+	var found []loaded
+	for _, file := range files {
+		entry, err := readEntry(file)
+		if err != nil {
+			logger().Warn("Removing unreadable cache file", "file", file, "error", err)
+			os.Remove(file)
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		found = append(found, loaded{key: entry.Key, size: info.Size(), mod: info.ModTime().UnixNano()})
+	}
+
+	// Most recently written files end up at the front of the LRU list
+	sort.Slice(found, func(i, j int) bool { return found[i].mod < found[j].mod })
+	for _, f := range found {
+		s.entries[f.key] = s.lru.PushFront(&diskIndexEntry{key: f.key, size: f.size})
+		s.size += f.size
+	}
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+	return nil
+}
+
+func (s *diskStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	elem, ok := s.entries[key]
+	if ok {
+		s.lru.MoveToFront(elem)
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	entry, err := readEntry(s.path(key))
+	if err != nil {
+		logger().Warn("Failed to read cache entry", "key", key, "error", err)
+		s.mu.Lock()
+		if elem, ok := s.entries[key]; ok {
+			s.remove(elem)
+		}
+		s.mu.Unlock()
+		return nil, false
+	}
+	return entry, true
+}
+
+func (s *diskStore) Set(entry *Entry) {
+	path := s.path(entry.Key)
+	tmp, err := os.CreateTemp(s.dir, "tmp-*")
+	if err != nil {
+		logger().Warn("Failed to create cache file", "error", err)
+		return
+	}
+	if err := gob.NewEncoder(tmp).Encode(entry); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		logger().Warn("Failed to write cache entry", "key", entry.Key, "error", err)
+		return
+	}
+	info, err := tmp.Stat()
+	tmp.Close()
+	if err != nil || info.Size() > s.maxBytes {
+		os.Remove(tmp.Name())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		logger().Warn("Failed to store cache entry", "key", entry.Key, "error", err)
+		return
+	}
+	if elem, ok := s.entries[entry.Key]; ok {
+		s.size -= elem.Value.(*diskIndexEntry).size
+		s.lru.Remove(elem)
+	}
+	s.entries[entry.Key] = s.lru.PushFront(&diskIndexEntry{key: entry.Key, size: info.Size()})
+	s.size += info.Size()
+
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *diskStore) Purge(match func(key string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for key, elem := range s.entries {
+		if match(key) {
+			s.remove(elem)
+			purged++
+		}
+	}
+	return purged
+}
+
+// remove deletes an element and its file; the caller must hold the lock
+func (s *diskStore) remove(elem *list.Element) {
+	index := elem.Value.(*diskIndexEntry)
+	s.lru.Remove(elem)
+	delete(s.entries, index.key)
+	s.size -= index.size
+	if err := os.Remove(s.path(index.key)); err != nil && !os.IsNotExist(err) {
+		logger().Warn("Failed to remove cache file", "key", index.key, "error", err)
+	}
+}
+
+// path returns the file used for a key
+func (s *diskStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+diskFileExt)
+}
+
+// readEntry decodes an entry file
+func readEntry(path string) (*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entry Entry
+	if err := gob.NewDecoder(f).Decode(&entry); err != nil {
+		return nil, err
+	}
+	if !strings.Contains(entry.Key, keySeparator) {
+		return nil, fmt.Errorf("invalid cache key")
+	}
+	return &entry, nil
+}
@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Entry is a cached response
+type Entry struct {
+	Key        string
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// StoredAt is when the response was received from the backend
+	StoredAt time.Time
+	// FreshUntil is when the response becomes stale
+	FreshUntil time.Time
+	// StaleWhileRevalidate and StaleIfError extend how long a stale response may be served
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	// Vary is set on the index entry of a domain and request URI, listing the request
+	// headers that select which of its stored responses is served
+	Vary []string
+}
+
+// size approximates the memory used by an entry
+func (e *Entry) size() int64 {
+	size := int64(len(e.Key) + len(e.Body))
+	for _, name := range e.Vary {
+		size += int64(len(name))
+	}
+	for name, values := range e.Header {
+		size += int64(len(name))
+		for _, value := range values {
+			size += int64(len(value))
+		}
+	}
+	return size
+}
+
+// Store holds cached entries, evicting the least recently used ones when full
+type Store interface {
+	// Get returns the entry for key, if present
+	Get(key string) (*Entry, bool)
+	// Set stores an entry under its key, replacing any existing entry
+	Set(entry *Entry)
+	// Purge removes all entries whose key matches and returns how many were removed
+	Purge(match func(key string) bool) int
+}
+
+// memoryStore keeps entries in memory with LRU eviction
+type memoryStore struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	lru      *list.List
+	entries  map[string]*list.Element
+}
+
+// NewMemoryStore creates an in-memory store limited to maxBytes
+func NewMemoryStore(maxBytes int64) Store {
+	return &memoryStore{
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (s *memoryStore) Get(key string) (*Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elem, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+	s.lru.MoveToFront(elem)
+	return elem.Value.(*Entry), true
+}
+
+func (s *memoryStore) Set(entry *Entry) {
+	size := entry.size()
+	if size > s.maxBytes {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elem, ok := s.entries[entry.Key]; ok {
+		s.remove(elem)
+	}
+	s.entries[entry.Key] = s.lru.PushFront(entry)
+	s.size += size
+
+	for s.size > s.maxBytes {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *memoryStore) Purge(match func(key string) bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for key, elem := range s.entries {
+		if match(key) {
+			s.remove(elem)
+			purged++
+		}
+	}
+	return purged
+}
+
+// remove deletes an element; the caller must hold the lock
+func (s *memoryStore) remove(elem *list.Element) {
+	entry := elem.Value.(*Entry)
+	s.lru.Remove(elem)
+	delete(s.entries, entry.Key)
+	s.size -= entry.size()
+}
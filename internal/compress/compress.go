@@ -0,0 +1,253 @@
+package compress
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// defaultEncodings lists the supported encodings in order of server preference
+var defaultEncodings = []string{"br", "zstd", "gzip"}
+
+// defaultMimeTypes lists the content types compressed when a domain doesn't configure its own
+var defaultMimeTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/javascript",
+	"application/xml",
+	"application/*+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// defaultMinSize is the smallest Content-Length compressed when a domain doesn't configure one
+const defaultMinSize = 1024
+
+// encoder compresses a response body
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// encoderPools reuse encoders per encoding, since they are costly to allocate
+var encoderPools = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} { return gzip.NewWriter(io.Discard) }},
+	"br":   {New: func() interface{} { return brotli.NewWriterLevel(io.Discard, 4) }},
+	"zstd": {New: func() interface{} {
+		w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1))
+		return w
+	}},
+}
+
+// newEncoder takes an encoder for an encoding from its pool, writing to w
+func newEncoder(encoding string, w io.Writer) encoder {
+	e := encoderPools[encoding].Get().(encoder)
+	e.Reset(w)
+	return e
+}
+
+// Validate checks that a compression configuration is usable
+func Validate(cfg *models.CompressionConfig) error {
+	for _, encoding := range cfg.Encodings {
+		if _, ok := encoderPools[encoding]; !ok {
+			return fmt.Errorf("unsupported encoding %q", encoding)
+		}
+	}
+	for _, pattern := range cfg.MimeTypes {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid mime type pattern %q", pattern)
+		}
+	}
+	if cfg.MinSize < 0 {
+		return fmt.Errorf("min_size must not be negative")
+	}
+	return nil
+}
+
+// Serve calls next with a response writer that compresses eligible responses using the
+// best encoding accepted by the client
+func Serve(w http.ResponseWriter, r *http.Request, cfg *models.CompressionConfig, next http.Handler) {
+	encodings := cfg.Encodings
+	if len(encodings) == 0 {
+		encodings = defaultEncodings
+	}
+
+	// Upgraded connections and HEAD requests are passed through untouched
+	if r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	cw := &compressWriter{
+		ResponseWriter: w,
+		cfg:            cfg,
+		encoding:       negotiate(r.Header.Values("Accept-Encoding"), encodings),
+	}
+	defer cw.close()
+	next.ServeHTTP(cw, r)
+}
+
+// compressWriter decides when the response header is written whether to compress the body
+type compressWriter struct {
+	http.ResponseWriter
+	cfg         *models.CompressionConfig
+	encoding    string
+	encoder     encoder
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	if status >= 100 && status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.wroteHeader = true
+
+	header := cw.Header()
+	if cw.eligible(status, header) {
+		header.Add("Vary", "Accept-Encoding")
+		if cw.encoding != "" {
+			header.Set("Content-Encoding", cw.encoding)
+			header.Del("Content-Length")
+			header.Del("Accept-Ranges")
+			// The compressed body is no longer byte-for-byte identical to the original
+			if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				header.Set("ETag", "W/"+etag)
+			}
+			cw.encoder = newEncoder(cw.encoding, cw.ResponseWriter)
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+// eligible reports whether a response may be compressed
+func (cw *compressWriter) eligible(status int, header http.Header) bool {
+	switch status {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+
+	minSize := cw.cfg.MinSize
+	if minSize == 0 {
+		minSize = defaultMinSize
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < minSize {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	// Event streams must reach the client as they are written
+	if mediaType == "text/event-stream" {
+		return false
+	}
+	patterns := cw.cfg.MimeTypes
+	if len(patterns) == 0 {
+		patterns = defaultMimeTypes
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Flush writes out data buffered by the encoder before flushing the connection
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.encoder != nil {
+		cw.encoder.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap exposes the underlying writer, e.g. for hijacking upgraded connections
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close finishes the compressed stream and returns the encoder to its pool
+func (cw *compressWriter) close() {
+	if cw.encoder == nil {
+		return
+	}
+	cw.encoder.Close()
+	// Drop the reference to the response writer before pooling the encoder
+	cw.encoder.Reset(io.Discard)
+	encoderPools[cw.encoding].Put(cw.encoder)
+	cw.encoder = nil
+}
+
+// negotiate picks the encoding with the highest client preference, breaking ties by
+// server preference. It returns an empty string if no encoding is acceptable.
+func negotiate(acceptEncoding []string, supported []string) string {
+	weights := make(map[string]float64)
+	for _, value := range acceptEncoding {
+		for _, part := range strings.Split(value, ",") {
+			fields := strings.Split(part, ";")
+			name := strings.ToLower(strings.TrimSpace(fields[0]))
+			if name == "" {
+				continue
+			}
+			weight := 1.0
+			for _, param := range fields[1:] {
+				key, val, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.ToLower(key) == "q" {
+					if q, err := strconv.ParseFloat(val, 64); err == nil {
+						weight = q
+					}
+				}
+			}
+			weights[name] = weight
+		}
+	}
+
+	best, bestWeight := "", 0.0
+	for _, encoding := range supported {
+		weight, ok := weights[encoding]
+		if !ok {
+			weight, ok = weights["*"]
+		}
+		if ok && weight > bestWeight {
+			best, bestWeight = encoding, weight
+		}
+	}
+	return best
+}
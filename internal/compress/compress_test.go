@@ -0,0 +1,185 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding []string
+		supported      []string
+		want           string
+	}{
+		{"no header", nil, defaultEncodings, ""},
+		{"server preference breaks ties", []string{"gzip, zstd, br"}, defaultEncodings, "br"},
+		{"client weights", []string{"br;q=0.5, gzip;q=0.8"}, defaultEncodings, "gzip"},
+		{"case and spaces", []string{" GZIP ; Q=0.9 "}, defaultEncodings, "gzip"},
+		{"several headers", []string{"gzip;q=0.1", "zstd"}, defaultEncodings, "zstd"},
+		{"wildcard", []string{"*"}, defaultEncodings, "br"},
+		{"wildcard with exclusion", []string{"br;q=0, *;q=0.5"}, defaultEncodings, "zstd"},
+		{"refused", []string{"gzip;q=0"}, defaultEncodings, ""},
+		{"identity only", []string{"identity"}, defaultEncodings, ""},
+		{"configured encodings", []string{"br, gzip"}, []string{"gzip"}, "gzip"},
+		{"invalid weight counts as 1", []string{"gzip;q=x, br;q=0.5"}, defaultEncodings, "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := negotiate(tt.acceptEncoding, tt.supported); got != tt.want {
+				t.Errorf("negotiate(%q) = %q, want %q", tt.acceptEncoding, got, tt.want)
+			}
+		})
+	}
+}
+
+// decode decompresses a response body in the given encoding
+func decode(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(body)
+	switch encoding {
+	case "gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatalf("invalid gzip body: %v", err)
+		}
+		r = gr
+	case "br":
+		r = brotli.NewReader(r)
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			t.Fatalf("invalid zstd body: %v", err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading %s body: %v", encoding, err)
+	}
+	return string(data)
+}
+
+func TestServe(t *testing.T) {
+	body := strings.Repeat(`{"message": "hello"}`, 100)
+	tests := []struct {
+		name   string
+		method string
+		accept string
+		cfg    models.CompressionConfig
+		status int
+		// header of the backend response, which also sets Content-Length unless given
+		header http.Header
+		// encoding is the expected Content-Encoding, empty if the body isn't compressed
+		encoding string
+		vary     bool
+	}{
+		{"gzip", http.MethodGet, "gzip", models.CompressionConfig{}, http.StatusOK,
+			http.Header{"Content-Type": {"application/json"}}, "gzip", true},
+		{"brotli preferred", http.MethodGet, "gzip, br", models.CompressionConfig{}, http.StatusOK,
+			http.Header{"Content-Type": {"application/json; charset=utf-8"}}, "br", true},
+		{"zstd", http.MethodGet, "zstd", models.CompressionConfig{}, http.StatusOK,
+			http.Header{"Content-Type": {"text/html"}}, "zstd", true},
+		{"not accepted", http.MethodGet, "", models.CompressionConfig{}, http.StatusOK,
+			http.Header{"Content-Type": {"application/json"}}, "", true},
+		{"below min size", http.MethodGet, "gzip", models.CompressionConfig{MinSize: 1 << 20}, http.StatusOK,
+			http.Header{"Content-Type": {"application/json"}}, "", false},
+		{"unknown length", http.MethodGet, "gzip", models.CompressionConfig{MinSize: 1 << 20}, http.StatusOK,
+			http.Header{"Content-Type": {"application/json"}, "Content-Length": nil}, "gzip", true},
+		{"image", http.MethodGet, "gzip", models.CompressionConfig{}, http.StatusOK,
+			http.Header{"Content-Type": {"image/png"}}, "", false},
+		{"configured mime types", http.MethodGet, "gzip", models.CompressionConfig{MimeTypes: []string{"image/*"}}, http.StatusOK,
+			http.Header{"Content-Type": {"image/png"}}, "gzip", true},
+		{"event stream", http.MethodGet, "gzip", models.CompressionConfig{MimeTypes: []string{"text/*"}}, http.StatusOK,
+			http.Header{"Content-Type": {"text/event-stream"}}, "", false},
+		{"no-transform", http.MethodGet, "gzip", models.CompressionConfig{}, http.StatusOK,
+			http.Header{"Content-Type": {"application/json"}, "Cache-Control": {"public, No-Transform"}}, "", false},
+		{"already encoded", http.MethodGet, "gzip", models.CompressionConfig{}, http.StatusOK,
+			http.Header{"Content-Type": {"application/json"}, "Content-Encoding": {"br"}}, "br", false},
+		{"partial content", http.MethodGet, "gzip", models.CompressionConfig{}, http.StatusPartialContent,
+			http.Header{"Content-Type": {"application/json"}, "Content-Range": {"bytes 0-1999/4000"}}, "", false},
+		{"head", http.MethodHead, "gzip", models.CompressionConfig{}, http.StatusOK,
+			http.Header{"Content-Type": {"application/json"}}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				w.Header().Set("ETag", `"v1"`)
+				for name, values := range tt.header {
+					w.Header()[name] = values
+				}
+				w.WriteHeader(tt.status)
+				if r.Method != http.MethodHead {
+					io.WriteString(w, body)
+				}
+			})
+			r := httptest.NewRequest(tt.method, "/", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			Serve(w, r, &tt.cfg, next)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			header := w.Header()
+			if got := header.Get("Content-Encoding"); got != tt.encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if got := header.Get("Vary") == "Accept-Encoding"; got != tt.vary {
+				t.Errorf("Vary = %q, want Accept-Encoding %v", header.Get("Vary"), tt.vary)
+			}
+			if tt.method == http.MethodHead {
+				return
+			}
+			compressed := tt.encoding != "" && tt.header.Get("Content-Encoding") == ""
+			if !compressed {
+				if w.Body.String() != body || header.Get("ETag") != `"v1"` {
+					t.Errorf("uncompressed response changed: ETag %q, %d bytes", header.Get("ETag"), w.Body.Len())
+				}
+				return
+			}
+			if got := decode(t, tt.encoding, w.Body.Bytes()); got != body {
+				t.Errorf("decoded body has %d bytes, want %d", len(got), len(body))
+			}
+			if header.Get("Content-Length") != "" || header.Get("ETag") != `W/"v1"` {
+				t.Errorf("Content-Length %q and ETag %q, want none and a weak ETag", header.Get("Content-Length"), header.Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  models.CompressionConfig
+		ok   bool
+	}{
+		{"defaults", models.CompressionConfig{}, true},
+		{"encodings", models.CompressionConfig{Encodings: []string{"zstd", "gzip"}}, true},
+		{"unsupported encoding", models.CompressionConfig{Encodings: []string{"deflate"}}, false},
+		{"invalid pattern", models.CompressionConfig{MimeTypes: []string{"text/["}}, false},
+		{"negative min size", models.CompressionConfig{MinSize: -1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(&tt.cfg); (err == nil) != tt.ok {
+				t.Errorf("Validate error = %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
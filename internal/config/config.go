@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 // Config holds the application configuration
@@ -11,22 +12,136 @@ type Config struct {
 	APIDomain   string
 	DBPath      string
 	Port        int
-	Debug       bool
+	// Debug lowers the default log level to debug
+	Debug bool
+
+	// Logging settings. LogLevels overrides LogLevel per subsystem, e.g. "proxy=debug,api=warn".
+	LogLevel  string
+	LogFormat string
+	LogLevels string
+
+	// TLS listener settings. The TLS listener is only started when both
+	// TLSCertFile and TLSKeyFile are set.
+	TLSPort     int
+	TLSCertFile string
+	TLSKeyFile  string
+	// HTTP3 additionally serves HTTP/3 over QUIC on the UDP TLS port
+	HTTP3 bool
+
+	// Response cache settings shared by all domains with caching enabled
+	CacheStore     string
+	CacheDir       string
+	CacheMaxSizeMB int
+
+	// StaticRoot is the directory static domain roots must be inside. When empty, only
+	// unrestricted admin keys may set static roots.
+	StaticRoot string
+
+	// Access log settings. Logging is disabled when AccessLogOutput is empty.
+	AccessLogOutput     string
+	AccessLogFormat     string
+	AccessLogMaxSizeMB  int
+	AccessLogMaxBackups int
+	// AccessLogDir is the directory of per-domain access log files
+	AccessLogDir string
+
+	// TrustedProxies lists the CIDRs whose X-Request-ID headers are kept
+	TrustedProxies string
+
+	// TracingEndpoint is the OTLP/HTTP collector receiving trace spans. Tracing is disabled
+	// when it is empty; the exporter itself reads the remaining OTEL_EXPORTER_OTLP_* settings.
+	TracingEndpoint string
+
+	// AdminAddr is the address of the admin listener serving the API, metrics, pprof and
+	// whoami, e.g. "127.0.0.1:9090" or "unix:/run/proxy/admin.sock". When empty, they are
+	// served on the public listener for the API domain.
+	AdminAddr string
+
+	// JWT bearer authentication settings. JWTs are accepted when JWTJWKS is set to the file
+	// path or URL of the identity provider's key set; JWTScopeMap maps values of the
+	// JWTScopesClaim claim to scopes, e.g. "proxy-admins=admin,deployers=domains:write".
+	JWTJWKS        string
+	JWTJWKSRefresh int
+	JWTIssuer      string
+	JWTAudience    string
+	JWTScopesClaim string
+	JWTScopeMap    string
+	JWTNameClaim   string
+
+	// Shutdown settings in seconds. On SIGTERM, readiness fails for ShutdownDelay before the
+	// listeners close, then in-flight requests get up to DrainTimeout to complete.
+	ShutdownDelay int
+	DrainTimeout  int
 }
 
 // Load loads configuration from environment variables
 func Load() *Config {
+	debug := getEnvAsBool("DEBUG", false)
+	defaultLogLevel := "info"
+	if debug {
+		defaultLogLevel = "debug"
+	}
+
 	cfg := &Config{
 		ProxyAPIKey: os.Getenv("PROXY_API_KEY"),
 		APIDomain:   os.Getenv("PROXY_API_DOMAIN"),
 		DBPath:      getEnv("DB_PATH", "data/proxy.db"),
 		Port:        getEnvAsInt("PORT", 80),
-		Debug:       getEnvAsBool("DEBUG", false),
+		Debug:       debug,
+		LogLevel:    getEnv("LOG_LEVEL", defaultLogLevel),
+		LogFormat:   getEnv("LOG_FORMAT", "text"),
+		LogLevels:   os.Getenv("LOG_LEVELS"),
+		TLSPort:     getEnvAsInt("TLS_PORT", 443),
+		TLSCertFile: os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:  os.Getenv("TLS_KEY_FILE"),
+		HTTP3:       getEnvAsBool("HTTP3", false),
+
+		CacheStore:     getEnv("CACHE_STORE", "memory"),
+		CacheDir:       getEnv("CACHE_DIR", "data/cache"),
+		CacheMaxSizeMB: getEnvAsInt("CACHE_MAX_SIZE_MB", 256),
+
+		StaticRoot: os.Getenv("STATIC_ROOT"),
+
+		AccessLogOutput:     os.Getenv("ACCESS_LOG_OUTPUT"),
+		AccessLogFormat:     getEnv("ACCESS_LOG_FORMAT", "json"),
+		AccessLogMaxSizeMB:  getEnvAsInt("ACCESS_LOG_MAX_SIZE_MB", 100),
+		AccessLogMaxBackups: getEnvAsInt("ACCESS_LOG_MAX_BACKUPS", 5),
+		AccessLogDir:        os.Getenv("ACCESS_LOG_DIR"),
+
+		TrustedProxies: os.Getenv("TRUSTED_PROXIES"),
+
+		TracingEndpoint: getEnv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")),
+
+		AdminAddr: os.Getenv("ADMIN_ADDR"),
+
+		JWTJWKS:        os.Getenv("JWT_JWKS"),
+		JWTJWKSRefresh: getEnvAsInt("JWT_JWKS_REFRESH", 3600),
+		JWTIssuer:      os.Getenv("JWT_ISSUER"),
+		JWTAudience:    os.Getenv("JWT_AUDIENCE"),
+		JWTScopesClaim: getEnv("JWT_SCOPES_CLAIM", "scope"),
+		JWTScopeMap:    os.Getenv("JWT_SCOPE_MAP"),
+		JWTNameClaim:   getEnv("JWT_NAME_CLAIM", "sub"),
+
+		ShutdownDelay: getEnvAsInt("SHUTDOWN_DELAY", 0),
+		DrainTimeout:  getEnvAsInt("DRAIN_TIMEOUT", 30),
 	}
 
 	return cfg
 }
 
+// TLSEnabled reports whether the TLS listener is configured
+func (c *Config) TLSEnabled() bool {
+	return c.TLSCertFile != "" && c.TLSKeyFile != ""
+}
+
+// AdminListener returns the network and address of the admin listener
+func (c *Config) AdminListener() (network, address string) {
+	if path, ok := strings.CutPrefix(c.AdminAddr, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", c.AdminAddr
+}
+
 // getEnv gets an environment variable or returns a default value
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -0,0 +1,140 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/metrics"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// apiKeyColumns lists the columns read by scanAPIKey, in scan order
+const apiKeyColumns = `id, name, hash, scopes, domains, expires_at, revoked_at, created_at`
+
+// initAPIKeysSchema creates the table of API keys. Only hashes of the keys are stored.
+func (db *DB) initAPIKeysSchema() error {
+	_, err := db.conn.Exec(`
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id TEXT PRIMARY KEY NOT NULL,
+		name TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		domains TEXT,
+		expires_at DATETIME,
+		revoked_at DATETIME,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	`)
+	return err
+}
+
+// scanAPIKey scans a row selected with apiKeyColumns
+func scanAPIKey(row rowScanner) (*models.APIKey, string, error) {
+	var k models.APIKey
+	var hash, scopes, createdAt string
+	var domains, expiresAt, revokedAt sql.NullString
+	if err := row.Scan(&k.ID, &k.Name, &hash, &scopes, &domains, &expiresAt, &revokedAt, &createdAt); err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal([]byte(scopes), &k.Scopes); err != nil {
+		return nil, "", fmt.Errorf("api key %s: invalid scopes: %w", k.ID, err)
+	}
+	if err := unmarshalJSONColumn(domains, &k.Domains); err != nil {
+		return nil, "", fmt.Errorf("api key %s: %w", k.ID, err)
+	}
+	k.ExpiresAt = parseNullTime(expiresAt)
+	k.RevokedAt = parseNullTime(revokedAt)
+	k.CreatedAt = parseTime(createdAt)
+	return &k, hash, nil
+}
+
+// parseNullTime parses an optional timestamp
+func parseNullTime(ts sql.NullString) *time.Time {
+	if !ts.Valid {
+		return nil
+	}
+	t := parseTime(ts.String)
+	return &t
+}
+
+// formatTime formats a timestamp like CURRENT_TIMESTAMP, so stored times compare correctly
+func formatTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+// CreateAPIKey stores a new API key by the hash of its secret
+func (db *DB) CreateAPIKey(id, hash string, req models.CreateAPIKeyRequest) (*models.APIKey, error) {
+	defer metrics.ObserveQuery("create_api_key", time.Now())
+	scopes, err := json.Marshal(req.Scopes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode scopes: %w", err)
+	}
+	var domains interface{}
+	if len(req.Domains) > 0 {
+		if domains, err = marshalJSONColumn(req.Domains); err != nil {
+			return nil, fmt.Errorf("failed to encode domains: %w", err)
+		}
+	}
+	var expiresAt interface{}
+	if req.ExpiresAt != nil {
+		expiresAt = formatTime(*req.ExpiresAt)
+	}
+
+	_, err = db.conn.Exec(`INSERT INTO api_keys (id, name, hash, scopes, domains, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		id, req.Name, hash, string(scopes), domains, expiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create api key: %w", err)
+	}
+	key, _, err := db.GetAPIKey(id)
+	return key, err
+}
+
+// GetAPIKey retrieves an API key and its hash by ID
+func (db *DB) GetAPIKey(id string) (*models.APIKey, string, error) {
+	defer metrics.ObserveQuery("get_api_key", time.Now())
+	key, hash, err := scanAPIKey(db.conn.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to get api key: %w", err)
+	}
+	return key, hash, nil
+}
+
+// ListAPIKeys retrieves all API keys, including revoked ones
+func (db *DB) ListAPIKeys() ([]models.APIKey, error) {
+	defer metrics.ObserveQuery("list_api_keys", time.Now())
+	rows, err := db.conn.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at, id`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query api keys: %w", err)
+	}
+	defer rows.Close()
+
+	keys := []models.APIKey{}
+	for rows.Next() {
+		key, _, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api key: %w", err)
+		}
+		keys = append(keys, *key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating api keys: %w", err)
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes an API key. Revoked keys are kept, so they can still be identified
+// in logs. It returns nil if the key doesn't exist.
+func (db *DB) RevokeAPIKey(id string) (*models.APIKey, error) {
+	defer metrics.ObserveQuery("revoke_api_key", time.Now())
+	_, err := db.conn.Exec(`UPDATE api_keys SET revoked_at = CURRENT_TIMESTAMP WHERE id = ? AND revoked_at IS NULL`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to revoke api key: %w", err)
+	}
+	key, _, err := db.GetAPIKey(id)
+	return key, err
+}
@@ -0,0 +1,155 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/metrics"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// auditTimeFormat is the UTC format of audit times. Its fixed width makes the times sort as
+// strings, which the since and until filters rely on.
+const auditTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+// auditColumns lists the columns read by scanAuditRecord, in scan order
+const auditColumns = `id, time, actor, key_id, source_ip, request_id, action, domain, before, after`
+
+// initAuditSchema creates the audit log of configuration changes
+func (db *DB) initAuditSchema() error {
+	_, err := db.conn.Exec(`
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time DATETIME NOT NULL,
+		actor TEXT NOT NULL,
+		key_id TEXT NOT NULL DEFAULT '',
+		source_ip TEXT NOT NULL,
+		request_id TEXT NOT NULL DEFAULT '',
+		action TEXT NOT NULL,
+		domain TEXT NOT NULL,
+		before TEXT,
+		after TEXT
+	);
+	CREATE INDEX IF NOT EXISTS audit_log_domain ON audit_log (domain, id);
+	CREATE INDEX IF NOT EXISTS audit_log_time ON audit_log (time);
+	`)
+	return err
+}
+
+// AuditQuery filters audit records. Zero fields don't filter.
+type AuditQuery struct {
+	Domain string
+	Actor  string
+	Since  time.Time
+	Until  time.Time
+	// DomainPatterns limits the records to domains matching any of these patterns. SQLite
+	// GLOB matches domains like path.Match, since domains contain no slashes.
+	DomainPatterns []string
+	// BeforeID only returns records older than this ID, for paging
+	BeforeID int64
+	Limit    int
+}
+
+// recordAudit appends a record of a change to the audit log
+func recordAudit(q querier, actor models.Actor, action, domain string, before, after *models.Domain) error {
+	beforeJSON, err := marshalJSONColumn(before)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry of %s: %w", domain, err)
+	}
+	afterJSON, err := marshalJSONColumn(after)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit entry of %s: %w", domain, err)
+	}
+	_, err = q.Exec(`INSERT INTO audit_log (time, actor, key_id, source_ip, request_id, action, domain, before, after)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().UTC().Format(auditTimeFormat), actor.Name, actor.KeyID, actor.SourceIP, actor.RequestID,
+		action, domain, beforeJSON, afterJSON)
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry of %s: %w", domain, err)
+	}
+	return nil
+}
+
+// recordChange records a change of a domain in the transaction that made it: a revision
+// holding the new state and an audit entry of who changed it
+func recordChange(tx *sql.Tx, actor models.Actor, action, domain string, before, after *models.Domain) error {
+	if err := recordRevision(tx, action, domain, after); err != nil {
+		return err
+	}
+	return recordAudit(tx, actor, action, domain, before, after)
+}
+
+// ListAudit returns matching audit records, newest first
+func (db *DB) ListAudit(q AuditQuery) ([]models.AuditRecord, error) {
+	defer metrics.ObserveQuery("list_audit", time.Now())
+	var where []string
+	var args []interface{}
+	if q.Domain != "" {
+		where = append(where, `domain = ?`)
+		args = append(args, q.Domain)
+	}
+	if q.Actor != "" {
+		where = append(where, `actor = ?`)
+		args = append(args, q.Actor)
+	}
+	if !q.Since.IsZero() {
+		where = append(where, `time >= ?`)
+		args = append(args, q.Since.UTC().Format(auditTimeFormat))
+	}
+	if !q.Until.IsZero() {
+		where = append(where, `time < ?`)
+		args = append(args, q.Until.UTC().Format(auditTimeFormat))
+	}
+	if q.BeforeID > 0 {
+		where = append(where, `id < ?`)
+		args = append(args, q.BeforeID)
+	}
+	if len(q.DomainPatterns) > 0 {
+		patterns := make([]string, len(q.DomainPatterns))
+		for i, pattern := range q.DomainPatterns {
+			patterns[i] = `domain GLOB ?`
+			args = append(args, pattern)
+		}
+		where = append(where, `(`+strings.Join(patterns, ` OR `)+`)`)
+	}
+
+	query := `SELECT ` + auditColumns + ` FROM audit_log`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, ` AND `)
+	}
+	query += ` ORDER BY id DESC LIMIT ?`
+	rows, err := db.conn.Query(query, append(args, q.Limit)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	records := []models.AuditRecord{}
+	for rows.Next() {
+		var r models.AuditRecord
+		var ts string
+		var before, after sql.NullString
+		if err := rows.Scan(&r.ID, &ts, &r.Actor.Name, &r.KeyID, &r.SourceIP, &r.RequestID, &r.Action, &r.Domain, &before, &after); err != nil {
+			return nil, fmt.Errorf("failed to scan audit record: %w", err)
+		}
+		r.Time = parseTime(ts)
+		r.Before = rawJSON(before)
+		r.After = rawJSON(after)
+		records = append(records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating audit log: %w", err)
+	}
+	return records, nil
+}
+
+// rawJSON returns a stored JSON column, or null when it is NULL
+func rawJSON(column sql.NullString) json.RawMessage {
+	if !column.Valid {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(column.String)
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// testActor is recorded as the author of changes made by tests
+var testActor = models.Actor{Name: "test", KeyID: "k1", SourceIP: "127.0.0.1", RequestID: "req-1"}
+
+// createDomain maps a domain to a backend, failing the test if it can't
+func createDomain(t *testing.T, db *DB, domain string) *models.Domain {
+	t.Helper()
+	d, err := db.CreateDomain(testActor, models.CreateDomainRequest{Domain: domain, IP: "10.0.0.1", Port: 8080})
+	if err != nil {
+		t.Fatalf("CreateDomain(%s): %v", domain, err)
+	}
+	return d
+}
+
+// auditDomains returns the domain field of the audit JSON values before and after a change
+func auditDomains(t *testing.T, record models.AuditRecord) (before, after string) {
+	t.Helper()
+	for _, v := range []struct {
+		raw  json.RawMessage
+		name *string
+	}{{record.Before, &before}, {record.After, &after}} {
+		var d *models.Domain
+		if err := json.Unmarshal(v.raw, &d); err != nil {
+			t.Fatalf("invalid audit JSON %s: %v", v.raw, err)
+		}
+		if d != nil {
+			*v.name = d.Domain
+		}
+	}
+	return before, after
+}
+
+func TestChangesAreAudited(t *testing.T) {
+	db := newTestDB(t)
+	createDomain(t, db, "a.example.com")
+	if _, err := db.UpdateDomain(testActor, "a.example.com", models.UpdateDomainRequest{IP: "10.0.0.2", Port: 8080}, 0); err != nil {
+		t.Fatalf("UpdateDomain: %v", err)
+	}
+	renamed := models.Domain{Domain: "b.example.com", IP: "10.0.0.2", Port: 8080, Protocol: "http"}
+	if _, err := db.ReplaceDomain(testActor, "a.example.com", &renamed, 0); err != nil {
+		t.Fatalf("ReplaceDomain: %v", err)
+	}
+	if err := db.DeleteDomain(testActor, "b.example.com", 0); err != nil {
+		t.Fatalf("DeleteDomain: %v", err)
+	}
+
+	records, err := db.ListAudit(AuditQuery{Limit: 10})
+	if err != nil {
+		t.Fatalf("ListAudit: %v", err)
+	}
+	want := []struct {
+		action, domain, before, after string
+	}{
+		{models.AuditDelete, "b.example.com", "b.example.com", ""},
+		{models.AuditRename, "b.example.com", "", "b.example.com"},
+		{models.AuditRename, "a.example.com", "a.example.com", ""},
+		{models.AuditUpdate, "a.example.com", "a.example.com", "a.example.com"},
+		{models.AuditCreate, "a.example.com", "", "a.example.com"},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("got %d audit records, want %d", len(records), len(want))
+	}
+	for i, w := range want {
+		r := records[i]
+		before, after := auditDomains(t, r)
+		if r.Action != w.action || r.Domain != w.domain || before != w.before || after != w.after {
+			t.Errorf("record %d = %s %s (%q -> %q), want %s %s (%q -> %q)", i, r.Action, r.Domain, before, after,
+				w.action, w.domain, w.before, w.after)
+		}
+		if r.Actor != testActor {
+			t.Errorf("record %d actor = %+v, want %+v", i, r.Actor, testActor)
+		}
+	}
+}
+
+func TestAuditFailureRollsBackChange(t *testing.T) {
+	db := newTestDB(t)
+	createDomain(t, db, "a.example.com")
+	if _, err := db.conn.Exec(`DROP TABLE audit_log`); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.CreateDomain(testActor, models.CreateDomainRequest{Domain: "b.example.com", IP: "10.0.0.1", Port: 80}); err == nil {
+		t.Error("CreateDomain succeeded without an audit log")
+	}
+	if err := db.DeleteDomain(testActor, "a.example.com", 0); err == nil {
+		t.Error("DeleteDomain succeeded without an audit log")
+	}
+
+	for domain, exists := range map[string]bool{"a.example.com": true, "b.example.com": false} {
+		d, err := db.GetDomain(domain)
+		if err != nil {
+			t.Fatalf("GetDomain: %v", err)
+		}
+		if (d != nil) != exists {
+			t.Errorf("%s exists = %v, want %v after failed audit", domain, d != nil, exists)
+		}
+	}
+	revisions, err := db.ListRevisions("b.example.com")
+	if err != nil {
+		t.Fatalf("ListRevisions: %v", err)
+	}
+	if len(revisions) != 0 {
+		t.Errorf("%d revisions of b.example.com kept after failed audit", len(revisions))
+	}
+}
+
+func TestListAuditTimeRange(t *testing.T) {
+	db := newTestDB(t)
+	at := func(ts string) time.Time {
+		parsed, err := time.Parse(time.RFC3339Nano, ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	// RFC 3339 drops trailing zeros of fractional seconds, so these times don't sort as strings
+	times := []string{"2025-01-15T10:00:00Z", "2025-01-15T10:00:00.5Z", "2025-01-15T10:00:00.25Z", "2025-01-15T10:00:01Z"}
+	for _, ts := range times {
+		_, err := db.conn.Exec(`INSERT INTO audit_log (time, actor, source_ip, action, domain) VALUES (?, 'test', '', 'create', ?)`,
+			at(ts).Format(auditTimeFormat), ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		since, until string
+		want         []string
+	}{
+		{"2025-01-15T10:00:00Z", "2025-01-15T10:00:01Z", []string{times[2], times[1], times[0]}},
+		{"2025-01-15T10:00:00.3Z", "2025-01-15T10:00:01Z", []string{times[1]}},
+		{"2025-01-15T10:00:00.25Z", "2025-01-15T10:00:00.5Z", []string{times[2]}},
+		{"2025-01-15T10:00:00.000001Z", "2025-01-15T11:00:00Z", []string{times[3], times[2], times[1]}},
+	}
+	for _, tt := range tests {
+		records, err := db.ListAudit(AuditQuery{Since: at(tt.since), Until: at(tt.until), Limit: 10})
+		if err != nil {
+			t.Fatalf("ListAudit: %v", err)
+		}
+		var got []string
+		for _, r := range records {
+			got = append(got, r.Domain)
+			if !r.Time.Equal(at(r.Domain)) {
+				t.Errorf("record time %v, want %s", r.Time, r.Domain)
+			}
+		}
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+			t.Errorf("since %s until %s: got %q, want %q", tt.since, tt.until, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"cmp"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/metrics"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// errBatchFailed rolls back an atomic batch after one of its operations failed
+var errBatchFailed = errors.New("batch failed")
+
+// BatchCheck is called for every operation of a batch with the stored mapping and the
+// one it would be changed to, nil when it doesn't or won't exist. An error fails the
+// operation before anything is written.
+type BatchCheck func(op models.BatchOperation, before, after *models.Domain) error
+
+// BatchOutcome is the result of one operation of a batch: the change it made, with Before
+// and After of the same configuration if the domain already matched, or the error that
+// made it fail
+type BatchOutcome struct {
+	Change *models.DomainChange
+	Err    error
+}
+
+// ApplyBatch applies domain operations in order in a single transaction. In atomic mode
+// the first failing operation rolls back the whole batch and the operations after it
+// aren't attempted; otherwise each failing operation is rolled back on its own and the
+// others are kept. The returned outcomes are those of the attempted operations. The
+// snapshot taken before the batch is only kept, and returned, if the batch changed a domain.
+func (db *DB) ApplyBatch(actor models.Actor, ops []models.BatchOperation, atomic bool, check BatchCheck) ([]BatchOutcome, *models.Snapshot, error) {
+	defer metrics.ObserveQuery("apply_batch", time.Now())
+	outcomes := make([]BatchOutcome, 0, len(ops))
+	var snapshot *models.Snapshot
+	err := db.withTx(func(tx *sql.Tx) error {
+		// A bad batch can be undone by restoring the routing table from before it
+		var err error
+		if snapshot, err = createSnapshot(tx, "before batch", true); err != nil {
+			return err
+		}
+
+		changed := false
+		for _, op := range ops {
+			if atomic {
+				change, err := applyOperation(tx, actor, op, check)
+				outcomes = append(outcomes, BatchOutcome{Change: change, Err: err})
+				if err != nil {
+					return errBatchFailed
+				}
+				changed = changed || !SameConfig(change.Before, change.After)
+				continue
+			}
+
+			// Savepoints undo a failed operation without losing the ones before it
+			if _, err := tx.Exec(`SAVEPOINT batch_operation`); err != nil {
+				return fmt.Errorf("failed to create savepoint: %w", err)
+			}
+			change, err := applyOperation(tx, actor, op, check)
+			outcomes = append(outcomes, BatchOutcome{Change: change, Err: err})
+			release := `RELEASE batch_operation`
+			if err != nil {
+				release = `ROLLBACK TO batch_operation; RELEASE batch_operation`
+			} else {
+				changed = changed || !SameConfig(change.Before, change.After)
+			}
+			if _, err := tx.Exec(release); err != nil {
+				return fmt.Errorf("failed to release savepoint: %w", err)
+			}
+		}
+		if !changed {
+			return errNoChanges
+		}
+		return nil
+	})
+	if errors.Is(err, errBatchFailed) || errors.Is(err, errNoChanges) {
+		return outcomes, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return outcomes, snapshot, nil
+}
+
+// applyOperation applies one operation of a batch, recording the change if it changed
+// the domain
+func applyOperation(tx *sql.Tx, actor models.Actor, op models.BatchOperation, check BatchCheck) (*models.DomainChange, error) {
+	existing, err := getDomain(tx, op.Domain)
+	if err != nil {
+		return nil, err
+	}
+	if op.Version != 0 && (existing == nil || existing.Version != op.Version) {
+		return nil, ErrVersionMismatch
+	}
+
+	config := &models.Domain{
+		Domain:        op.Domain,
+		IP:            op.IP,
+		Port:          op.Port,
+		Protocol:      cmp.Or(op.Protocol, "http"),
+		Target:        op.Target,
+		DomainOptions: normalizeOptions(op.DomainOptions),
+	}
+	switch op.Op {
+	case models.BatchCreate:
+		if existing != nil {
+			return nil, ErrDomainExists
+		}
+	case models.BatchUpdate:
+		if existing == nil {
+			return nil, ErrDomainNotFound
+		}
+		config.Protocol = cmp.Or(op.Protocol, existing.Protocol)
+		config.DomainOptions = mergeOptions(existing.DomainOptions, op.DomainOptions)
+	case models.BatchUpsert:
+	case models.BatchDelete:
+		if existing == nil {
+			return nil, ErrDomainNotFound
+		}
+		config = nil
+	default:
+		return nil, fmt.Errorf("unsupported operation %q", op.Op)
+	}
+	// Responses leave client keys out, so settings sent back with the same certificate keep the stored key
+	if existing != nil && config != nil {
+		config.UpstreamTLS.KeepClientKey(existing.UpstreamTLS)
+	}
+
+	if err := check(op, existing, config); err != nil {
+		return nil, err
+	}
+	action := models.AuditUpdate
+	switch {
+	case existing == nil:
+		action = models.AuditCreate
+	case config == nil:
+		action = models.AuditDelete
+	}
+	change, err := applyDomain(tx, actor, action, op.Domain, config)
+	if err != nil {
+		return nil, err
+	}
+	if change == nil {
+		change = &models.DomainChange{Domain: op.Domain, Before: existing, After: existing}
+	}
+	return change, nil
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// allowAll is a BatchCheck allowing every operation
+func allowAll(models.BatchOperation, *models.Domain, *models.Domain) error { return nil }
+
+func TestApplyBatch(t *testing.T) {
+	op := func(name, domain string) models.BatchOperation {
+		return models.BatchOperation{Op: name, CreateDomainRequest: models.CreateDomainRequest{Domain: domain, IP: "10.0.0.1", Port: 80}}
+	}
+	upsertA := op(models.BatchUpsert, "a.example.com")
+	createB := op(models.BatchCreate, "b.example.com")
+	deleteC := op(models.BatchDelete, "c.example.com")
+	tests := []struct {
+		name   string
+		ops    []models.BatchOperation
+		atomic bool
+		// errs are the expected errors of the attempted operations
+		errs     []error
+		domains  []string
+		snapshot bool
+	}{
+		{"atomic", []models.BatchOperation{upsertA, createB}, true, []error{nil, nil},
+			[]string{"a.example.com", "b.example.com"}, true},
+		{"atomic failure rolls back", []models.BatchOperation{createB, deleteC, upsertA}, true,
+			[]error{nil, ErrDomainNotFound}, []string{"a.example.com"}, false},
+		{"best effort keeps successes", []models.BatchOperation{deleteC, createB}, false,
+			[]error{ErrDomainNotFound, nil}, []string{"a.example.com", "b.example.com"}, true},
+		{"best effort without changes", []models.BatchOperation{upsertA, deleteC}, false,
+			[]error{nil, ErrDomainNotFound}, []string{"a.example.com"}, false},
+		{"atomic without changes", []models.BatchOperation{upsertA}, true, []error{nil},
+			[]string{"a.example.com"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			if _, err := db.CreateDomain(testActor, models.CreateDomainRequest{Domain: "a.example.com", IP: "10.0.0.1", Port: 80}); err != nil {
+				t.Fatalf("CreateDomain: %v", err)
+			}
+
+			outcomes, snapshot, err := db.ApplyBatch(testActor, tt.ops, tt.atomic, allowAll)
+			if err != nil {
+				t.Fatalf("ApplyBatch: %v", err)
+			}
+			if len(outcomes) != len(tt.errs) {
+				t.Fatalf("%d operations attempted, want %d", len(outcomes), len(tt.errs))
+			}
+			for i, outcome := range outcomes {
+				if !errors.Is(outcome.Err, tt.errs[i]) {
+					t.Errorf("operation %d error = %v, want %v", i, outcome.Err, tt.errs[i])
+				}
+			}
+
+			domains, err := db.GetAllDomains()
+			if err != nil {
+				t.Fatalf("GetAllDomains: %v", err)
+			}
+			var names []string
+			for _, d := range domains {
+				names = append(names, d.Domain)
+			}
+			if !slices.Equal(names, tt.domains) {
+				t.Errorf("domains after batch = %q, want %q", names, tt.domains)
+			}
+			if kept := snapshotCount(t, db) == 1; (snapshot != nil) != tt.snapshot || kept != tt.snapshot {
+				t.Errorf("snapshot returned = %v, stored = %v, want %v", snapshot != nil, kept, tt.snapshot)
+			}
+		})
+	}
+}
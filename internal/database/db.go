@@ -2,21 +2,42 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strings"
 	"time"
 
+	"github.com/itsnoxius/simple-proxy/internal/logging"
+	"github.com/itsnoxius/simple-proxy/internal/metrics"
 	"github.com/itsnoxius/simple-proxy/pkg/models"
 	_ "modernc.org/sqlite"
 )
 
+// ErrVersionMismatch is returned by conditional writes when the stored domain has a
+// different version than the one expected
+var ErrVersionMismatch = errors.New("version mismatch")
+
+// ErrDomainNotFound is returned when changing a domain that isn't mapped
+var ErrDomainNotFound = errors.New("domain not found")
+
+// ErrDomainExists is returned when renaming a domain to one that is already mapped
+var ErrDomainExists = errors.New("domain already exists")
+
 // DB wraps the database connection and operations
 type DB struct {
 	conn *sql.DB
 }
 
+// logger returns the database subsystem logger
+func logger() *slog.Logger {
+	return logging.Logger(logging.Database)
+}
+
 // New creates a new database connection and initializes the schema
 func New(dbPath string) (*DB, error) {
-	conn, err := sql.Open("sqlite", dbPath+"?_foreign_keys=1")
+	// Writers wait for each other's transactions instead of failing with SQLITE_BUSY
+	conn, err := sql.Open("sqlite", dbPath+"?_foreign_keys=1&_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
@@ -44,8 +65,74 @@ func (db *DB) initSchema() error {
 	);
 	`
 
-	_, err := db.conn.Exec(query)
-	return err
+	if _, err := db.conn.Exec(query); err != nil {
+		return err
+	}
+	if err := db.initAPIKeysSchema(); err != nil {
+		return err
+	}
+	if err := db.initAuditSchema(); err != nil {
+		return err
+	}
+	if err := db.migrate(); err != nil {
+		return err
+	}
+	return db.initRevisionsSchema()
+}
+
+// migrate adds columns introduced after the initial schema to existing databases
+func (db *DB) migrate() error {
+	if err := db.addColumnIfMissing("domains", "target", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return err
+	}
+	if err := db.addColumnIfMissing("domains", "version", "INTEGER NOT NULL DEFAULT 1"); err != nil {
+		return err
+	}
+
+	// Domain option columns hold JSON encoded settings and are NULL when unset
+	for _, column := range optionColumnNames() {
+		if err := db.addColumnIfMissing("domains", column, "TEXT"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumnIfMissing adds a column to a table unless it already exists
+func (db *DB) addColumnIfMissing(table, column, definition string) error {
+	rows, err := db.conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return fmt.Errorf("failed to read table info for %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return fmt.Errorf("failed to scan table info for %s: %w", table, err)
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error iterating table info for %s: %w", table, err)
+	}
+	rows.Close()
+
+	_, err = db.conn.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		return fmt.Errorf("failed to add column %s.%s: %w", table, column, err)
+	}
+	logger().Info("Added database column", "table", table, "column", column)
+	return nil
 }
 
 // Close closes the database connection
@@ -53,46 +140,103 @@ func (db *DB) Close() error {
 	return db.conn.Close()
 }
 
-// GetDomain retrieves a domain mapping by domain name
-func (db *DB) GetDomain(domain string) (*models.Domain, error) {
-	query := `SELECT domain, ip, port, protocol, created_at, updated_at FROM domains WHERE domain = ?`
-	row := db.conn.QueryRow(query, domain)
+// domainColumns lists the columns read by scanDomain, in scan order
+var domainColumns = `domain, ip, port, protocol, target, ` + strings.Join(optionColumnNames(), ", ") + `, version, created_at, updated_at`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
 
+// withTx runs fn in a transaction, which is committed if fn succeeds
+func (db *DB) withTx(fn func(tx *sql.Tx) error) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// scanDomain scans a row selected with domainColumns into a domain model
+func scanDomain(row rowScanner) (*models.Domain, error) {
 	var d models.Domain
+	options := make([]sql.NullString, len(optionColumnNames()))
 	var createdAt, updatedAt string
 
-	err := row.Scan(&d.Domain, &d.IP, &d.Port, &d.Protocol, &createdAt, &updatedAt)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, fmt.Errorf("failed to get domain: %w", err)
+	dest := []interface{}{&d.Domain, &d.IP, &d.Port, &d.Protocol, &d.Target}
+	for i := range options {
+		dest = append(dest, &options[i])
 	}
+	dest = append(dest, &d.Version, &createdAt, &updatedAt)
 
-	// Parse timestamps - SQLite can return various formats
-	parseTime := func(ts string) time.Time {
-		formats := []string{
-			"2006-01-02 15:04:05",
-			"2006-01-02T15:04:05Z",
-			"2006-01-02T15:04:05",
-			time.RFC3339,
-		}
-		for _, format := range formats {
-			if t, err := time.Parse(format, ts); err == nil {
-				return t
-			}
-		}
-		return time.Time{}
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	if err := scanOptions(options, &d.DomainOptions); err != nil {
+		return nil, fmt.Errorf("domain %s: %w", d.Domain, err)
 	}
+
 	d.CreatedAt = parseTime(createdAt)
 	d.UpdatedAt = parseTime(updatedAt)
 
 	return &d, nil
 }
 
+// parseTime parses timestamps - SQLite can return various formats
+func parseTime(ts string) time.Time {
+	formats := []string{
+		"2006-01-02 15:04:05",
+		"2006-01-02T15:04:05Z",
+		"2006-01-02T15:04:05",
+		time.RFC3339,
+	}
+	for _, format := range formats {
+		if t, err := time.Parse(format, ts); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// GetDomain retrieves a domain mapping by domain name
+func (db *DB) GetDomain(domain string) (*models.Domain, error) {
+	defer metrics.ObserveQuery("get_domain", time.Now())
+	logger().Debug("Querying domain", "domain", domain)
+	return getDomain(db.conn, domain)
+}
+
+// getDomain retrieves a domain mapping, or nil if it doesn't exist
+func getDomain(q querier, domain string) (*models.Domain, error) {
+	d, err := scanDomain(q.QueryRow(`SELECT `+domainColumns+` FROM domains WHERE domain = ?`, domain))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get domain: %w", err)
+	}
+
+	return d, nil
+}
+
 // GetAllDomains retrieves all domain mappings
 func (db *DB) GetAllDomains() ([]models.Domain, error) {
-	query := `SELECT domain, ip, port, protocol, created_at, updated_at FROM domains ORDER BY domain`
+	defer metrics.ObserveQuery("list_domains", time.Now())
+	query := `SELECT ` + domainColumns + ` FROM domains ORDER BY domain`
 	rows, err := db.conn.Query(query)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query domains: %w", err)
@@ -101,18 +245,12 @@ func (db *DB) GetAllDomains() ([]models.Domain, error) {
 
 	var domains []models.Domain
 	for rows.Next() {
-		var d models.Domain
-		var createdAt, updatedAt string
-
-		err := rows.Scan(&d.Domain, &d.IP, &d.Port, &d.Protocol, &createdAt, &updatedAt)
+		d, err := scanDomain(rows)
 		if err != nil {
 			return nil, fmt.Errorf("failed to scan domain: %w", err)
 		}
 
-		d.CreatedAt, _ = time.Parse("2006-01-02 15:04:05", createdAt)
-		d.UpdatedAt, _ = time.Parse("2006-01-02 15:04:05", updatedAt)
-
-		domains = append(domains, d)
+		domains = append(domains, *d)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -122,126 +260,233 @@ func (db *DB) GetAllDomains() ([]models.Domain, error) {
 	return domains, nil
 }
 
-// CreateDomain creates a new domain mapping
-func (db *DB) CreateDomain(req models.CreateDomainRequest) (*models.Domain, error) {
+// CountDomains returns the number of domain mappings
+func (db *DB) CountDomains() (int, error) {
+	defer metrics.ObserveQuery("count_domains", time.Now())
+	var count int
+	if err := db.conn.QueryRow(`SELECT COUNT(*) FROM domains`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count domains: %w", err)
+	}
+	return count, nil
+}
+
+// insertDomainQuery inserts a domain with all of its option columns
+var insertDomainQuery = `INSERT INTO domains (domain, ip, port, protocol, target, ` + strings.Join(optionColumnNames(), ", ") +
+	`) VALUES (?, ?, ?, ?, ?` + strings.Repeat(", ?", len(optionColumnNames())) + `)`
+
+// insertDomainArgs returns the arguments for insertDomainQuery
+func insertDomainArgs(req models.CreateDomainRequest) ([]interface{}, error) {
 	protocol := req.Protocol
 	if protocol == "" {
 		protocol = "http" // Default to http if not specified
 	}
-	query := `INSERT INTO domains (domain, ip, port, protocol) VALUES (?, ?, ?, ?)`
-	_, err := db.conn.Exec(query, req.Domain, req.IP, req.Port, protocol)
+	options, err := optionValues(normalizeOptions(req.DomainOptions))
+	if err != nil {
+		return nil, err
+	}
+	return append([]interface{}{req.Domain, req.IP, req.Port, protocol, req.Target}, options...), nil
+}
+
+// CreateDomain creates a new domain mapping, recording actor as the one who made it.
+// Like all changes of domains, it is recorded in the audit log in the same transaction.
+func (db *DB) CreateDomain(actor models.Actor, req models.CreateDomainRequest) (*models.Domain, error) {
+	defer metrics.ObserveQuery("create_domain", time.Now())
+	args, err := insertDomainArgs(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create domain: %w", err)
 	}
 
-	// Fetch the created domain
-	return db.GetDomain(req.Domain)
+	var created *models.Domain
+	err = db.withTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(insertDomainQuery, args...); err != nil {
+			return fmt.Errorf("failed to create domain: %w", err)
+		}
+		// Fetch the created domain
+		if created, err = getDomain(tx, req.Domain); err != nil {
+			return err
+		}
+		return recordChange(tx, actor, models.AuditCreate, req.Domain, nil, created)
+	})
+	return created, err
 }
 
-// UpdateDomain updates an existing domain mapping
-func (db *DB) UpdateDomain(domain string, req models.UpdateDomainRequest) (*models.Domain, error) {
-	protocol := req.Protocol
-	if protocol == "" {
-		// If protocol not provided, keep existing value by selecting it first
-		existing, err := db.GetDomain(domain)
+// UpdateDomain updates an existing domain mapping. It returns nil if the domain doesn't exist.
+// A non-zero version makes the update conditional; ErrVersionMismatch is returned if the
+// stored version differs.
+func (db *DB) UpdateDomain(actor models.Actor, domain string, req models.UpdateDomainRequest, version int64) (*models.Domain, error) {
+	defer metrics.ObserveQuery("update_domain", time.Now())
+	var updated *models.Domain
+	err := db.withTx(func(tx *sql.Tx) error {
+		// Optional fields that are not provided keep their existing values, so select them first
+		existing, err := getDomain(tx, domain)
 		if err != nil {
-			return nil, fmt.Errorf("failed to get existing domain: %w", err)
+			return fmt.Errorf("failed to get existing domain: %w", err)
 		}
 		if existing == nil {
-			return nil, nil
+			return nil
+		}
+		if version != 0 && existing.Version != version {
+			return ErrVersionMismatch
 		}
-		protocol = existing.Protocol
-	}
-	query := `UPDATE domains SET ip = ?, port = ?, protocol = ?, updated_at = CURRENT_TIMESTAMP WHERE domain = ?`
-	result, err := db.conn.Exec(query, req.IP, req.Port, protocol, domain)
-	if err != nil {
-		return nil, fmt.Errorf("failed to update domain: %w", err)
-	}
-
-	rowsAffected, err := result.RowsAffected()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get rows affected: %w", err)
-	}
 
-	if rowsAffected == 0 {
-		return nil, nil
-	}
+		protocol := req.Protocol
+		if protocol == "" {
+			protocol = existing.Protocol
+		}
+		options, err := optionValues(mergeOptions(existing.DomainOptions, req.DomainOptions))
+		if err != nil {
+			return fmt.Errorf("failed to update domain: %w", err)
+		}
 
-	// Fetch the updated domain
-	return db.GetDomain(domain)
-}
+		set := `ip = ?, port = ?, protocol = ?, target = ?`
+		for _, column := range optionColumnNames() {
+			set += `, ` + column + ` = ?`
+		}
+		query := `UPDATE domains SET ` + set + `, version = version + 1, updated_at = CURRENT_TIMESTAMP WHERE domain = ?`
+		args := append([]interface{}{req.IP, req.Port, protocol, req.Target}, options...)
+		if _, err := tx.Exec(query, append(args, domain)...); err != nil {
+			return fmt.Errorf("failed to update domain: %w", err)
+		}
 
-// DeleteDomain deletes a domain mapping
-func (db *DB) DeleteDomain(domain string) error {
-	query := `DELETE FROM domains WHERE domain = ?`
-	result, err := db.conn.Exec(query, domain)
+		// Fetch the updated domain
+		if updated, err = getDomain(tx, domain); err != nil {
+			return err
+		}
+		return recordChange(tx, actor, models.AuditUpdate, domain, existing, updated)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to delete domain: %w", err)
+		return nil, err
 	}
+	return updated, nil
+}
+
+// ReplaceDomain replaces all settings of a domain mapping with those of d, renaming it
+// when d has a different domain name. The old name's revisions end with its deletion and
+// the new name starts with the replaced mapping. It returns nil if the domain doesn't
+// exist, and a change with equal Before and After if nothing changed. A non-zero version
+// makes the replacement conditional like in UpdateDomain.
+func (db *DB) ReplaceDomain(actor models.Actor, domain string, d *models.Domain, version int64) (*models.DomainChange, error) {
+	defer metrics.ObserveQuery("replace_domain", time.Now())
+	var change *models.DomainChange
+	err := db.withTx(func(tx *sql.Tx) error {
+		existing, err := getDomain(tx, domain)
+		if err != nil {
+			return fmt.Errorf("failed to get existing domain: %w", err)
+		}
+		if existing == nil {
+			return nil
+		}
+		if version != 0 && existing.Version != version {
+			return ErrVersionMismatch
+		}
+
+		if d.Domain == domain {
+			if change, err = applyDomain(tx, actor, models.AuditUpdate, domain, d); err != nil {
+				return err
+			}
+			if change == nil {
+				change = &models.DomainChange{Domain: domain, Before: existing, After: existing}
+			}
+			return nil
+		}
 
-	rowsAffected, err := result.RowsAffected()
+		taken, err := getDomain(tx, d.Domain)
+		if err != nil {
+			return fmt.Errorf("failed to get domain %s: %w", d.Domain, err)
+		}
+		if taken != nil {
+			return ErrDomainExists
+		}
+		if _, err := applyDomain(tx, actor, models.AuditRename, domain, nil); err != nil {
+			return err
+		}
+		renamed, err := applyDomain(tx, actor, models.AuditRename, d.Domain, d)
+		if err != nil {
+			return err
+		}
+		change = &models.DomainChange{Domain: domain, Before: existing, After: renamed.After}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get rows affected: %w", err)
+		return nil, err
 	}
+	return change, nil
+}
 
-	if rowsAffected == 0 {
-		return fmt.Errorf("domain not found")
-	}
+// DeleteDomain deletes a domain mapping. A non-zero version makes the deletion conditional
+// like in UpdateDomain.
+func (db *DB) DeleteDomain(actor models.Actor, domain string, version int64) error {
+	defer metrics.ObserveQuery("delete_domain", time.Now())
+	return db.withTx(func(tx *sql.Tx) error {
+		existing, err := getDomain(tx, domain)
+		if err != nil {
+			return fmt.Errorf("failed to get existing domain: %w", err)
+		}
+		if existing == nil {
+			return ErrDomainNotFound
+		}
+		if version != 0 && existing.Version != version {
+			return ErrVersionMismatch
+		}
 
-	return nil
+		if _, err := tx.Exec(`DELETE FROM domains WHERE domain = ?`, domain); err != nil {
+			return fmt.Errorf("failed to delete domain: %w", err)
+		}
+		return recordChange(tx, actor, models.AuditDelete, domain, existing, nil)
+	})
 }
 
 // BulkCreateDomains creates multiple domain mappings in a single transaction
-func (db *DB) BulkCreateDomains(domains []models.CreateDomainRequest) ([]models.Domain, error) {
+func (db *DB) BulkCreateDomains(actor models.Actor, domains []models.CreateDomainRequest) ([]models.Domain, *models.Snapshot, error) {
+	defer metrics.ObserveQuery("bulk_create_domains", time.Now())
 	if len(domains) == 0 {
-		return []models.Domain{}, nil
-	}
-
-	// Start a transaction
-	tx, err := db.conn.Begin()
-	if err != nil {
-		return nil, fmt.Errorf("failed to begin transaction: %w", err)
-	}
-	defer tx.Rollback()
-
-	query := `INSERT INTO domains (domain, ip, port, protocol) VALUES (?, ?, ?, ?)`
-	stmt, err := tx.Prepare(query)
-	if err != nil {
-		return nil, fmt.Errorf("failed to prepare statement: %w", err)
+		return []models.Domain{}, nil, nil
 	}
-	defer stmt.Close()
 
 	var createdDomains []models.Domain
-	var domainNames []string
-
-	// Insert all domains
-	for _, req := range domains {
-		protocol := req.Protocol
-		if protocol == "" {
-			protocol = "http" // Default to http if not specified
+	var snapshot *models.Snapshot
+	err := db.withTx(func(tx *sql.Tx) error {
+		// A bad import can be undone by restoring the routing table from before it
+		var err error
+		if snapshot, err = createSnapshot(tx, "before bulk create", true); err != nil {
+			return err
 		}
-		_, err := stmt.Exec(req.Domain, req.IP, req.Port, protocol)
+
+		stmt, err := tx.Prepare(insertDomainQuery)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create domain %s: %w", req.Domain, err)
+			return fmt.Errorf("failed to prepare statement: %w", err)
 		}
-		domainNames = append(domainNames, req.Domain)
-	}
-
-	// Commit the transaction
-	if err := tx.Commit(); err != nil {
-		return nil, fmt.Errorf("failed to commit transaction: %w", err)
-	}
+		defer stmt.Close()
 
-	// Fetch all created domains
-	for _, domainName := range domainNames {
-		domain, err := db.GetDomain(domainName)
-		if err != nil {
-			return nil, fmt.Errorf("failed to fetch created domain %s: %w", domainName, err)
+		// Insert all domains
+		for _, req := range domains {
+			args, err := insertDomainArgs(req)
+			if err != nil {
+				return fmt.Errorf("failed to create domain %s: %w", req.Domain, err)
+			}
+			if _, err = stmt.Exec(args...); err != nil {
+				return fmt.Errorf("failed to create domain %s: %w", req.Domain, err)
+			}
 		}
-		if domain != nil {
+
+		// Fetch all created domains
+		for _, req := range domains {
+			domain, err := getDomain(tx, req.Domain)
+			if err != nil {
+				return fmt.Errorf("failed to fetch created domain %s: %w", req.Domain, err)
+			}
+			if domain == nil {
+				continue
+			}
+			if err := recordChange(tx, actor, models.AuditBulkCreate, domain.Domain, nil, domain); err != nil {
+				return err
+			}
 			createdDomains = append(createdDomains, *domain)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
 	}
-
-	return createdDomains, nil
+	return createdDomains, snapshot, nil
 }
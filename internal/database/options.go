@@ -0,0 +1,120 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// Each field of models.DomainOptions is stored as a JSON encoded TEXT column named
+// after the field's JSON key, so adding a new option only requires adding the field.
+
+// optionColumnNames returns the column names of the domain option fields, in field order
+func optionColumnNames() []string {
+	t := reflect.TypeOf(models.DomainOptions{})
+	names := make([]string, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		names[i] = strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+	}
+	return names
+}
+
+// optionValues encodes each domain option for storage, in field order
+func optionValues(o models.DomainOptions) ([]interface{}, error) {
+	v := reflect.ValueOf(o)
+	names := optionColumnNames()
+	values := make([]interface{}, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i).Interface()
+		if cfg, ok := field.(*models.UpstreamTLSConfig); ok {
+			field = (*storedUpstreamTLS)(cfg)
+		}
+		value, err := marshalJSONColumn(field)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s: %w", names[i], err)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// scanOptions decodes option columns scanned in field order into o
+func scanOptions(columns []sql.NullString, o *models.DomainOptions) error {
+	v := reflect.ValueOf(o).Elem()
+	names := optionColumnNames()
+	for i := 0; i < v.NumField(); i++ {
+		if err := unmarshalJSONColumn(columns[i], v.Field(i).Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid %s: %w", names[i], err)
+		}
+	}
+	return nil
+}
+
+// mergeOptions applies the options set in update on top of existing. Options omitted
+// from the update keep their existing value, and options set to an empty object are cleared.
+func mergeOptions(existing, update models.DomainOptions) models.DomainOptions {
+	merged := existing
+	mv := reflect.ValueOf(&merged).Elem()
+	uv := reflect.ValueOf(update)
+	for i := 0; i < uv.NumField(); i++ {
+		field := uv.Field(i)
+		if field.IsNil() {
+			continue
+		}
+		if field.Elem().IsZero() {
+			mv.Field(i).Set(reflect.Zero(field.Type()))
+		} else {
+			mv.Field(i).Set(field)
+		}
+	}
+	return merged
+}
+
+// normalizeOptions clears options that were provided as empty objects
+func normalizeOptions(o models.DomainOptions) models.DomainOptions {
+	return mergeOptions(models.DomainOptions{}, o)
+}
+
+// marshalJSONColumn encodes an optional config struct for storage in a TEXT column.
+// Nil values are stored as NULL.
+func marshalJSONColumn(v interface{}) (interface{}, error) {
+	if v == nil || reflect.ValueOf(v).IsNil() {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// storedUpstreamTLS is the storage encoding of upstream TLS settings. Unlike the JSON
+// encoding of models.UpstreamTLSConfig, which API responses use, it includes the client key.
+type storedUpstreamTLS models.UpstreamTLSConfig
+
+// storedDomain is the storage encoding of a domain in revisions and snapshots, which keeps
+// the client key of its upstream TLS settings so that rollbacks and restores bring it back
+type storedDomain struct {
+	models.Domain
+	UpstreamTLS *storedUpstreamTLS `json:"upstream_tls,omitempty"`
+}
+
+// storeDomain returns the storage encoding of a domain, or nil for a nil domain
+func storeDomain(d *models.Domain) *storedDomain {
+	if d == nil {
+		return nil
+	}
+	return &storedDomain{Domain: *d, UpstreamTLS: (*storedUpstreamTLS)(d.UpstreamTLS)}
+}
+
+// unmarshalJSONColumn decodes a TEXT column written by marshalJSONColumn
+func unmarshalJSONColumn(column sql.NullString, v interface{}) error {
+	if !column.Valid || column.String == "" {
+		return nil
+	}
+	return json.Unmarshal([]byte(column.String), v)
+}
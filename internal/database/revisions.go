@@ -0,0 +1,365 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/metrics"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// maxAutomaticSnapshots is the number of snapshots taken automatically before bulk changes
+// that are kept; snapshots taken through the API are never pruned
+const maxAutomaticSnapshots = 20
+
+// upsertDomainQuery inserts a domain or replaces all columns of an existing one, keeping
+// its created_at and incrementing its version
+var upsertDomainQuery = insertDomainQuery + ` ON CONFLICT(domain) DO UPDATE SET ip = excluded.ip, port = excluded.port, ` +
+	`protocol = excluded.protocol, target = excluded.target, ` + upsertOptionColumns() +
+	`version = version + 1, updated_at = CURRENT_TIMESTAMP`
+
+func upsertOptionColumns() string {
+	var set strings.Builder
+	for _, column := range optionColumnNames() {
+		set.WriteString(column + ` = excluded.` + column + `, `)
+	}
+	return set.String()
+}
+
+// initRevisionsSchema creates the tables of domain revisions and routing table snapshots.
+// Domains without revisions, such as those created before revisions were recorded, get
+// an initial one so they can be rolled back.
+func (db *DB) initRevisionsSchema() error {
+	_, err := db.conn.Exec(`
+	CREATE TABLE IF NOT EXISTS domain_revisions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		domain TEXT NOT NULL,
+		revision INTEGER NOT NULL,
+		time DATETIME NOT NULL,
+		action TEXT NOT NULL,
+		config TEXT,
+		UNIQUE (domain, revision)
+	);
+	CREATE TABLE IF NOT EXISTS snapshots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		automatic INTEGER NOT NULL DEFAULT 0,
+		created_at DATETIME NOT NULL,
+		domain_count INTEGER NOT NULL,
+		domains TEXT NOT NULL
+	);
+	`)
+	if err != nil {
+		return err
+	}
+
+	return db.withTx(func(tx *sql.Tx) error {
+		domains, err := queryDomains(tx, `SELECT `+domainColumns+` FROM domains
+			WHERE domain NOT IN (SELECT domain FROM domain_revisions) ORDER BY domain`)
+		if err != nil {
+			return err
+		}
+		for i := range domains {
+			if err := recordRevision(tx, models.AuditImport, domains[i].Domain, &domains[i]); err != nil {
+				return err
+			}
+		}
+		if len(domains) > 0 {
+			logger().Info("Recorded initial domain revisions", "count", len(domains))
+		}
+		return nil
+	})
+}
+
+// queryDomains returns the domains selected by a query of domainColumns
+func queryDomains(q querier, query string, args ...interface{}) ([]models.Domain, error) {
+	rows, err := q.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query domains: %w", err)
+	}
+	defer rows.Close()
+
+	domains := []models.Domain{}
+	for rows.Next() {
+		d, err := scanDomain(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan domain: %w", err)
+		}
+		domains = append(domains, *d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating domains: %w", err)
+	}
+	return domains, nil
+}
+
+// recordRevision appends a revision holding the state of a domain after a change, with
+// a nil domain recording its deletion
+func recordRevision(q querier, action, domain string, d *models.Domain) error {
+	config, err := marshalJSONColumn(storeDomain(d))
+	if err != nil {
+		return fmt.Errorf("failed to encode revision of %s: %w", domain, err)
+	}
+	_, err = q.Exec(`INSERT INTO domain_revisions (domain, revision, time, action, config)
+		SELECT ?, COALESCE(MAX(revision), 0) + 1, ?, ?, ? FROM domain_revisions WHERE domain = ?`,
+		domain, time.Now().UTC().Format(time.RFC3339Nano), action, config, domain)
+	if err != nil {
+		return fmt.Errorf("failed to record revision of %s: %w", domain, err)
+	}
+	return nil
+}
+
+// scanRevision scans a row of domain_revisions selected with revisionColumns
+func scanRevision(row rowScanner) (*models.Revision, error) {
+	var r models.Revision
+	var ts string
+	var config sql.NullString
+	if err := row.Scan(&r.Domain, &r.Revision, &ts, &r.Action, &config); err != nil {
+		return nil, err
+	}
+	r.Time = parseTime(ts)
+	if config.Valid {
+		r.Config = &models.Domain{}
+		if err := json.Unmarshal([]byte(config.String), r.Config); err != nil {
+			return nil, fmt.Errorf("revision %d of %s: %w", r.Revision, r.Domain, err)
+		}
+	}
+	return &r, nil
+}
+
+// revisionColumns lists the columns read by scanRevision, in scan order
+const revisionColumns = `domain, revision, time, action, config`
+
+// ListRevisions returns the revisions of a domain, newest first
+func (db *DB) ListRevisions(domain string) ([]models.Revision, error) {
+	defer metrics.ObserveQuery("list_revisions", time.Now())
+	rows, err := db.conn.Query(`SELECT `+revisionColumns+` FROM domain_revisions WHERE domain = ? ORDER BY revision DESC`, domain)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query revisions: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := []models.Revision{}
+	for rows.Next() {
+		r, err := scanRevision(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan revision: %w", err)
+		}
+		revisions = append(revisions, *r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating revisions: %w", err)
+	}
+	return revisions, nil
+}
+
+// GetRevision returns a revision of a domain, or nil if it doesn't exist. Revision 0
+// selects the revision before the latest one.
+func (db *DB) GetRevision(domain string, revision int) (*models.Revision, error) {
+	defer metrics.ObserveQuery("get_revision", time.Now())
+	query := `SELECT ` + revisionColumns + ` FROM domain_revisions WHERE domain = ? AND revision = ?`
+	args := []interface{}{domain, revision}
+	if revision == 0 {
+		query = `SELECT ` + revisionColumns + ` FROM domain_revisions WHERE domain = ? ORDER BY revision DESC LIMIT 1 OFFSET 1`
+		args = args[:1]
+	}
+	r, err := scanRevision(db.conn.QueryRow(query, args...))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get revision: %w", err)
+	}
+	return r, nil
+}
+
+// RollbackDomain restores a domain to a revision, recording the result as a new revision.
+// Rolling back to a deletion deletes the domain.
+func (db *DB) RollbackDomain(actor models.Actor, revision *models.Revision) (*models.DomainChange, error) {
+	defer metrics.ObserveQuery("rollback_domain", time.Now())
+	var change *models.DomainChange
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		change, err = applyDomain(tx, actor, models.AuditRollback, revision.Domain, revision.Config)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// applyDomain makes a domain match config, deleting it when config is nil, and records the
+// change if there was one. It returns nil if the domain already matched.
+func applyDomain(tx *sql.Tx, actor models.Actor, action, domain string, config *models.Domain) (*models.DomainChange, error) {
+	before, err := getDomain(tx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if SameConfig(before, config) {
+		return nil, nil
+	}
+
+	if config == nil {
+		if _, err := tx.Exec(`DELETE FROM domains WHERE domain = ?`, domain); err != nil {
+			return nil, fmt.Errorf("failed to delete domain %s: %w", domain, err)
+		}
+	} else {
+		args, err := insertDomainArgs(models.CreateDomainRequest{
+			Domain:        domain,
+			IP:            config.IP,
+			Port:          config.Port,
+			Protocol:      config.Protocol,
+			Target:        config.Target,
+			DomainOptions: config.DomainOptions,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to write domain %s: %w", domain, err)
+		}
+		if _, err := tx.Exec(upsertDomainQuery, args...); err != nil {
+			return nil, fmt.Errorf("failed to write domain %s: %w", domain, err)
+		}
+	}
+
+	after, err := getDomain(tx, domain)
+	if err != nil {
+		return nil, err
+	}
+	if err := recordChange(tx, actor, action, domain, before, after); err != nil {
+		return nil, err
+	}
+	return &models.DomainChange{Domain: domain, Before: before, After: after}, nil
+}
+
+// SameConfig reports whether two domain mappings have the same configuration, ignoring
+// their versions and timestamps. Nil mappings only match each other.
+func SameConfig(a, b *models.Domain) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	ca, cb := *a, *b
+	ca.Version, ca.CreatedAt, ca.UpdatedAt = 0, time.Time{}, time.Time{}
+	cb.Version, cb.CreatedAt, cb.UpdatedAt = 0, time.Time{}, time.Time{}
+	ja, errA := json.Marshal(storeDomain(&ca))
+	jb, errB := json.Marshal(storeDomain(&cb))
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
+
+// CreateSnapshot saves a copy of the whole routing table. Automatic snapshots, taken
+// before bulk changes, are pruned to the newest maxAutomaticSnapshots.
+func (db *DB) CreateSnapshot(name string, automatic bool) (*models.Snapshot, error) {
+	defer metrics.ObserveQuery("create_snapshot", time.Now())
+	var snapshot *models.Snapshot
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		snapshot, err = createSnapshot(tx, name, automatic)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// errNoChanges rolls back the automatic snapshot of a bulk change that changed nothing
+var errNoChanges = errors.New("no changes")
+
+// createSnapshot saves a copy of the routing table as seen by tx. Bulk changes take their
+// automatic snapshot in their own transaction, so it is only kept if they are.
+func createSnapshot(tx *sql.Tx, name string, automatic bool) (*models.Snapshot, error) {
+	domains, err := queryDomains(tx, `SELECT `+domainColumns+` FROM domains ORDER BY domain`)
+	if err != nil {
+		return nil, err
+	}
+	stored := make([]*storedDomain, len(domains))
+	for i := range domains {
+		stored[i] = storeDomain(&domains[i])
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	now := time.Now().UTC()
+	result, err := tx.Exec(`INSERT INTO snapshots (name, automatic, created_at, domain_count, domains) VALUES (?, ?, ?, ?, ?)`,
+		name, automatic, now.Format(time.RFC3339Nano), len(domains), string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	if automatic {
+		_, err = tx.Exec(`DELETE FROM snapshots WHERE automatic = 1 AND id NOT IN
+			(SELECT id FROM snapshots WHERE automatic = 1 ORDER BY id DESC LIMIT ?)`, maxAutomaticSnapshots)
+		if err != nil {
+			return nil, fmt.Errorf("failed to prune snapshots: %w", err)
+		}
+	}
+	return &models.Snapshot{ID: id, Name: name, CreatedAt: now, DomainCount: len(domains)}, nil
+}
+
+// ListSnapshots returns all snapshots without their domains, newest first
+func (db *DB) ListSnapshots() ([]models.Snapshot, error) {
+	defer metrics.ObserveQuery("list_snapshots", time.Now())
+	rows, err := db.conn.Query(`SELECT id, name, created_at, domain_count FROM snapshots ORDER BY id DESC`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query snapshots: %w", err)
+	}
+	defer rows.Close()
+
+	snapshots := []models.Snapshot{}
+	for rows.Next() {
+		var s models.Snapshot
+		var createdAt string
+		if err := rows.Scan(&s.ID, &s.Name, &createdAt, &s.DomainCount); err != nil {
+			return nil, fmt.Errorf("failed to scan snapshot: %w", err)
+		}
+		s.CreatedAt = parseTime(createdAt)
+		snapshots = append(snapshots, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating snapshots: %w", err)
+	}
+	return snapshots, nil
+}
+
+// GetSnapshot returns a snapshot along with its domains, or nil if it doesn't exist
+func (db *DB) GetSnapshot(id int64) (*models.Snapshot, error) {
+	defer metrics.ObserveQuery("get_snapshot", time.Now())
+	var s models.Snapshot
+	var createdAt, domains string
+	err := db.conn.QueryRow(`SELECT id, name, created_at, domain_count, domains FROM snapshots WHERE id = ?`, id).
+		Scan(&s.ID, &s.Name, &createdAt, &s.DomainCount, &domains)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get snapshot: %w", err)
+	}
+	s.CreatedAt = parseTime(createdAt)
+	if err := json.Unmarshal([]byte(domains), &s.Domains); err != nil {
+		return nil, fmt.Errorf("snapshot %d: invalid domains: %w", s.ID, err)
+	}
+	return &s, nil
+}
+
+// RestoreSnapshot makes the routing table match a snapshot in a single transaction.
+// Domains missing from the snapshot are deleted. Each changed domain gets a new revision.
+func (db *DB) RestoreSnapshot(actor models.Actor, snapshot *models.Snapshot) ([]models.DomainChange, error) {
+	defer metrics.ObserveQuery("restore_snapshot", time.Now())
+	var changes []models.DomainChange
+	err := db.withTx(func(tx *sql.Tx) error {
+		var err error
+		changes, _, err = syncDomains(tx, actor, models.AuditRestore, snapshot.Domains, true, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
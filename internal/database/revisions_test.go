@@ -0,0 +1,51 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// snapshotCount returns the number of stored snapshots
+func snapshotCount(t *testing.T, db *DB) int {
+	t.Helper()
+	snapshots, err := db.ListSnapshots()
+	if err != nil {
+		t.Fatalf("ListSnapshots: %v", err)
+	}
+	return len(snapshots)
+}
+
+func TestBulkCreateSnapshot(t *testing.T) {
+	db := newTestDB(t)
+	createDomain(t, db, "a.example.com")
+
+	created, snapshot, err := db.BulkCreateDomains(testActor, []models.CreateDomainRequest{
+		{Domain: "b.example.com", IP: "10.0.0.1", Port: 80},
+		{Domain: "c.example.com", IP: "10.0.0.1", Port: 80},
+	})
+	if err != nil {
+		t.Fatalf("BulkCreateDomains: %v", err)
+	}
+	if len(created) != 2 || snapshot == nil {
+		t.Fatalf("created %d domains with snapshot %v, want 2 with a snapshot", len(created), snapshot)
+	}
+	stored, err := db.GetSnapshot(snapshot.ID)
+	if err != nil {
+		t.Fatalf("GetSnapshot: %v", err)
+	}
+	if len(stored.Domains) != 1 || stored.Domains[0].Domain != "a.example.com" {
+		t.Errorf("snapshot holds %v, want the routing table before the bulk create", stored.Domains)
+	}
+
+	_, snapshot, err = db.BulkCreateDomains(testActor, []models.CreateDomainRequest{
+		{Domain: "d.example.com", IP: "10.0.0.1", Port: 80},
+		{Domain: "a.example.com", IP: "10.0.0.1", Port: 80},
+	})
+	if err == nil {
+		t.Fatal("BulkCreateDomains with an existing domain succeeded")
+	}
+	if snapshot != nil || snapshotCount(t, db) != 1 {
+		t.Errorf("failed bulk create kept its snapshot")
+	}
+}
@@ -0,0 +1,133 @@
+package database
+
+import (
+	"cmp"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/metrics"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// errDryRun rolls back the transaction of a dry run after the changes were computed
+var errDryRun = errors.New("dry run")
+
+// SyncCheck is called for every domain a sync would change, with the stored mapping and
+// the desired one, nil when it doesn't or won't exist. An error aborts the sync.
+type SyncCheck func(before, after *models.Domain) error
+
+// SyncDomains makes the routing table match the desired mappings in a single transaction.
+// Domains missing from desired are only deleted when prune is set. A dry run computes
+// the same diff without keeping any changes. The snapshot taken before the sync is only
+// kept, and returned, if the sync changed a domain.
+func (db *DB) SyncDomains(actor models.Actor, desired []models.Domain, prune, dryRun bool, check SyncCheck) (*models.StateDiff, *models.Snapshot, error) {
+	defer metrics.ObserveQuery("sync_domains", time.Now())
+	diff := &models.StateDiff{
+		DryRun:  dryRun,
+		Prune:   prune,
+		Added:   []models.DomainChange{},
+		Changed: []models.DomainChange{},
+		Removed: []models.DomainChange{},
+	}
+	var snapshot *models.Snapshot
+	err := db.withTx(func(tx *sql.Tx) error {
+		// A bad sync can be undone by restoring the routing table from before it
+		if !dryRun {
+			var err error
+			if snapshot, err = createSnapshot(tx, "before state sync", true); err != nil {
+				return err
+			}
+		}
+		changes, unlisted, err := syncDomains(tx, actor, models.AuditSync, desired, prune, check)
+		if err != nil {
+			return err
+		}
+		for _, change := range changes {
+			switch {
+			case change.Before == nil:
+				diff.Added = append(diff.Added, change)
+			case change.After == nil:
+				diff.Removed = append(diff.Removed, change)
+			default:
+				diff.Changed = append(diff.Changed, change)
+			}
+		}
+		diff.Unchanged = len(desired) - len(diff.Added) - len(diff.Changed)
+		diff.Unlisted = unlisted
+		if dryRun {
+			return errDryRun
+		}
+		if len(changes) == 0 {
+			return errNoChanges
+		}
+		return nil
+	})
+	if errors.Is(err, errDryRun) || errors.Is(err, errNoChanges) {
+		return diff, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return diff, snapshot, nil
+}
+
+// syncDomains makes the domains table match desired, recording each change with action.
+// Domains missing from desired are deleted if prune is set, and otherwise returned as unlisted. check, if not nil, is called before each change is written.
+func syncDomains(tx *sql.Tx, actor models.Actor, action string, desired []models.Domain, prune bool, check SyncCheck) ([]models.DomainChange, []string, error) {
+	current, err := queryDomains(tx, `SELECT `+domainColumns+` FROM domains ORDER BY domain`)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Settings are compared as they would be stored, so e.g. empty options don't count as changes
+	normalized := make([]models.Domain, len(desired))
+	wanted := make(map[string]bool, len(desired))
+	for i, d := range desired {
+		d.Protocol = cmp.Or(d.Protocol, "http")
+		d.DomainOptions = normalizeOptions(d.DomainOptions)
+		normalized[i] = d
+		wanted[d.Domain] = true
+	}
+
+	changes := []models.DomainChange{}
+	var unlisted []string
+	apply := func(before, after *models.Domain, domain string) error {
+		if SameConfig(before, after) {
+			return nil
+		}
+		if check != nil {
+			if err := check(before, after); err != nil {
+				return err
+			}
+		}
+		change, err := applyDomain(tx, actor, action, domain, after)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, *change)
+		return nil
+	}
+
+	stored := make(map[string]*models.Domain, len(current))
+	for i := range current {
+		d := &current[i]
+		stored[d.Domain] = d
+		if wanted[d.Domain] {
+			continue
+		}
+		if !prune {
+			unlisted = append(unlisted, d.Domain)
+			continue
+		}
+		if err := apply(d, nil, d.Domain); err != nil {
+			return nil, nil, err
+		}
+	}
+	for i := range normalized {
+		d := &normalized[i]
+		if err := apply(stored[d.Domain], d, d.Domain); err != nil {
+			return nil, nil, err
+		}
+	}
+	return changes, unlisted, nil
+}
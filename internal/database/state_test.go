@@ -0,0 +1,33 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+func TestSyncDomainsSnapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		desired  []models.Domain
+		dryRun   bool
+		snapshot bool
+	}{
+		{"changed", []models.Domain{{Domain: "a.example.com", IP: "10.0.0.2", Port: 80}}, false, true},
+		{"dry run", []models.Domain{{Domain: "a.example.com", IP: "10.0.0.2", Port: 80}}, true, false},
+		{"unchanged", []models.Domain{{Domain: "a.example.com", IP: "10.0.0.1", Port: 8080}}, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			createDomain(t, db, "a.example.com")
+			_, snapshot, err := db.SyncDomains(testActor, tt.desired, false, tt.dryRun, nil)
+			if err != nil {
+				t.Fatalf("SyncDomains: %v", err)
+			}
+			if kept := snapshotCount(t, db) == 1; (snapshot != nil) != tt.snapshot || kept != tt.snapshot {
+				t.Errorf("snapshot returned = %v, stored = %v, want %v", snapshot != nil, kept, tt.snapshot)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// MergePatchType is the media type of JSON merge patches
+const MergePatchType = "application/merge-patch+json"
+
+// Decode parses a JSON document into maps, slices and scalars. Numbers are kept as
+// json.Number so they are written back unchanged.
+func Decode(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return doc, nil
+}
+
+// MergePatch applies an RFC 7396 merge patch to a decoded document. Members of patch
+// objects replace those of the document, recursively for objects, and null members
+// remove them; any other patch value replaces the document as a whole.
+func MergePatch(doc, patch interface{}) interface{} {
+	members, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	target, ok := doc.(map[string]interface{})
+	if !ok {
+		target = map[string]interface{}{}
+	}
+	for name, value := range members {
+		if value == nil {
+			delete(target, name)
+			continue
+		}
+		target[name] = MergePatch(target[name], value)
+	}
+	return target
+}
@@ -0,0 +1,50 @@
+package jsonpatch
+
+import "testing"
+
+func TestMergePatch(t *testing.T) {
+	// The examples of RFC 7396 appendix A
+	tests := []struct {
+		doc, patch, want string
+	}{
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "b"}`, `{"b": "c"}`, `{"a": "b", "b": "c"}`},
+		{`{"a": "b"}`, `{"a": null}`, `{}`},
+		{`{"a": "b", "b": "c"}`, `{"a": null}`, `{"b": "c"}`},
+		{`{"a": ["b"]}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "c"}`, `{"a": ["b"]}`, `{"a": ["b"]}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a": {"b": "d"}}`},
+		{`{"a": [{"b": "c"}]}`, `{"a": [1]}`, `{"a": [1]}`},
+		{`["a", "b"]`, `["c", "d"]`, `["c", "d"]`},
+		{`{"a": "b"}`, `["c"]`, `["c"]`},
+		{`{"a": "foo"}`, `null`, `null`},
+		{`{"a": "foo"}`, `"bar"`, `"bar"`},
+		{`{"e": null}`, `{"a": 1}`, `{"e": null, "a": 1}`},
+		{`[1, 2]`, `{"a": "b", "c": null}`, `{"a": "b"}`},
+		{`{}`, `{"a": {"bb": {"ccc": null}}}`, `{"a": {"bb": {}}}`},
+	}
+	for _, tt := range tests {
+		got := canonical(t, MergePatch(decode(t, tt.doc), decode(t, tt.patch)))
+		if got != canonical(t, decode(t, tt.want)) {
+			t.Errorf("MergePatch(%s, %s) = %s, want %s", tt.doc, tt.patch, got, tt.want)
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		data string
+		ok   bool
+	}{
+		{`{"port": 8080}`, true},
+		{` [1, 2] `, true},
+		{`{"a": 1} {"b": 2}`, false},
+		{`{"a": 1}]`, false},
+		{`{"a": `, false},
+	}
+	for _, tt := range tests {
+		if _, err := Decode([]byte(tt.data)); (err == nil) != tt.ok {
+			t.Errorf("Decode(%s) error = %v, want success %v", tt.data, err, tt.ok)
+		}
+	}
+}
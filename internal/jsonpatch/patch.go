@@ -0,0 +1,296 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// PatchType is the media type of JSON Patch documents
+const PatchType = "application/json-patch+json"
+
+var (
+	// ErrTestFailed is returned when the value of a test operation doesn't match
+	ErrTestFailed = errors.New("test failed")
+	// errNotFound is returned for paths that don't exist in the document
+	errNotFound = errors.New("path not found")
+)
+
+// Operation is a single operation of an RFC 6902 JSON Patch
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Apply applies the operations of an RFC 6902 JSON Patch to a decoded document in order.
+// The document is modified in place, so it must be discarded if an operation fails.
+func Apply(doc interface{}, patch []Operation) (interface{}, error) {
+	for i, op := range patch {
+		var err error
+		if doc, err = op.apply(doc); err != nil {
+			return nil, fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+func (op Operation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		value, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "remove":
+		return remove(doc, path)
+	case "replace":
+		value, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return value, nil
+		}
+		if doc, err = remove(doc, path); err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from: %w", err)
+		}
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, fmt.Errorf("from: %w", err)
+		}
+		if op.Op == "copy" {
+			return add(doc, path, deepCopy(value))
+		}
+		if len(from) < len(path) && slices.Equal(from, path[:len(from)]) {
+			return nil, errors.New("can't move a value into itself")
+		}
+		if doc, err = remove(doc, from); err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "test":
+		want, err := op.value()
+		if err != nil {
+			return nil, err
+		}
+		got, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(got, want) {
+			return nil, ErrTestFailed
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("unsupported operation %q", op.Op)
+	}
+}
+
+// value decodes the value of an operation, which is required by add, replace and test
+func (op Operation) value() (interface{}, error) {
+	if len(op.Value) == 0 {
+		return nil, errors.New("missing value")
+	}
+	return Decode(op.Value)
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid path %q: must be empty or start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses an array index token, which must be below n
+func arrayIndex(token string, n int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || strconv.Itoa(i) != token {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i >= n {
+		return 0, errNotFound
+	}
+	return i, nil
+}
+
+// get returns the value a path refers to
+func get(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch container := doc.(type) {
+		case map[string]interface{}:
+			value, ok := container[token]
+			if !ok {
+				return nil, errNotFound
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			doc = container[i]
+		default:
+			return nil, errNotFound
+		}
+	}
+	return doc, nil
+}
+
+// update replaces the container holding the last token of a non-empty path with the
+// result of fn, returning the updated document
+func update(doc interface{}, path []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		child, ok := container[path[0]]
+		if !ok {
+			return nil, errNotFound
+		}
+		child, err := update(child, path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		container[path[0]] = child
+		return container, nil
+	case []interface{}:
+		i, err := arrayIndex(path[0], len(container))
+		if err != nil {
+			return nil, err
+		}
+		if container[i], err = update(container[i], path[1:], fn); err != nil {
+			return nil, err
+		}
+		return container, nil
+	default:
+		return nil, errNotFound
+	}
+}
+
+// add sets an object member or inserts an array element; "-" appends to an array
+func add(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch container := container.(type) {
+		case map[string]interface{}:
+			container[token] = value
+			return container, nil
+		case []interface{}:
+			if token == "-" {
+				return append(container, value), nil
+			}
+			i, err := arrayIndex(token, len(container)+1)
+			if err != nil {
+				return nil, err
+			}
+			return slices.Insert(container, i, value), nil
+		default:
+			return nil, errNotFound
+		}
+	})
+}
+
+// remove removes an object member or array element, which must exist
+func remove(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, errors.New("can't remove the whole document")
+	}
+	return update(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch container := container.(type) {
+		case map[string]interface{}:
+			if _, ok := container[token]; !ok {
+				return nil, errNotFound
+			}
+			delete(container, token)
+			return container, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(container))
+			if err != nil {
+				return nil, err
+			}
+			return slices.Delete(container, i, i+1), nil
+		default:
+			return nil, errNotFound
+		}
+	})
+}
+
+// deepCopy copies a decoded value so that changes to the copy don't affect the original
+func deepCopy(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(value))
+		for name, member := range value {
+			copied[name] = deepCopy(member)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, element := range value {
+			copied[i] = deepCopy(element)
+		}
+		return copied
+	default:
+		return value
+	}
+}
+
+// equal compares decoded values as required by the test operation: numbers by value,
+// objects regardless of member order
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		fa, errA := a.Float64()
+		fb, errB := b.Float64()
+		return errA == nil && errB == nil && fa == fb
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for name, member := range a {
+			other, ok := b[name]
+			if !ok || !equal(member, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		b, ok := b.([]interface{})
+		return ok && slices.EqualFunc(a, b, equal)
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,110 @@
+package jsonpatch
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// canonical encodes a decoded document with sorted members, so documents compare
+// regardless of member order and whitespace
+func canonical(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// decode decodes a JSON document, failing the test if it is invalid
+func decode(t *testing.T, data string) interface{} {
+	t.Helper()
+	v, err := Decode([]byte(data))
+	if err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return v
+}
+
+func TestApply(t *testing.T) {
+	// Most cases are the examples of RFC 6902 appendix A
+	tests := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+		// err is a substring of the expected error, empty if the patch applies
+		err string
+	}{
+		{"add member", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz": "qux", "foo": "bar"}`, ""},
+		{"add element", `{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			`{"foo": ["bar", "qux", "baz"]}`, ""},
+		{"append element", `{"foo": [1]}`, `[{"op": "add", "path": "/foo/-", "value": 2}]`, `{"foo": [1, 2]}`, ""},
+		{"add nested member", `{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`,
+			`{"foo": "bar", "child": {"grandchild": {}}}`, ""},
+		{"add to missing parent", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`, "", "path not found"},
+		{"add past end of array", `{"foo": [1]}`, `[{"op": "add", "path": "/foo/2", "value": 2}]`, "", "path not found"},
+		{"remove member", `{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo": "bar"}`, ""},
+		{"remove element", `{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo": ["bar", "baz"]}`, ""},
+		{"remove missing member", `{"foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, "", "path not found"},
+		{"replace", `{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			`{"baz": "boo", "foo": "bar"}`, ""},
+		{"replace document", `{"foo": "bar"}`, `[{"op": "replace", "path": "", "value": [1]}]`, `[1]`, ""},
+		{"replace missing member", `{"foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": 1}]`, "", "path not found"},
+		{"move member", `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			`[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			`{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`, ""},
+		{"move element", `{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			`{"foo": ["all", "cows", "eat", "grass"]}`, ""},
+		{"move into itself", `{"foo": {"bar": 1}}`, `[{"op": "move", "from": "/foo", "path": "/foo/bar/baz"}]`, "", "into itself"},
+		{"copy is independent", `{"foo": {"bar": 1}}`,
+			`[{"op": "copy", "from": "/foo", "path": "/baz"}, {"op": "replace", "path": "/baz/bar", "value": 2}]`,
+			`{"foo": {"bar": 1}, "baz": {"bar": 2}}`, ""},
+		{"test", `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			`[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			`{"baz": "qux", "foo": ["a", 2, "c"]}`, ""},
+		{"test numbers by value", `{"port": 8080}`, `[{"op": "test", "path": "/port", "value": 8080.0}]`, `{"port": 8080}`, ""},
+		{"test objects regardless of order", `{"a": {"x": 1, "y": 2}}`, `[{"op": "test", "path": "/a", "value": {"y": 2, "x": 1}}]`,
+			`{"a": {"x": 1, "y": 2}}`, ""},
+		{"test failure", `{"baz": "qux"}`, `[{"op": "test", "path": "/baz", "value": "bar"}]`, "", "test failed"},
+		{"test string against number", `{"foo": 10}`, `[{"op": "test", "path": "/foo", "value": "10"}]`, "", "test failed"},
+		{"escaped tokens", `{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": 10}, {"op": "remove", "path": "/~1"}]`,
+			`{"~1": 10}`, ""},
+		{"leading zero index", `{"foo": [1, 2]}`, `[{"op": "remove", "path": "/foo/01"}]`, "", "invalid array index"},
+		{"relative path", `{"foo": 1}`, `[{"op": "remove", "path": "foo"}]`, "", "must be empty or start with /"},
+		{"missing value", `{"foo": 1}`, `[{"op": "add", "path": "/bar"}]`, "", "missing value"},
+		{"unsupported op", `{"foo": 1}`, `[{"op": "rename", "path": "/foo"}]`, "", `unsupported operation "rename"`},
+		{"error names operation", `{"foo": 1}`, `[{"op": "test", "path": "/foo", "value": 1}, {"op": "remove", "path": "/bar"}]`,
+			"", "operation 1 (remove /bar)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var patch []Operation
+			if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+				t.Fatal(err)
+			}
+			got, err := Apply(decode(t, tt.doc), patch)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Apply: %v", err)
+			}
+			if got, want := canonical(t, got), canonical(t, decode(t, tt.want)); got != want {
+				t.Errorf("patched document = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestApplyTestFailedIsSentinel(t *testing.T) {
+	_, err := Apply(map[string]interface{}{"a": "b"}, []Operation{{Op: "test", Path: "/a", Value: json.RawMessage(`"c"`)}})
+	if !errors.Is(err, ErrTestFailed) {
+		t.Errorf("error = %v, want ErrTestFailed", err)
+	}
+}
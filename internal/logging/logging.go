@@ -0,0 +1,176 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+	"github.com/itsnoxius/simple-proxy/internal/requestid"
+)
+
+// Subsystems with independently adjustable log levels
+const (
+	Server   = "server"
+	Proxy    = "proxy"
+	API      = "api"
+	Database = "database"
+	TLS      = "tls"
+	Cache    = "cache"
+)
+
+// Subsystems lists all subsystems in display order
+var Subsystems = []string{Server, Proxy, API, Database, TLS, Cache}
+
+var (
+	mu      sync.RWMutex
+	levels  = make(map[string]*slog.LevelVar)
+	loggers = make(map[string]*slog.Logger)
+)
+
+func init() {
+	for _, subsystem := range Subsystems {
+		levels[subsystem] = new(slog.LevelVar)
+	}
+	Setup(os.Stderr, "text")
+}
+
+// Setup configures the output format ("text" or "json") of all subsystem loggers and routes
+// the standard library logger through the server subsystem. Levels are kept.
+func Setup(w io.Writer, format string) error {
+	var base slog.Handler
+	// Every subsystem handler filters by its own level, so the base handler lets everything through
+	options := &slog.HandlerOptions{Level: slog.Level(-100)}
+	switch format {
+	case "text":
+		base = slog.NewTextHandler(w, options)
+	case "json":
+		base = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("unsupported log format %q, expected text or json", format)
+	}
+
+	mu.Lock()
+	for _, subsystem := range Subsystems {
+		handler := &levelHandler{
+			Handler: base.WithAttrs([]slog.Attr{slog.String("subsystem", subsystem)}),
+			level:   levels[subsystem],
+		}
+		loggers[subsystem] = slog.New(handler)
+	}
+	server := loggers[Server]
+	mu.Unlock()
+
+	// Messages from the standard logger are written at info level
+	slog.SetDefault(server)
+	return nil
+}
+
+// Logger returns the logger of a subsystem. Loggers are replaced by Setup, so callers
+// should not keep them in package level variables.
+func Logger(subsystem string) *slog.Logger {
+	mu.RLock()
+	defer mu.RUnlock()
+	if logger, ok := loggers[subsystem]; ok {
+		return logger
+	}
+	return loggers[Server]
+}
+
+// ParseLevel parses a level name: debug, info, warn or error
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(name)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", name)
+	}
+	return level, nil
+}
+
+// ParseLevels parses per-subsystem levels in the form "proxy=debug,api=warn"
+func ParseLevels(spec string) (map[string]slog.Level, error) {
+	result := make(map[string]slog.Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, name, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid log level setting %q, expected subsystem=level", part)
+		}
+		level, err := ParseLevel(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		result[strings.TrimSpace(subsystem)] = level
+	}
+	return result, nil
+}
+
+// SetLevel changes the level of a subsystem
+func SetLevel(subsystem string, level slog.Level) error {
+	if !slices.Contains(Subsystems, subsystem) {
+		return fmt.Errorf("unknown subsystem %q, expected one of %s", subsystem, strings.Join(Subsystems, ", "))
+	}
+	levels[subsystem].Set(level)
+	return nil
+}
+
+// SetAllLevels changes the level of every subsystem
+func SetAllLevels(level slog.Level) {
+	for _, subsystem := range Subsystems {
+		levels[subsystem].Set(level)
+	}
+}
+
+// Levels returns the current level name of every subsystem
+func Levels() map[string]string {
+	result := make(map[string]string, len(Subsystems))
+	for _, subsystem := range Subsystems {
+		result[subsystem] = strings.ToLower(levels[subsystem].Level().String())
+	}
+	return result
+}
+
+// levelHandler drops records below its subsystem's level and adds the request ID of
+// records logged with a request context
+type levelHandler struct {
+	slog.Handler
+	level *slog.LevelVar
+}
+
+func (h *levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	id := requestid.FromContext(ctx)
+	principal := auth.FromContext(ctx)
+	if id != "" || principal != nil {
+		record = record.Clone()
+	}
+	if id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	// API requests are attributed to the credential that made them
+	if principal != nil {
+		record.AddAttrs(slog.String("principal", principal.Name))
+		if principal.KeyID != "" {
+			record.AddAttrs(slog.String("key_id", principal.KeyID))
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h *levelHandler) WithGroup(name string) slog.Handler {
+	return &levelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"strings"
+	"testing"
+)
+
+// captureLogs writes the logs of every subsystem to a buffer until the test ends, restoring
+// the default output and levels afterwards
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	previous := make(map[string]slog.Level, len(Subsystems))
+	for _, subsystem := range Subsystems {
+		previous[subsystem] = levels[subsystem].Level()
+	}
+	var buf bytes.Buffer
+	if err := Setup(&buf, "text"); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	t.Cleanup(func() {
+		Setup(os.Stderr, "text")
+		for subsystem, level := range previous {
+			levels[subsystem].Set(level)
+		}
+	})
+	return &buf
+}
+
+func TestSetLevelAtRuntime(t *testing.T) {
+	buf := captureLogs(t)
+	SetAllLevels(slog.LevelInfo)
+
+	// A logger fetched before the change follows it, as the level is shared
+	proxy := Logger(Proxy)
+	proxy.Debug("before")
+	if err := SetLevel(Proxy, slog.LevelDebug); err != nil {
+		t.Fatalf("SetLevel: %v", err)
+	}
+	proxy.Debug("after")
+	Logger(API).Debug("other subsystem")
+
+	out := buf.String()
+	if strings.Contains(out, "before") {
+		t.Errorf("debug record logged before the level change: %s", out)
+	}
+	if !strings.Contains(out, "msg=after subsystem=proxy") {
+		t.Errorf("debug record missing after the level change: %s", out)
+	}
+	if strings.Contains(out, "other subsystem") {
+		t.Errorf("level change leaked into another subsystem: %s", out)
+	}
+	if got := Levels(); got[Proxy] != "debug" || got[API] != "info" {
+		t.Errorf("Levels() = %v, want proxy=debug and api=info", got)
+	}
+
+	if err := SetLevel("nonexistent", slog.LevelDebug); err == nil {
+		t.Error("SetLevel accepted an unknown subsystem")
+	}
+}
+
+func TestParseLevels(t *testing.T) {
+	got, err := ParseLevels(" proxy=debug, api = warn ,")
+	if err != nil {
+		t.Fatalf("ParseLevels: %v", err)
+	}
+	if len(got) != 2 || got[Proxy] != slog.LevelDebug || got[API] != slog.LevelWarn {
+		t.Errorf("ParseLevels = %v, want proxy=DEBUG and api=WARN", got)
+	}
+	for _, spec := range []string{"proxy", "proxy=verbose"} {
+		if _, err := ParseLevels(spec); err == nil {
+			t.Errorf("ParseLevels(%q) succeeded, want an error", spec)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Unmatched is the domain label of requests for hosts without a domain mapping. Arbitrary
+// Host headers are not used as label values, so clients can't inflate the series count.
+const Unmatched = "unmatched"
+
+// registry holds all proxy metrics along with the Go runtime and process collectors
+var registry = prometheus.NewRegistry()
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_requests_total",
+		Help: "Proxied requests by domain, status class and upstream.",
+	}, []string{"domain", "status_class", "upstream"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_request_duration_seconds",
+		Help:    "Total time to serve proxied requests by domain, status class and upstream.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"domain", "status_class", "upstream"})
+
+	requestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proxy_requests_in_flight",
+		Help: "Requests currently being served by domain.",
+	}, []string{"domain"})
+
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_upstream_duration_seconds",
+		Help:    "Time until upstream response headers arrived by domain and upstream.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"domain", "upstream"})
+
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_upstream_errors_total",
+		Help: "Failed upstream requests by domain, upstream and error type.",
+	}, []string{"domain", "upstream", "type"})
+
+	mirrorRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_mirror_requests_total",
+		Help: "Shadow requests by domain and result: completed, error, dropped (too many in flight) or skipped (body too large).",
+	}, []string{"domain", "result"})
+
+	mirrorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_mirror_duration_seconds",
+		Help:    "Latency of completed shadow requests by domain and status class.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"domain", "status_class"})
+
+	mirrorErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proxy_mirror_errors_total",
+		Help: "Failed shadow requests by domain and error type.",
+	}, []string{"domain", "type"})
+
+	dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proxy_db_query_duration_seconds",
+		Help:    "Database query latency by operation.",
+		Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1},
+	}, []string{"operation"})
+)
+
+func init() {
+	registry.MustRegister(
+		requestsTotal,
+		requestDuration,
+		requestsInFlight,
+		upstreamDuration,
+		upstreamErrors,
+		mirrorRequests,
+		mirrorDuration,
+		mirrorErrors,
+		dbQueryDuration,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves the metrics in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// RegisterRouteCount reports the number of domain mappings, calling count on every scrape
+func RegisterRouteCount(count func() (int, error)) {
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "proxy_routes",
+		Help: "Number of configured domain mappings.",
+	}, func() float64 {
+		n, err := count()
+		if err != nil {
+			return -1
+		}
+		return float64(n)
+	}))
+}
+
+// ObserveRequest records a completed request
+func ObserveRequest(domain, upstream string, status int, duration time.Duration) {
+	class := statusClass(status)
+	requestsTotal.WithLabelValues(domain, class, upstream).Inc()
+	requestDuration.WithLabelValues(domain, class, upstream).Observe(duration.Seconds())
+}
+
+// TrackInFlight counts a request as in flight until the returned function is called
+func TrackInFlight(domain string) func() {
+	gauge := requestsInFlight.WithLabelValues(domain)
+	gauge.Inc()
+	return gauge.Dec
+}
+
+// ObserveUpstream records an upstream attempt, counting failures by error type
+func ObserveUpstream(domain, upstream string, duration time.Duration, err error) {
+	if err != nil {
+		upstreamErrors.WithLabelValues(domain, upstream, errorType(err)).Inc()
+		return
+	}
+	upstreamDuration.WithLabelValues(domain, upstream).Observe(duration.Seconds())
+}
+
+// ObserveMirror records a shadow request that completed with status or failed with err
+func ObserveMirror(domain string, status int, duration time.Duration, err error) {
+	if err != nil {
+		mirrorRequests.WithLabelValues(domain, "error").Inc()
+		mirrorErrors.WithLabelValues(domain, errorType(err)).Inc()
+		return
+	}
+	mirrorRequests.WithLabelValues(domain, "completed").Inc()
+	mirrorDuration.WithLabelValues(domain, statusClass(status)).Observe(duration.Seconds())
+}
+
+// MirrorNotSent records a sampled request that was not mirrored, e.g. "dropped" or "skipped"
+func MirrorNotSent(domain, result string) {
+	mirrorRequests.WithLabelValues(domain, result).Inc()
+}
+
+// statusClass returns the status class label of a status code, e.g. "2xx"
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// ObserveQuery records the latency of a database operation started at start
+func ObserveQuery(operation string, start time.Time) {
+	dbQueryDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// errorType classifies an upstream error for the error type label
+func errorType(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection_reset"
+	case errors.As(err, &certErr), errors.As(err, &recordErr), errors.As(err, &alertErr),
+		errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr):
+		return "tls"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scrape returns the exposition of all registered metrics
+func scrape(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics status = %d, want 200", w.Code)
+	}
+	body, err := io.ReadAll(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestMetricsExposition(t *testing.T) {
+	RegisterRouteCount(func() (int, error) { return 3, nil })
+	ObserveRequest("app.example.com", "10.0.0.1:8080", http.StatusNotFound, 20*time.Millisecond)
+	ObserveUpstream("app.example.com", "10.0.0.1:8080", 10*time.Millisecond, nil)
+	ObserveUpstream("app.example.com", "10.0.0.1:8080", 0, syscall.ECONNREFUSED)
+	done := TrackInFlight("app.example.com")
+	ObserveQuery("get_domain", time.Now())
+
+	out := scrape(t)
+	for _, want := range []string{
+		`proxy_requests_total{domain="app.example.com",status_class="4xx",upstream="10.0.0.1:8080"} 1`,
+		`proxy_request_duration_seconds_count{domain="app.example.com",status_class="4xx",upstream="10.0.0.1:8080"} 1`,
+		`proxy_upstream_duration_seconds_count{domain="app.example.com",upstream="10.0.0.1:8080"} 1`,
+		`proxy_upstream_errors_total{domain="app.example.com",type="connection_refused",upstream="10.0.0.1:8080"} 1`,
+		`proxy_requests_in_flight{domain="app.example.com"} 1`,
+		`proxy_db_query_duration_seconds_count{operation="get_domain"} 1`,
+		`proxy_routes 3`,
+		`go_goroutines `,
+		`process_cpu_seconds_total `,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("exposition lacks %q", want)
+		}
+	}
+
+	done()
+	if out := scrape(t); !strings.Contains(out, `proxy_requests_in_flight{domain="app.example.com"} 0`) {
+		t.Error("in-flight gauge not decremented")
+	}
+}
+
+func TestErrorType(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("dial: %w", context.DeadlineExceeded), "timeout"},
+		{&net.DNSError{Err: "no such host", Name: "backend.invalid"}, "dns"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "connection_refused"},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, "connection_reset"},
+		{errors.New("something else"), "other"},
+	}
+	for _, tt := range tests {
+		if got := errorType(tt.err); got != tt.want {
+			t.Errorf("errorType(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
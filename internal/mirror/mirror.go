@@ -0,0 +1,215 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/logging"
+	"github.com/itsnoxius/simple-proxy/internal/metrics"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+const (
+	// defaultMaxBodyBytes is the largest request body mirrored when a domain doesn't configure one
+	defaultMaxBodyBytes = 1 << 20
+	// defaultTimeout bounds shadow requests when a domain doesn't configure a timeout
+	defaultTimeout = 5 * time.Second
+	// maxInFlight bounds concurrent shadow requests; further requests are not mirrored
+	maxInFlight = 256
+)
+
+// hopHeaders are connection specific and not copied to shadow requests
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// logger returns the logger for shadow request failures, which are part of request handling
+func logger() *slog.Logger {
+	return logging.Logger(logging.Proxy)
+}
+
+// Validate checks that a mirror configuration is usable
+func Validate(cfg *models.MirrorConfig) error {
+	target, err := url.Parse(cfg.Target)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("target must be an http or https URL, e.g. http://10.0.0.5:8080")
+	}
+	if cfg.Percent < 0 || cfg.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	if cfg.MaxBodyBytes < 0 || cfg.Timeout < 0 {
+		return fmt.Errorf("max_body_bytes and timeout must not be negative")
+	}
+	return nil
+}
+
+// Mirror sends copies of live requests to shadow targets without affecting the real responses
+type Mirror struct {
+	client   *http.Client
+	inFlight chan struct{}
+}
+
+// New creates a mirror with its own connection pool
+func New() *Mirror {
+	return &Mirror{
+		client: &http.Client{
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+			// Redirects are the client's business; the shadow response is discarded anyway
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		inFlight: make(chan struct{}, maxInFlight),
+	}
+}
+
+// Send mirrors a sampled share of requests for a domain to its shadow target. The request
+// body isn't read ahead of the real request: r.Body is replaced by a reader copying up to
+// the configured limit while the real request reads it, and the shadow request is sent
+// once the body was read completely. Requests with larger bodies, bodies that aren't read
+// to the end, and upgrades are not mirrored.
+func (m *Mirror) Send(r *http.Request, domain string, cfg *models.MirrorConfig) {
+	if cfg.Percent <= 0 || rand.Float64()*100 >= cfg.Percent || r.Header.Get("Upgrade") != "" {
+		return
+	}
+	target, err := url.Parse(cfg.Target)
+	if err != nil {
+		return
+	}
+	// The shadow request is copied now, before proxying changes the request
+	shadow := r.Clone(r.Context())
+	shadow.RequestURI = ""
+	shadow.URL.Scheme = target.Scheme
+	shadow.URL.Host = target.Host
+	shadow.GetBody = nil
+	for _, name := range hopHeaders {
+		shadow.Header.Del(name)
+	}
+
+	if r.Body == nil || r.Body == http.NoBody {
+		m.send(shadow, domain, cfg, nil)
+		return
+	}
+	limit := int64(cfg.MaxBodyBytes)
+	if limit == 0 {
+		limit = defaultMaxBodyBytes
+	}
+	if r.ContentLength > limit {
+		metrics.MirrorNotSent(domain, "skipped")
+		return
+	}
+	r.Body = &teeBody{
+		ReadCloser: r.Body,
+		limit:      limit,
+		done: func(body []byte, complete bool) {
+			if !complete {
+				metrics.MirrorNotSent(domain, "skipped")
+				return
+			}
+			m.send(shadow, domain, cfg, body)
+		},
+	}
+}
+
+// send sends a shadow request with the given body in the background, unless too many are
+// in flight already
+func (m *Mirror) send(shadow *http.Request, domain string, cfg *models.MirrorConfig, body []byte) {
+	select {
+	case m.inFlight <- struct{}{}:
+	default:
+		metrics.MirrorNotSent(domain, "dropped")
+		return
+	}
+
+	timeout := defaultTimeout
+	if cfg.Timeout > 0 {
+		timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	// The shadow request outlives the client request, so detach it from its cancellation
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(shadow.Context()), timeout)
+	shadow = shadow.WithContext(ctx)
+	shadow.Body = io.NopCloser(bytes.NewReader(body))
+	shadow.ContentLength = int64(len(body))
+	if body == nil {
+		shadow.Body = http.NoBody
+	}
+
+	go func() {
+		defer func() { <-m.inFlight }()
+		defer cancel()
+		start := time.Now()
+		resp, err := m.client.Do(shadow)
+		if err != nil {
+			logger().DebugContext(ctx, "Shadow request failed", "domain", domain, "target", shadow.URL.Host, "error", err)
+			metrics.ObserveMirror(domain, 0, time.Since(start), err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		metrics.ObserveMirror(domain, resp.StatusCode, time.Since(start), nil)
+	}()
+}
+
+// teeBody copies a request body up to a limit while it is read, and calls done once with
+// the copy when the body was read to the end, or with complete false when it was larger
+// than the limit, failed or was closed before the end
+type teeBody struct {
+	io.ReadCloser
+	limit int64
+	done  func(body []byte, complete bool)
+
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	overflow bool
+	finished bool
+}
+
+func (b *teeBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.finished && !b.overflow && n > 0 {
+		if int64(b.buf.Len()+n) > b.limit {
+			// Larger bodies aren't mirrored, so the copy is dropped instead of growing
+			b.overflow = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	switch {
+	case err == io.EOF:
+		b.finish(!b.overflow)
+	case err != nil:
+		b.finish(false)
+	}
+	return n, err
+}
+
+func (b *teeBody) Close() error {
+	b.mu.Lock()
+	b.finish(false)
+	b.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// finish calls done unless it was called already. b.mu must be held.
+func (b *teeBody) finish(complete bool) {
+	if b.finished {
+		return
+	}
+	b.finished = true
+	b.done(b.buf.Bytes(), complete)
+}
@@ -0,0 +1,134 @@
+package mirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// shadowRequest is a request received by the shadow backend
+type shadowRequest struct {
+	method, path, body, requestID string
+}
+
+// newShadow starts a shadow backend and returns a mirror configuration sending every
+// request to it, along with the requests it receives
+func newShadow(t *testing.T) (*models.MirrorConfig, <-chan shadowRequest) {
+	t.Helper()
+	received := make(chan shadowRequest, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- shadowRequest{r.Method, r.URL.Path, string(body), r.Header.Get("X-Request-ID")}
+	}))
+	t.Cleanup(backend.Close)
+	return &models.MirrorConfig{Target: backend.URL, Percent: 100, MaxBodyBytes: 8}, received
+}
+
+// next returns the next shadow request, failing if none arrives
+func next(t *testing.T, received <-chan shadowRequest) shadowRequest {
+	t.Helper()
+	select {
+	case req := <-received:
+		return req
+	case <-time.After(5 * time.Second):
+		t.Fatal("no shadow request received")
+		return shadowRequest{}
+	}
+}
+
+// proxied mirrors a request and reads its body as proxying would, returning what was read
+func proxied(t *testing.T, m *Mirror, cfg *models.MirrorConfig, method, path, body string) string {
+	t.Helper()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("X-Request-ID", path)
+	m.Send(r, "app.example.com", cfg)
+	read, err := io.ReadAll(r.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	r.Body.Close()
+	return string(read)
+}
+
+func TestSend(t *testing.T) {
+	m := New()
+	cfg, received := newShadow(t)
+
+	if got := proxied(t, m, cfg, http.MethodPost, "/small", "hello"); got != "hello" {
+		t.Errorf("proxied body = %q, want hello", got)
+	}
+	want := shadowRequest{http.MethodPost, "/small", "hello", "/small"}
+	if got := next(t, received); got != want {
+		t.Errorf("shadow request = %+v, want %+v", got, want)
+	}
+
+	// Larger bodies reach the real backend complete but aren't mirrored, whether their
+	// length is known up front or only while they are read
+	large := "hello mirror"
+	r := httptest.NewRequest(http.MethodPost, "/large", strings.NewReader(large))
+	r.ContentLength = -1
+	m.Send(r, "app.example.com", cfg)
+	if got, _ := io.ReadAll(r.Body); string(got) != large {
+		t.Errorf("proxied body = %q, want %q", got, large)
+	}
+	if got := proxied(t, m, cfg, http.MethodPost, "/large", large); got != large {
+		t.Errorf("proxied body = %q, want %q", got, large)
+	}
+	if got := proxied(t, m, cfg, http.MethodGet, "/empty", ""); got != "" {
+		t.Errorf("proxied body = %q, want none", got)
+	}
+	// The next shadow request is the one without a body, so the large ones were skipped
+	if got := next(t, received); got.path != "/empty" {
+		t.Errorf("shadow request for %s, want /empty", got.path)
+	}
+}
+
+func TestSendAfterBodyIsRead(t *testing.T) {
+	m := New()
+	cfg, received := newShadow(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/partial", strings.NewReader("hello"))
+	m.Send(r, "app.example.com", cfg)
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(r.Body, buf); err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	select {
+	case req := <-received:
+		t.Fatalf("shadow request %+v sent before the body was read", req)
+	case <-time.After(50 * time.Millisecond):
+	}
+	// A body closed before the end isn't mirrored
+	r.Body.Close()
+
+	if got := proxied(t, m, cfg, http.MethodPost, "/complete", "hello"); got != "hello" {
+		t.Errorf("proxied body = %q, want hello", got)
+	}
+	if got := next(t, received); got.path != "/complete" || got.body != "hello" {
+		t.Errorf("shadow request = %+v, want the complete one", got)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		cfg models.MirrorConfig
+		ok  bool
+	}{
+		{models.MirrorConfig{Target: "http://10.0.0.5:8080", Percent: 10}, true},
+		{models.MirrorConfig{Target: "https://shadow.example.com", Percent: 100, MaxBodyBytes: 1024, Timeout: 2}, true},
+		{models.MirrorConfig{Target: "10.0.0.5:8080", Percent: 10}, false},
+		{models.MirrorConfig{Target: "ftp://10.0.0.5", Percent: 10}, false},
+		{models.MirrorConfig{Target: "http://10.0.0.5", Percent: 101}, false},
+		{models.MirrorConfig{Target: "http://10.0.0.5", Percent: 10, Timeout: -1}, false},
+	}
+	for _, tt := range tests {
+		if err := Validate(&tt.cfg); (err == nil) != tt.ok {
+			t.Errorf("Validate(%+v) error = %v, want success %v", tt.cfg, err, tt.ok)
+		}
+	}
+}
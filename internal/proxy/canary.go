@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// canaryOverride is the header and cookie clients use to force a backend:
+// "1" routes to the canary and "0" to the primary backend
+const canaryOverride = "X-Canary"
+
+// Sticky cookie values
+const (
+	stickyCanary  = "canary"
+	stickyPrimary = "primary"
+)
+
+// ValidateCanary checks that a canary configuration is usable
+func ValidateCanary(cfg *models.CanaryConfig) error {
+	target, err := url.Parse(cfg.Target)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("target must be an http or https URL, e.g. http://10.0.0.6:8080")
+	}
+	if cfg.Weight < 0 || cfg.Weight > 100 {
+		return fmt.Errorf("weight must be between 0 and 100")
+	}
+	if cfg.StickyCookie != "" && !validCookieName(cfg.StickyCookie) {
+		return fmt.Errorf("sticky_cookie %q is not a valid cookie name", cfg.StickyCookie)
+	}
+	if cfg.StickyTTL < 0 {
+		return fmt.Errorf("sticky_ttl must not be negative")
+	}
+	return nil
+}
+
+// validCookieName reports whether name can be used as a cookie name
+func validCookieName(name string) bool {
+	return (&http.Cookie{Name: name, Value: stickyCanary}).Valid() == nil
+}
+
+// chooseCanary decides whether a request goes to the canary backend. An explicit override
+// wins, then the sticky cookie, then the configured weight. When a sticky cookie is
+// configured, weighted choices are remembered by setting it on the response. Stickiness
+// is ignored at weights 0 and 100, so rollbacks and completed rollouts apply to everyone.
+func chooseCanary(w http.ResponseWriter, r *http.Request, cfg *models.CanaryConfig) bool {
+	if canary, ok := parseOverride(r.Header.Get(canaryOverride)); ok {
+		return canary
+	}
+	if cookie, err := r.Cookie(canaryOverride); err == nil {
+		if canary, ok := parseOverride(cookie.Value); ok {
+			return canary
+		}
+	}
+
+	if cfg.Weight <= 0 {
+		return false
+	}
+	if cfg.Weight >= 100 {
+		return true
+	}
+
+	if cfg.StickyCookie != "" {
+		if cookie, err := r.Cookie(cfg.StickyCookie); err == nil {
+			switch cookie.Value {
+			case stickyCanary:
+				return true
+			case stickyPrimary:
+				return false
+			}
+		}
+	}
+
+	canary := rand.Float64()*100 < cfg.Weight
+	if cfg.StickyCookie != "" {
+		value := stickyPrimary
+		if canary {
+			value = stickyCanary
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     cfg.StickyCookie,
+			Value:    value,
+			Path:     "/",
+			MaxAge:   cfg.StickyTTL,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return canary
+}
+
+// parseOverride interprets the value of an override header or cookie
+func parseOverride(value string) (canary, ok bool) {
+	switch value {
+	case "1", "true":
+		return true, true
+	case "0", "false":
+		return false, true
+	}
+	return false, false
+}
+
+// canaryBackend returns a copy of a domain that proxies to its canary target. Upstream TLS
+// settings are shared with the primary backend. Canary responses bypass the response cache,
+// so they are never served to clients of the primary backend.
+func canaryBackend(domain *models.Domain) (*models.Domain, error) {
+	target, err := url.Parse(domain.Canary.Target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse canary target: %w", err)
+	}
+	canary, err := urlBackend(domain, domain.Domain+"#canary", target)
+	if err != nil {
+		return nil, err
+	}
+	canary.Cache = nil
+	return canary, nil
+}
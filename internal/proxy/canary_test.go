@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// countingBackend returns a backend answering with its name and a cacheable response,
+// and the number of requests it received
+func countingBackend(t *testing.T, name string) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	hits := new(atomic.Int32)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, name)
+	}))
+	t.Cleanup(backend.Close)
+	return backend, hits
+}
+
+// canaryDomain returns a domain proxying to primary with a canary at the given weight
+func canaryDomain(primary, canary *httptest.Server, weight float64) models.CreateDomainRequest {
+	return models.CreateDomainRequest{
+		Domain:   "app.example.com",
+		IP:       "127.0.0.1",
+		Port:     primary.Listener.Addr().(*net.TCPAddr).Port,
+		Protocol: "http",
+		DomainOptions: models.DomainOptions{
+			Canary: &models.CanaryConfig{Target: canary.URL, Weight: weight},
+		},
+	}
+}
+
+func TestCanaryWeights(t *testing.T) {
+	const requests = 1000
+	tests := []struct {
+		weight   float64
+		min, max int32
+	}{
+		{0, 0, 0},
+		// Three standard deviations are about 43 requests, so this fails spuriously far less than once in a million runs
+		{30, 230, 370},
+		{100, requests, requests},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.weight), func(t *testing.T) {
+			primary, primaryHits := countingBackend(t, "primary")
+			canary, canaryHits := countingBackend(t, "canary")
+			p, _ := newTestProxy(t, canaryDomain(primary, canary, tt.weight))
+
+			for i := 0; i < requests; i++ {
+				if w := get(p, "app.example.com", "/"); w.Code != http.StatusOK {
+					t.Fatalf("status = %d, want 200", w.Code)
+				}
+			}
+			if got := canaryHits.Load(); got < tt.min || got > tt.max {
+				t.Errorf("canary received %d of %d requests, want %d to %d", got, requests, tt.min, tt.max)
+			}
+			if got := primaryHits.Load() + canaryHits.Load(); got != requests {
+				t.Errorf("backends received %d requests, want %d", got, requests)
+			}
+		})
+	}
+}
+
+func TestCanaryOverride(t *testing.T) {
+	primary, _ := countingBackend(t, "primary")
+	canary, _ := countingBackend(t, "canary")
+	p, _ := newTestProxy(t, canaryDomain(primary, canary, 50))
+
+	for value, want := range map[string]string{"1": "canary", "true": "canary", "0": "primary", "false": "primary"} {
+		for i := 0; i < 10; i++ {
+			r := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+			r.Header.Set(canaryOverride, value)
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if body := w.Body.String(); body != want {
+				t.Fatalf("%s: %s routed to %q, want %q", canaryOverride, value, body, want)
+			}
+		}
+	}
+}
+
+func TestCanaryBypassesCache(t *testing.T) {
+	primary, primaryHits := countingBackend(t, "primary")
+	canary, canaryHits := countingBackend(t, "canary")
+	domain := canaryDomain(primary, canary, 50)
+	domain.Cache = &models.CacheConfig{Enabled: true}
+	p, _ := newTestProxy(t, domain)
+
+	request := func(override string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "http://app.example.com/page", nil)
+		r.Header.Set(canaryOverride, override)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	// Canary responses are neither stored nor served from the cache
+	for i := 0; i < 2; i++ {
+		if w := request("1"); w.Body.String() != "canary" || w.Header().Get("X-Cache") != "" {
+			t.Fatalf("canary request %d: body %q, X-Cache %q, want an uncached canary response", i, w.Body.String(), w.Header().Get("X-Cache"))
+		}
+	}
+	if got := canaryHits.Load(); got != 2 {
+		t.Errorf("canary received %d requests, want 2", got)
+	}
+
+	for i, want := range []string{"MISS", "HIT"} {
+		w := request("0")
+		if w.Body.String() != "primary" || w.Header().Get("X-Cache") != want {
+			t.Errorf("primary request %d: body %q, X-Cache %q, want primary and %s", i, w.Body.String(), w.Header().Get("X-Cache"), want)
+		}
+	}
+	if got := primaryHits.Load(); got != 1 {
+		t.Errorf("primary received %d requests, want 1", got)
+	}
+	if w := request("1"); w.Body.String() != "canary" {
+		t.Errorf("canary request after caching the primary response got %q", w.Body.String())
+	}
+}
@@ -0,0 +1,202 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// Default headers used to pass the verified client identity to the backend
+const (
+	defaultClientSubjectHeader     = "X-Client-Cert-Subject"
+	defaultClientSANsHeader        = "X-Client-Cert-SANs"
+	defaultClientFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+// caPoolCache keeps parsed client CA bundles per domain so handshakes don't re-parse PEM
+type caPoolCache struct {
+	mu    sync.Mutex
+	pools map[string]*cachedCAPool
+}
+
+type cachedCAPool struct {
+	pem  string
+	pool *x509.CertPool
+}
+
+func newCAPoolCache() *caPoolCache {
+	return &caPoolCache{pools: make(map[string]*cachedCAPool)}
+}
+
+// get returns the CA pool for a domain's client auth settings
+func (c *caPoolCache) get(domain string, cfg *models.ClientAuthConfig) (*x509.CertPool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.pools[domain]; ok && cached.pem == cfg.CACert {
+		return cached.pool, nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(cfg.CACert)) {
+		return nil, fmt.Errorf("ca_cert does not contain any valid PEM certificates")
+	}
+	c.pools[domain] = &cachedCAPool{pem: cfg.CACert, pool: pool}
+	return pool, nil
+}
+
+// ValidateClientAuth checks that a domain's client auth settings are usable
+func ValidateClientAuth(cfg *models.ClientAuthConfig) error {
+	if cfg == nil {
+		return nil
+	}
+	if cfg.CACert == "" {
+		return fmt.Errorf("ca_cert is required")
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM([]byte(cfg.CACert)) {
+		return fmt.Errorf("ca_cert does not contain any valid PEM certificates")
+	}
+	for _, patterns := range [][]string{cfg.AllowSubjects, cfg.AllowSANs, cfg.DenySubjects, cfg.DenySANs} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// TLSConfigForClient returns a tls.Config GetConfigForClient callback that requests
+// client certificates for domains with client auth configured, based on the SNI name.
+func (p *Proxy) TLSConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		if hello.ServerName == "" {
+			return nil, nil
+		}
+		domain, err := p.db.GetDomain(strings.ToLower(hello.ServerName))
+		if err != nil {
+			tlsLogger().Error("Failed to lookup domain for TLS handshake", "server_name", hello.ServerName, "error", err)
+			return nil, nil
+		}
+		if domain == nil || domain.ClientAuth == nil {
+			return nil, nil
+		}
+
+		pool, err := p.caPools.get(domain.Domain, domain.ClientAuth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client auth configuration for %s: %w", domain.Domain, err)
+		}
+
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = pool
+		tlsLogger().Debug("Requesting client certificate", "domain", domain.Domain)
+		return config, nil
+	}
+}
+
+// authorizeClient enforces a domain's client auth settings on a request and sets the
+// identity headers for the backend. It returns an error describing why access was denied.
+// The certificate is verified again here since the Host header need not match the SNI name.
+func (p *Proxy) authorizeClient(r *http.Request, domain *models.Domain) error {
+	cfg := domain.ClientAuth
+	headers := clientAuthHeaderNames(cfg)
+
+	// Never pass through identity headers supplied by the client
+	for _, header := range headers {
+		r.Header.Del(header)
+	}
+	if cfg == nil {
+		return nil
+	}
+
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return fmt.Errorf("client certificate required")
+	}
+
+	pool, err := p.caPools.get(domain.Domain, cfg)
+	if err != nil {
+		return err
+	}
+	cert := r.TLS.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:         pool,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("client certificate not trusted: %w", err)
+	}
+
+	subjects := []string{cert.Subject.String(), cert.Subject.CommonName}
+	sans := certificateSANs(cert)
+
+	if matchAny(cfg.DenySubjects, subjects) || matchAny(cfg.DenySANs, sans) {
+		return fmt.Errorf("client certificate denied")
+	}
+	if len(cfg.AllowSubjects) > 0 || len(cfg.AllowSANs) > 0 {
+		if !matchAny(cfg.AllowSubjects, subjects) && !matchAny(cfg.AllowSANs, sans) {
+			return fmt.Errorf("client certificate not allowed")
+		}
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	r.Header.Set(headers[0], cert.Subject.String())
+	if len(sans) > 0 {
+		r.Header.Set(headers[1], strings.Join(sans, ","))
+	}
+	r.Header.Set(headers[2], hex.EncodeToString(fingerprint[:]))
+	return nil
+}
+
+// clientAuthHeaderNames returns the subject, SANs and fingerprint header names for a domain
+func clientAuthHeaderNames(cfg *models.ClientAuthConfig) []string {
+	names := []string{defaultClientSubjectHeader, defaultClientSANsHeader, defaultClientFingerprintHeader}
+	if cfg == nil {
+		return names
+	}
+	for i, name := range []string{cfg.Headers.Subject, cfg.Headers.SANs, cfg.Headers.Fingerprint} {
+		if name != "" {
+			names[i] = name
+		}
+	}
+	return names
+}
+
+// certificateSANs returns all subject alternative names of a certificate
+func certificateSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return sans
+}
+
+// matchAny reports whether any value matches any of the patterns
+func matchAny(patterns, values []string) bool {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if ok, _ := path.Match(pattern, value); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/accesslog"
+	"github.com/itsnoxius/simple-proxy/internal/metrics"
+	"github.com/itsnoxius/simple-proxy/internal/requestid"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// requestInfo collects what the access log needs to know about how a request was handled.
+// It is guarded by a mutex since background cache revalidations may still reach the
+// upstream after the request has been logged.
+type requestInfo struct {
+	mu              sync.Mutex
+	domain          *models.Domain
+	upstream        string
+	upstreamLatency time.Duration
+	attempts        int
+}
+
+func (i *requestInfo) setDomain(domain *models.Domain) {
+	i.mu.Lock()
+	i.domain = domain
+	i.mu.Unlock()
+}
+
+// nextAttempt returns the number of upstream attempts made so far and counts a new one
+func (i *requestInfo) nextAttempt() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.attempts++
+	return i.attempts - 1
+}
+
+func (i *requestInfo) addUpstream(upstream string, latency time.Duration) {
+	i.mu.Lock()
+	i.upstream = upstream
+	i.upstreamLatency += latency
+	i.mu.Unlock()
+}
+
+// snapshot returns the recorded values
+func (i *requestInfo) snapshot() (domain *models.Domain, upstream string, upstreamLatency time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.domain, i.upstream, i.upstreamLatency
+}
+
+// timedTransport records the upstream address and the time until response headers arrive,
+// tracing each attempt in its own span
+type timedTransport struct {
+	next     http.RoundTripper
+	domain   string
+	upstream string
+	info     *requestInfo
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req, span := startClientSpan(req, t.domain, t.upstream, t.info.nextAttempt())
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	latency := time.Since(start)
+	endClientSpan(span, resp, err)
+	t.info.addUpstream(t.upstream, latency)
+	metrics.ObserveUpstream(t.domain, t.upstream, latency, err)
+	return resp, err
+}
+
+// loggingWriter records the status code and number of body bytes sent to the client
+type loggingWriter struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+}
+
+func (lw *loggingWriter) WriteHeader(status int) {
+	if lw.status == 0 && status >= 200 {
+		lw.status = status
+	}
+	lw.ResponseWriter.WriteHeader(status)
+}
+
+func (lw *loggingWriter) Write(b []byte) (int, error) {
+	if lw.status == 0 {
+		lw.status = http.StatusOK
+	}
+	n, err := lw.ResponseWriter.Write(b)
+	lw.bytes += int64(n)
+	return n, err
+}
+
+func (lw *loggingWriter) Flush() {
+	http.NewResponseController(lw.ResponseWriter).Flush()
+}
+
+// Hijack marks the request as upgraded, since the response is then written directly
+// to the connection
+func (lw *loggingWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(lw.ResponseWriter).Hijack()
+	if err == nil {
+		lw.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// statusCode returns the status sent to the client
+func (lw *loggingWriter) statusCode() int {
+	switch {
+	case lw.hijacked:
+		return http.StatusSwitchingProtocols
+	case lw.status == 0:
+		return http.StatusOK
+	}
+	return lw.status
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (lw *loggingWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// recordRequest writes the access log record and metrics for a completed request
+func (p *Proxy) recordRequest(r *http.Request, lw *loggingWriter, info *requestInfo, start time.Time) {
+	duration := time.Since(start)
+	domain, upstream, upstreamLatency := info.snapshot()
+
+	domainLabel := metrics.Unmatched
+	if domain != nil {
+		domainLabel = domain.Domain
+	}
+	metrics.ObserveRequest(domainLabel, upstream, lw.statusCode(), duration)
+
+	if p.accessLogs == nil {
+		return
+	}
+	accessLogger := p.accessLogger(domain)
+	if accessLogger == nil {
+		return
+	}
+
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	path := r.RequestURI
+	if path == "" {
+		path = r.URL.RequestURI()
+	}
+
+	accessLogger.Log(&accesslog.Record{
+		Time:            start,
+		ClientIP:        clientIP,
+		Host:            r.Host,
+		Method:          r.Method,
+		Path:            path,
+		Protocol:        r.Proto,
+		Status:          lw.statusCode(),
+		Bytes:           lw.bytes,
+		Upstream:        upstream,
+		UpstreamLatency: upstreamLatency,
+		Duration:        duration,
+		RequestID:       requestid.FromContext(r.Context()),
+		Referer:         r.Referer(),
+		UserAgent:       r.UserAgent(),
+	})
+}
+
+// accessLogger returns the logger for a domain, or the global logger for unknown domains.
+// It returns nil if access logging is disabled for the request.
+func (p *Proxy) accessLogger(domain *models.Domain) *accesslog.Logger {
+	var name string
+	var override *models.AccessLogConfig
+	if domain != nil {
+		name, override = domain.Domain, domain.AccessLog
+	}
+	accessLogger, err := p.accessLogs.Logger(name, override)
+	if err != nil {
+		logger().Error("Failed to open access log, using the global access log", "domain", name, "output", override.Output, "error", err)
+	}
+	return accessLogger
+}
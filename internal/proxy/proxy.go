@@ -3,55 +3,95 @@ package proxy
 import (
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/itsnoxius/simple-proxy/internal/accesslog"
+	"github.com/itsnoxius/simple-proxy/internal/cache"
+	"github.com/itsnoxius/simple-proxy/internal/compress"
 	"github.com/itsnoxius/simple-proxy/internal/database"
+	"github.com/itsnoxius/simple-proxy/internal/logging"
+	"github.com/itsnoxius/simple-proxy/internal/metrics"
+	"github.com/itsnoxius/simple-proxy/internal/mirror"
+	"github.com/itsnoxius/simple-proxy/internal/requestid"
+	"github.com/itsnoxius/simple-proxy/internal/static"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
 )
 
 // Proxy handles HTTP reverse proxy requests
 type Proxy struct {
-	db    *database.DB
-	debug bool
+	db         *database.DB
+	cache      *cache.Cache
+	transports *transportCache
+	caPools    *caPoolCache
+	pools      *poolCache
+	accessLogs *accesslog.Manager
+	mirror     *mirror.Mirror
 }
 
 // New creates a new proxy instance
-func New(db *database.DB, debug bool) *Proxy {
-	p := &Proxy{db: db, debug: debug}
-	if debug {
-		log.Printf("[DEBUG] Creating new proxy instance")
+func New(db *database.DB, responseCache *cache.Cache, accessLogs *accesslog.Manager) *Proxy {
+	p := &Proxy{
+		db:         db,
+		cache:      responseCache,
+		transports: newTransportCache(),
+		caPools:    newCAPoolCache(),
+		pools:      newPoolCache(),
+		accessLogs: accessLogs,
+		mirror:     mirror.New(),
 	}
+	logger().Debug("Creating new proxy instance")
 	return p
 }
 
-// debugLog logs a debug message only if debug mode is enabled
-func (p *Proxy) debugLog(format string, v ...interface{}) {
-	if p.debug {
-		log.Printf("[DEBUG] "+format, v...)
-	}
+// logger returns the proxy subsystem logger
+func logger() *slog.Logger {
+	return logging.Logger(logging.Proxy)
+}
+
+// tlsLogger returns the TLS subsystem logger
+func tlsLogger() *slog.Logger {
+	return logging.Logger(logging.TLS)
 }
 
 // ServeHTTP handles incoming HTTP requests and proxies them to the configured backend
 func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p.debugLog("=== Proxy Handler Called ===")
-	p.debugLog("Method: %s", r.Method)
-	p.debugLog("Host: %s", r.Host)
-	p.debugLog("URL.Path: %s", r.URL.Path)
-	p.debugLog("URL.RawPath: %s", r.URL.RawPath)
-	p.debugLog("URL.RawQuery: %s", r.URL.RawQuery)
-	p.debugLog("URL.Fragment: %s", r.URL.Fragment)
-	p.debugLog("URL.String(): %s", r.URL.String())
-	p.debugLog("RequestURI: %s", r.RequestURI)
-	p.debugLog("RemoteAddr: %s", r.RemoteAddr)
+	start := time.Now()
+	r, span := startServerSpan(r)
+	lw := &loggingWriter{ResponseWriter: w}
+	info := &requestInfo{}
+	p.serve(lw, r, info)
+	p.recordRequest(r, lw, info, start)
+
+	var domainName string
+	if domain, _, _ := info.snapshot(); domain != nil {
+		domainName = domain.Domain
+	}
+	endServerSpan(span, domainName, lw.statusCode())
+}
+
+// serve handles a request, recording how it was handled in info
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request, info *requestInfo) {
+	logger().DebugContext(r.Context(), "Proxy handler called",
+		"method", r.Method,
+		"host", r.Host,
+		"path", r.URL.Path,
+		"raw_path", r.URL.RawPath,
+		"raw_query", r.URL.RawQuery,
+		"fragment", r.URL.Fragment,
+		"request_uri", r.RequestURI,
+		"remote_addr", r.RemoteAddr)
 
 	// Extract domain from Host header
 	host := r.Host
 	if host == "" {
-		log.Printf("[ERROR] Missing Host header from %s", r.RemoteAddr)
-		http.Error(w, "Missing Host header", http.StatusBadRequest)
+		logger().ErrorContext(r.Context(), "Missing Host header", "remote_addr", r.RemoteAddr)
+		requestid.Error(w, r, "Missing Host header", http.StatusBadRequest)
 		return
 	}
 
@@ -59,43 +99,106 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	domainName := host
 	if idx := strings.LastIndex(host, ":"); idx != -1 {
 		domainName = host[:idx]
-		p.debugLog("Stripped port from host: %s -> %s", host, domainName)
+		logger().DebugContext(r.Context(), "Stripped port from host", "host", host, "domain", domainName)
 	}
 
-	p.debugLog("Looking up domain: %s", domainName)
+	logger().DebugContext(r.Context(), "Looking up domain", "domain", domainName)
 	// Lookup domain in database
 	domain, err := p.db.GetDomain(domainName)
 	if err != nil {
-		log.Printf("[ERROR] Failed to lookup domain in database: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		logger().ErrorContext(r.Context(), "Failed to lookup domain in database", "domain", domainName, "error", err)
+		requestid.Error(w, r, "Internal server error", http.StatusInternalServerError)
 		return
 	}
 
 	if domain == nil {
-		http.Error(w, "Domain not found", http.StatusNotFound)
+		requestid.Error(w, r, "Domain not found", http.StatusNotFound)
+		return
+	}
+	info.setDomain(domain)
+	defer metrics.TrackInFlight(domain.Domain)()
+
+	if err := p.authorizeClient(r, domain); err != nil {
+		tlsLogger().WarnContext(r.Context(), "Client certificate rejected", "domain", domainName, "remote_addr", r.RemoteAddr, "error", err)
+		requestid.Error(w, r, "Forbidden: "+err.Error(), http.StatusForbidden)
 		return
 	}
 
+	// Static domains serve files directly instead of proxying
+	if domain.Static != nil {
+		logger().DebugContext(r.Context(), "Serving static file", "path", r.URL.Path, "root", domain.Static.Root)
+		static.Serve(w, r, domain.Static)
+		return
+	}
+
+	// Shadow requests are prepared before proxying and sent once it has read the request body
+	if domain.Mirror != nil {
+		p.mirror.Send(r, domain.Domain, domain.Mirror)
+	}
+
 	// Set default protocol if not specified
 	if domain.Protocol == "" {
 		domain.Protocol = "http"
 	}
 
-	p.debugLog("Found domain record: %s -> %s:%d (%s)", domainName, domain.IP, domain.Port, domain.Protocol)
+	backend := domain
+	var balanced *balancedTransport
+	switch {
+	case domain.Canary != nil && chooseCanary(w, r, domain.Canary):
+		backend, err = canaryBackend(domain)
+		if err != nil {
+			logger().ErrorContext(r.Context(), "Invalid canary configuration", "domain", domainName, "error", err)
+			requestid.Error(w, r, "Invalid target configuration", http.StatusInternalServerError)
+			return
+		}
+		logger().DebugContext(r.Context(), "Routing request to canary", "domain", domainName, "backend", backendAddress(backend))
+	case !domain.Upstreams.IsZero():
+		pool, err := p.pools.get(domain)
+		if err != nil {
+			logger().ErrorContext(r.Context(), "Invalid upstreams configuration", "domain", domainName, "error", err)
+			requestid.Error(w, r, "Invalid target configuration", http.StatusInternalServerError)
+			return
+		}
+		balanced = &balancedTransport{pool: pool, domain: domain.Domain, info: info, target: pool.pick(r, domain.Upstreams.Affinity)}
+		// All targets share one transport, since they share the domain's upstream TLS settings
+		backend, err = urlBackend(domain, domain.Domain+"#upstreams", pool.targets[balanced.target].url)
+		if err != nil {
+			logger().ErrorContext(r.Context(), "Invalid upstreams configuration", "domain", domainName, "error", err)
+			requestid.Error(w, r, "Invalid target configuration", http.StatusInternalServerError)
+			return
+		}
+	}
 
-	// Build target URL
-	targetURL := fmt.Sprintf("%s://%s:%d", domain.Protocol, domain.IP, domain.Port)
-	p.debugLog("Target URL: %s", targetURL)
+	// Build target URL. Socket targets are dialed by the transport, so the URL carries the
+	// requested domain as its host.
+	targetURL := fmt.Sprintf("%s://%s:%d", backend.Protocol, backend.IP, backend.Port)
+	if backend.Target != "" {
+		targetURL = fmt.Sprintf("%s://%s", backend.Protocol, domainName)
+	}
+	logger().DebugContext(r.Context(), "Found domain record", "domain", domainName, "backend", backendAddress(backend),
+		"protocol", backend.Protocol, "target_url", targetURL)
 	target, err := url.Parse(targetURL)
 	if err != nil {
-		log.Printf("[ERROR] Failed to parse target URL %s: %v", targetURL, err)
-		http.Error(w, "Invalid target configuration", http.StatusInternalServerError)
+		logger().ErrorContext(r.Context(), "Failed to parse target URL", "target_url", targetURL, "error", err)
+		requestid.Error(w, r, "Invalid target configuration", http.StatusInternalServerError)
+		return
+	}
+
+	transport, err := p.transports.get(backend)
+	if err != nil {
+		logger().ErrorContext(r.Context(), "Failed to build transport", "domain", domainName, "error", err)
+		requestid.Error(w, r, "Invalid target configuration", http.StatusInternalServerError)
 		return
 	}
-	p.debugLog("Parsed target: %s", target.String())
 
 	// Create reverse proxy
 	proxy := httputil.NewSingleHostReverseProxy(target)
+	if balanced != nil {
+		balanced.next = transport
+		proxy.Transport = balanced
+	} else {
+		proxy.Transport = &timedTransport{next: transport, domain: domain.Domain, upstream: backendAddress(backend), info: info}
+	}
 
 	// Modify the request to preserve the full original path and query parameters
 	// We override the director to ensure the complete path is preserved exactly as received
@@ -116,24 +219,94 @@ func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		// Clear RequestURI as it's not valid in client requests
 		req.RequestURI = ""
 
-		p.debugLog("Director: Modified request URL to %s", req.URL.String())
-		p.debugLog("Director: req.URL.Path=%s, req.URL.RawPath=%s", req.URL.Path, req.URL.RawPath)
-		p.debugLog("Director: req.URL.RawQuery=%s, req.URL.Fragment=%s", req.URL.RawQuery, req.URL.Fragment)
-		p.debugLog("Director: req.Host=%s, req.Method=%s", req.Host, req.Method)
-		p.debugLog("Director: req.Proto=%s, req.ProtoMajor=%d", req.Proto, req.ProtoMajor)
-		p.debugLog("Director: Request headers count: %d", len(req.Header))
+		logger().DebugContext(req.Context(), "Director modified request",
+			"url", req.URL.String(),
+			"path", req.URL.Path,
+			"raw_path", req.URL.RawPath,
+			"host", req.Host,
+			"method", req.Method,
+			"proto", req.Proto,
+			"headers", len(req.Header))
+	}
+
+	// The client's request ID is returned to the client, replacing any the backend echoes.
+	// Clients without an affinity cookie for the target that answered are pinned to it.
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		resp.Header.Del(requestid.Header)
+		if balanced != nil {
+			if affinity := domain.Upstreams.Affinity; affinity != nil && affinity.Mode == affinityCookie {
+				cookie := balanced.pool.affinityCookie(balanced.target, affinity)
+				if current, err := r.Cookie(cookie.Name); err != nil || current.Value != cookie.Value {
+					resp.Header.Add("Set-Cookie", cookie.String())
+				}
+			}
+		}
+		return nil
 	}
 
 	// Handle errors
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
-		log.Printf("[ERROR] Proxy error for %s %s: %v", r.Method, r.URL.String(), err)
-		http.Error(w, "Proxy error: "+err.Error(), http.StatusBadGateway)
+		logger().ErrorContext(r.Context(), "Proxy error", "method", r.Method, "url", r.URL.String(), "error", err)
+		requestid.Error(w, r, "Proxy error: "+err.Error(), http.StatusBadGateway)
 	}
 
 	// Serve the request
-	p.debugLog("Proxying request %s %s to %s", r.Method, r.URL.String(), targetURL)
-	proxy.ServeHTTP(w, r)
-	p.debugLog("Completed proxying request %s %s", r.Method, r.URL.String())
+	logger().DebugContext(r.Context(), "Proxying request", "method", r.Method, "url", r.URL.String(), "target_url", targetURL)
+	p.handlerFor(domain.Domain, backend, proxy).ServeHTTP(w, r)
+	logger().DebugContext(r.Context(), "Completed proxying request", "method", r.Method, "url", r.URL.String())
+}
+
+// handlerFor wraps the reverse proxy with the response handling enabled for a backend.
+// Responses are cached under the requested domain name rather than the backend's, which
+// may be renamed for the transport cache, so purging the domain clears them.
+// Compression is applied outside the cache, so cached responses are stored uncompressed.
+func (p *Proxy) handlerFor(name string, domain *models.Domain, next http.Handler) http.Handler {
+	handler := next
+	if cfg := domain.Cache; cfg != nil && cfg.Enabled && p.cache != nil {
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p.cache.Serve(w, r, name, cfg, inner)
+		})
+	}
+	if cfg := domain.Compression; cfg != nil && cfg.Enabled {
+		inner := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			compress.Serve(w, r, cfg, inner)
+		})
+	}
+	return handler
+}
+
+// backendAddress describes where a domain's requests are sent, for logging
+func backendAddress(domain *models.Domain) string {
+	if domain.Target != "" {
+		return domain.Target
+	}
+	return fmt.Sprintf("%s:%d", domain.IP, domain.Port)
+}
+
+// urlBackend returns a copy of a domain that proxies to target, an http or https URL.
+// The copy is given its own name, so the transport cache keeps its transport separately.
+func urlBackend(domain *models.Domain, name string, target *url.URL) (*models.Domain, error) {
+	port := target.Port()
+	if port == "" {
+		port = "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+	}
+	portNumber, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q in %s", port, target)
+	}
+
+	backend := *domain
+	backend.Domain = name
+	backend.IP = target.Hostname()
+	backend.Port = portNumber
+	backend.Protocol = target.Scheme
+	backend.Target = ""
+	return &backend, nil
 }
 
 // HealthCheck handles health check requests
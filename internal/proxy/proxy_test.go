@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/cache"
+	"github.com/itsnoxius/simple-proxy/internal/database"
+	"github.com/itsnoxius/simple-proxy/internal/requestid"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// newTestProxy returns a proxy with a response cache, serving the given domains from a
+// temporary database
+func newTestProxy(t *testing.T, domains ...models.CreateDomainRequest) (*Proxy, *cache.Cache) {
+	t.Helper()
+	db, err := database.New(filepath.Join(t.TempDir(), "proxy.db"))
+	if err != nil {
+		t.Fatalf("database.New: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, d := range domains {
+		if _, err := db.CreateDomain(models.Actor{}, d); err != nil {
+			t.Fatalf("CreateDomain(%s): %v", d.Domain, err)
+		}
+	}
+	responseCache := cache.New(cache.NewMemoryStore(1 << 20))
+	return New(db, responseCache, nil), responseCache
+}
+
+// get sends a GET request for a domain through the proxy
+func get(p *Proxy, domain, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://"+domain+path, nil))
+	return w
+}
+
+func TestPurgeClearsMultiTargetDomain(t *testing.T) {
+	var hits atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "response %d", hits.Add(1))
+	}))
+	defer backend.Close()
+
+	p, responseCache := newTestProxy(t, models.CreateDomainRequest{
+		Domain: "multi.example.com",
+		DomainOptions: models.DomainOptions{
+			Upstreams: &models.UpstreamsConfig{Targets: []string{backend.URL}},
+			Cache:     &models.CacheConfig{Enabled: true},
+		},
+	})
+
+	for i, want := range []string{"MISS", "HIT"} {
+		w := get(p, "multi.example.com", "/page")
+		if got := w.Header().Get("X-Cache"); got != want {
+			t.Fatalf("request %d: X-Cache = %q, want %q", i, got, want)
+		}
+		if body := w.Body.String(); body != "response 1" {
+			t.Fatalf("request %d: body = %q, want %q", i, body, "response 1")
+		}
+	}
+
+	if purged := responseCache.Purge("multi.example.com", "", ""); purged != 1 {
+		t.Fatalf("Purge removed %d entries, want 1", purged)
+	}
+	w := get(p, "multi.example.com", "/page")
+	if got := w.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("after purge: X-Cache = %q, want MISS", got)
+	}
+	if body := w.Body.String(); body != "response 2" {
+		t.Errorf("after purge: body = %q, want %q", body, "response 2")
+	}
+}
+
+func TestRequestIDPropagation(t *testing.T) {
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(requestid.Header)
+		// Backends that generate their own IDs must not replace the client's
+		w.Header().Set(requestid.Header, "backend-generated")
+	}))
+	defer backend.Close()
+	p, _ := newTestProxy(t, models.CreateDomainRequest{Domain: "app.example.com", IP: "127.0.0.1",
+		Port: backend.Listener.Addr().(*net.TCPAddr).Port})
+
+	w := httptest.NewRecorder()
+	requestid.Middleware(nil)(p).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil))
+	id := w.Header().Get(requestid.Header)
+	if id == "" || id == "backend-generated" {
+		t.Fatalf("response request ID = %q, want the generated one", id)
+	}
+	if values := w.Header().Values(requestid.Header); len(values) != 1 {
+		t.Errorf("response has request IDs %q, want one", values)
+	}
+	if got := <-received; got != id {
+		t.Errorf("backend received request ID %q, want %q", got, id)
+	}
+}
+
+func TestMirrorSendsProxiedBody(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer backend.Close()
+	shadowed := make(chan string, 1)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowed <- string(body)
+	}))
+	defer shadow.Close()
+
+	p, _ := newTestProxy(t, models.CreateDomainRequest{
+		Domain: "app.example.com",
+		DomainOptions: models.DomainOptions{
+			Upstreams: &models.UpstreamsConfig{Targets: []string{backend.URL}},
+			Mirror:    &models.MirrorConfig{Target: shadow.URL, Percent: 100},
+		},
+	})
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "http://app.example.com/orders", strings.NewReader("payload")))
+	if w.Code != http.StatusOK || w.Body.String() != "payload" {
+		t.Fatalf("response %d %q, want the backend to echo the complete body", w.Code, w.Body)
+	}
+	select {
+	case body := <-shadowed:
+		if body != "payload" {
+			t.Errorf("shadow body = %q, want payload", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no shadow request received")
+	}
+}
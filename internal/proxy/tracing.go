@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/itsnoxius/simple-proxy/internal/tracing"
+)
+
+// Span attributes specific to the proxy
+var (
+	domainKey   = attribute.Key("proxy.domain")
+	upstreamKey = attribute.Key("proxy.upstream")
+)
+
+// startServerSpan starts the span covering a whole request, continuing the trace
+// propagated by the client if there is one
+func startServerSpan(r *http.Request) (*http.Request, trace.Span) {
+	ctx := tracing.Propagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	ctx, span := tracing.Tracer().Start(ctx, r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			semconv.ServerAddress(r.Host),
+			semconv.ClientAddress(clientIP),
+		),
+	)
+	return r.WithContext(ctx), span
+}
+
+// endServerSpan records the outcome of a request on its span and ends it
+func endServerSpan(span trace.Span, domain string, status int) {
+	if domain != "" {
+		span.SetAttributes(domainKey.String(domain))
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+	if status >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
+
+// startClientSpan starts the span for one upstream attempt and injects its context into
+// a copy of the outgoing request. attempt counts from zero; later attempts are resends.
+func startClientSpan(req *http.Request, domain, upstream string, attempt int) (*http.Request, trace.Span) {
+	attributes := []attribute.KeyValue{
+		semconv.HTTPRequestMethodKey.String(req.Method),
+		semconv.URLFull(req.URL.String()),
+		domainKey.String(domain),
+		upstreamKey.String(upstream),
+	}
+	if attempt > 0 {
+		attributes = append(attributes, semconv.HTTPRequestResendCount(attempt))
+	}
+	ctx, span := tracing.Tracer().Start(req.Context(), req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributes...),
+	)
+	if span.SpanContext().IsValid() {
+		req = req.Clone(ctx)
+		tracing.Propagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	}
+	return req, span
+}
+
+// endClientSpan records the outcome of an upstream attempt on its span and ends it
+func endClientSpan(span trace.Span, resp *http.Response, err error) {
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case resp != nil:
+		span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+		}
+	}
+	span.End()
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// clientTraceparent is the trace context sent by the client in the tests
+const clientTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// recordSpans installs a tracer provider recording every span until the test ends
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+		provider.Shutdown(t.Context())
+	})
+	return recorder
+}
+
+// spanOfKind returns the only ended span of a kind
+func spanOfKind(t *testing.T, recorder *tracetest.SpanRecorder, kind trace.SpanKind) sdktrace.ReadOnlySpan {
+	t.Helper()
+	var found []sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.SpanKind() == kind {
+			found = append(found, span)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("%d ended %s spans, want 1", len(found), kind)
+	}
+	return found[0]
+}
+
+// attributeValue returns the value of a span attribute, or an invalid value if it isn't set
+func attributeValue(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracing(t *testing.T) {
+	received := make(chan string, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("Traceparent")
+	}))
+	defer backend.Close()
+	port := backend.Listener.Addr().(*net.TCPAddr).Port
+	// A closed port makes the upstream attempt fail
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedPort := closed.Listener.Addr().(*net.TCPAddr).Port
+	closed.Close()
+
+	tests := []struct {
+		name   string
+		port   int
+		status int
+		code   codes.Code
+	}{
+		{"proxied", port, http.StatusOK, codes.Unset},
+		{"upstream down", closedPort, http.StatusBadGateway, codes.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := recordSpans(t)
+			p, _ := newTestProxy(t, models.CreateDomainRequest{Domain: "app.example.com", IP: "127.0.0.1", Port: tt.port})
+
+			r := httptest.NewRequest(http.MethodGet, "http://app.example.com/page", nil)
+			r.Header.Set("Traceparent", clientTraceparent)
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+
+			server := spanOfKind(t, recorder, trace.SpanKindServer)
+			client := spanOfKind(t, recorder, trace.SpanKindClient)
+			if got := server.Parent().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" || !server.Parent().IsRemote() {
+				t.Errorf("server span parent trace %s, want the client's remote trace", got)
+			}
+			if got := server.Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+				t.Errorf("server span parent %s, want the client's span", got)
+			}
+			if client.Parent().SpanID() != server.SpanContext().SpanID() || client.SpanContext().TraceID() != server.SpanContext().TraceID() {
+				t.Error("client span is not a child of the server span")
+			}
+			for _, span := range []sdktrace.ReadOnlySpan{server, client} {
+				if got := attributeValue(span, domainKey).AsString(); got != "app.example.com" {
+					t.Errorf("%s span %s = %q, want app.example.com", span.SpanKind(), domainKey, got)
+				}
+			}
+			if got := attributeValue(server, "http.response.status_code").AsInt64(); got != int64(tt.status) {
+				t.Errorf("server span status code = %d, want %d", got, tt.status)
+			}
+			if server.Status().Code != tt.code || client.Status().Code != tt.code {
+				t.Errorf("span status codes server %v, client %v, want %v", server.Status().Code, client.Status().Code, tt.code)
+			}
+
+			if tt.status != http.StatusOK {
+				return
+			}
+			if got := attributeValue(client, "http.response.status_code").AsInt64(); got != http.StatusOK {
+				t.Errorf("client span status code = %d, want 200", got)
+			}
+			want := "00-" + client.SpanContext().TraceID().String() + "-" + client.SpanContext().SpanID().String() + "-01"
+			if got := <-received; got != want {
+				t.Errorf("backend received traceparent %q, want %q", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// cachedTransport is a transport built for a domain, along with the settings it was built from
+type cachedTransport struct {
+	key       string
+	transport http.RoundTripper
+}
+
+// transportCache keeps one transport per domain so connections are reused across requests.
+// Entries are rebuilt whenever the domain's transport settings change.
+type transportCache struct {
+	mu         sync.Mutex
+	transports map[string]*cachedTransport
+}
+
+func newTransportCache() *transportCache {
+	return &transportCache{transports: make(map[string]*cachedTransport)}
+}
+
+// get returns the transport for a domain, building a new one if its settings changed
+func (c *transportCache) get(domain *models.Domain) (http.RoundTripper, error) {
+	// Domains without custom settings share the default transport
+	if domain.UpstreamTLS.IsZero() && domain.Target == "" {
+		c.mu.Lock()
+		delete(c.transports, domain.Domain)
+		c.mu.Unlock()
+		return http.DefaultTransport, nil
+	}
+
+	settings := []interface{}{domain.Target, domain.UpstreamTLS}
+	// The client key is left out of the settings' JSON encoding, so it is added for key changes to count
+	if domain.UpstreamTLS != nil {
+		settings = append(settings, domain.UpstreamTLS.ClientKey)
+	}
+	keyBytes, err := json.Marshal(settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode transport settings: %w", err)
+	}
+	key := string(keyBytes)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cached, ok := c.transports[domain.Domain]; ok && cached.key == key {
+		return cached.transport, nil
+	}
+
+	tlsConfig, err := BuildUpstreamTLSConfig(domain.UpstreamTLS)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig.InsecureSkipVerify {
+		tlsLogger().Warn("Upstream TLS verification is disabled", "domain", domain.Domain)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	if domain.Target != "" {
+		socketPath, err := UnixSocketPath(domain.Target)
+		if err != nil {
+			return nil, err
+		}
+		// Every connection goes to the socket, regardless of the host in the request URL
+		dialer := &net.Dialer{}
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+	}
+
+	// Close idle connections of the transport being replaced
+	if cached, ok := c.transports[domain.Domain]; ok {
+		if t, ok := cached.transport.(*http.Transport); ok {
+			t.CloseIdleConnections()
+		}
+	}
+	c.transports[domain.Domain] = &cachedTransport{key: key, transport: transport}
+
+	return transport, nil
+}
+
+// UnixSocketPath returns the socket path of a "unix:///path/to.sock" target
+func UnixSocketPath(target string) (string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse target: %w", err)
+	}
+	if u.Scheme != "unix" {
+		return "", fmt.Errorf("unsupported target scheme %q, expected unix", u.Scheme)
+	}
+	if u.Host != "" || u.Path == "" {
+		return "", fmt.Errorf("target must be an absolute socket path such as unix:///run/app.sock")
+	}
+	return u.Path, nil
+}
+
+// BuildUpstreamTLSConfig converts a domain's upstream TLS settings into a tls.Config.
+// It is also used by the API to validate settings before they are stored.
+func BuildUpstreamTLSConfig(cfg *models.UpstreamTLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg == nil {
+		return tlsConfig, nil
+	}
+
+	tlsConfig.ServerName = cfg.ServerName
+	tlsConfig.InsecureSkipVerify = cfg.InsecureSkipVerify
+
+	if cfg.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(cfg.CACert)) {
+			return nil, fmt.Errorf("ca_cert does not contain any valid PEM certificates")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCert != "" || cfg.ClientKey != "" {
+		if cfg.ClientCert == "" || cfg.ClientKey == "" {
+			return nil, fmt.Errorf("client_cert and client_key must be provided together")
+		}
+		cert, err := tls.X509KeyPair([]byte(cfg.ClientCert), []byte(cfg.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("invalid client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
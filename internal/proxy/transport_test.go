@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// newClientCertificate returns a PEM client certificate and its key
+func newClientCertificate(t *testing.T) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+}
+
+func TestBuildUpstreamTLSConfig(t *testing.T) {
+	cert, key := newClientCertificate(t)
+	otherCert, _ := newClientCertificate(t)
+	tests := []struct {
+		name string
+		cfg  models.UpstreamTLSConfig
+		// err is a substring of the expected error, empty if the settings are valid
+		err string
+	}{
+		{"client certificate", models.UpstreamTLSConfig{ClientCert: cert, ClientKey: key}, ""},
+		{"certificate without key", models.UpstreamTLSConfig{ClientCert: cert}, "provided together"},
+		{"key without certificate", models.UpstreamTLSConfig{ClientKey: key}, "provided together"},
+		{"key of another certificate", models.UpstreamTLSConfig{ClientCert: otherCert, ClientKey: key}, "invalid client certificate"},
+		{"invalid ca", models.UpstreamTLSConfig{CACert: "not a certificate"}, "ca_cert"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsConfig, err := BuildUpstreamTLSConfig(&tt.cfg)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BuildUpstreamTLSConfig: %v", err)
+			}
+			if len(tlsConfig.Certificates) != 1 {
+				t.Errorf("%d client certificates, want 1", len(tlsConfig.Certificates))
+			}
+		})
+	}
+}
+
+func TestTransportCacheRebuildsOnKeyChange(t *testing.T) {
+	cert, key := newClientCertificate(t)
+	_, otherKey := newClientCertificate(t)
+	cache := newTransportCache()
+	domain := &models.Domain{Domain: "a.example.com",
+		DomainOptions: models.DomainOptions{UpstreamTLS: &models.UpstreamTLSConfig{ClientCert: cert, ClientKey: key}}}
+	first, err := cache.get(domain)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if again, _ := cache.get(domain); again != first {
+		t.Error("transport rebuilt without a settings change")
+	}
+
+	// A key of another certificate can only be loaded if the transport is rebuilt
+	domain.UpstreamTLS = &models.UpstreamTLSConfig{ClientCert: cert, ClientKey: otherKey}
+	if _, err := cache.get(domain); err == nil || !strings.Contains(err.Error(), "invalid client certificate") {
+		t.Errorf("error = %v after changing only the client key, want the new key to be loaded", err)
+	}
+}
@@ -0,0 +1,315 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+const (
+	// defaultMaxFailures is the number of consecutive failures marking a target unhealthy
+	defaultMaxFailures = 3
+	// defaultFailTimeout is how long an unhealthy target is skipped
+	defaultFailTimeout = 30 * time.Second
+	// defaultAffinityCookie names the affinity cookie when a domain doesn't configure one
+	defaultAffinityCookie = "proxy_affinity"
+)
+
+// Affinity modes
+const (
+	affinityCookie = "cookie"
+	affinityIPHash = "ip_hash"
+)
+
+// ValidateUpstreams checks that a multi-target configuration is usable
+func ValidateUpstreams(cfg *models.UpstreamsConfig) error {
+	if len(cfg.Targets) == 0 {
+		return fmt.Errorf("targets must list at least one backend URL")
+	}
+	seen := make(map[string]bool)
+	for _, raw := range cfg.Targets {
+		target, err := url.Parse(raw)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return fmt.Errorf("target %q must be an http or https URL, e.g. http://10.0.0.5:8080", raw)
+		}
+		if seen[raw] {
+			return fmt.Errorf("target %q is listed twice", raw)
+		}
+		seen[raw] = true
+	}
+	if cfg.MaxFailures < 0 || cfg.FailTimeout < 0 {
+		return fmt.Errorf("max_failures and fail_timeout must not be negative")
+	}
+
+	affinity := cfg.Affinity
+	if affinity == nil {
+		return nil
+	}
+	switch affinity.Mode {
+	case affinityCookie, affinityIPHash:
+	default:
+		return fmt.Errorf("affinity mode must be %q or %q", affinityCookie, affinityIPHash)
+	}
+	if affinity.CookieName != "" && !validCookieName(affinity.CookieName) {
+		return fmt.Errorf("affinity cookie_name %q is not a valid cookie name", affinity.CookieName)
+	}
+	if affinity.CookieTTL < 0 {
+		return fmt.Errorf("affinity cookie_ttl must not be negative")
+	}
+	switch affinity.SameSite {
+	case "", "lax", "strict":
+	case "none":
+		if !affinity.Secure {
+			return fmt.Errorf("affinity same_site none requires secure")
+		}
+	default:
+		return fmt.Errorf("affinity same_site must be lax, strict or none")
+	}
+	return nil
+}
+
+// upstreamTarget is one backend of a multi-target domain along with its passive health
+type upstreamTarget struct {
+	url *url.URL
+	// id identifies the target in affinity cookies and doesn't depend on its position
+	id        string
+	failures  int
+	downUntil time.Time
+}
+
+// upstreamPool tracks the targets of a domain. Targets are marked unhealthy after
+// consecutive failed requests and receive no requests until the fail timeout passes.
+type upstreamPool struct {
+	key         string
+	domain      string
+	maxFailures int
+	failTimeout time.Duration
+
+	mu      sync.Mutex
+	targets []*upstreamTarget
+	next    int
+}
+
+func newUpstreamPool(domain, key string, cfg *models.UpstreamsConfig) (*upstreamPool, error) {
+	pool := &upstreamPool{
+		key:         key,
+		domain:      domain,
+		maxFailures: cfg.MaxFailures,
+		failTimeout: time.Duration(cfg.FailTimeout) * time.Second,
+	}
+	if pool.maxFailures == 0 {
+		pool.maxFailures = defaultMaxFailures
+	}
+	if pool.failTimeout == 0 {
+		pool.failTimeout = defaultFailTimeout
+	}
+	for _, raw := range cfg.Targets {
+		target, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse upstream target: %w", err)
+		}
+		h := fnv.New64a()
+		h.Write([]byte(raw))
+		pool.targets = append(pool.targets, &upstreamTarget{url: target, id: strconv.FormatUint(h.Sum64(), 36)})
+	}
+	return pool, nil
+}
+
+// pick chooses the target for a request: the client's pinned target if it is healthy,
+// otherwise the next healthy target in round-robin order
+func (p *upstreamPool) pick(r *http.Request, affinity *models.AffinityConfig) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if affinity != nil {
+		switch affinity.Mode {
+		case affinityCookie:
+			if cookie, err := r.Cookie(affinityCookieName(affinity)); err == nil {
+				for i, target := range p.targets {
+					if target.id == cookie.Value && p.healthyLocked(i, now) {
+						return i
+					}
+				}
+			}
+		case affinityIPHash:
+			// Clients of an unhealthy target move to the following one, so the
+			// mapping of all other clients is unchanged
+			h := fnv.New32a()
+			h.Write([]byte(clientIP(r)))
+			return p.healthyFromLocked(int(h.Sum32()%uint32(len(p.targets))), nil, now)
+		}
+	}
+	p.next = (p.next + 1) % len(p.targets)
+	return p.healthyFromLocked(p.next, nil, now)
+}
+
+// failover returns a healthy target that hasn't been tried yet, or -1 if there is none
+func (p *upstreamPool) failover(after int, tried []bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	next := p.healthyFromLocked((after+1)%len(p.targets), tried, time.Now())
+	if tried[next] || !p.healthyLocked(next, time.Now()) {
+		return -1
+	}
+	return next
+}
+
+// healthyFromLocked returns the first healthy target from start on that isn't in skip.
+// When there is none, start is returned, since trying a target beats failing outright.
+func (p *upstreamPool) healthyFromLocked(start int, skip []bool, now time.Time) int {
+	for n := 0; n < len(p.targets); n++ {
+		i := (start + n) % len(p.targets)
+		if (skip == nil || !skip[i]) && p.healthyLocked(i, now) {
+			return i
+		}
+	}
+	return start
+}
+
+func (p *upstreamPool) healthyLocked(i int, now time.Time) bool {
+	return !now.Before(p.targets[i].downUntil)
+}
+
+// report records the outcome of a request to a target
+func (p *upstreamPool) report(i int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	target := p.targets[i]
+	if err == nil {
+		if target.failures >= p.maxFailures {
+			logger().Info("Upstream target recovered", "domain", p.domain, "upstream", target.url.Host)
+		}
+		target.failures = 0
+		target.downUntil = time.Time{}
+		return
+	}
+	target.failures++
+	if target.failures >= p.maxFailures {
+		// Targets failing again after their timeout are skipped again straight away
+		target.downUntil = time.Now().Add(p.failTimeout)
+		if target.failures == p.maxFailures {
+			logger().Warn("Upstream target marked unhealthy", "domain", p.domain, "upstream", target.url.Host,
+				"failures", target.failures, "error", err)
+		}
+	}
+}
+
+// affinityCookieName returns the name of the affinity cookie
+func affinityCookieName(affinity *models.AffinityConfig) string {
+	if affinity.CookieName != "" {
+		return affinity.CookieName
+	}
+	return defaultAffinityCookie
+}
+
+// affinityCookie returns the cookie pinning a client to a target
+func (p *upstreamPool) affinityCookie(i int, affinity *models.AffinityConfig) *http.Cookie {
+	sameSite := http.SameSiteLaxMode
+	switch affinity.SameSite {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	}
+	return &http.Cookie{
+		Name:     affinityCookieName(affinity),
+		Value:    p.targets[i].id,
+		Path:     "/",
+		MaxAge:   affinity.CookieTTL,
+		Secure:   affinity.Secure,
+		HttpOnly: true,
+		SameSite: sameSite,
+	}
+}
+
+// clientIP returns the address of the client connection without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// poolCache keeps the upstream pool of each multi-target domain, so health is tracked
+// across requests. Pools are rebuilt whenever the domain's targets change.
+type poolCache struct {
+	mu    sync.Mutex
+	pools map[string]*upstreamPool
+}
+
+func newPoolCache() *poolCache {
+	return &poolCache{pools: make(map[string]*upstreamPool)}
+}
+
+// get returns the pool of a domain, building a new one if its targets changed
+func (c *poolCache) get(domain *models.Domain) (*upstreamPool, error) {
+	cfg := domain.Upstreams
+	keyBytes, err := json.Marshal([]interface{}{cfg.Targets, cfg.MaxFailures, cfg.FailTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode upstream settings: %w", err)
+	}
+	key := string(keyBytes)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pool, ok := c.pools[domain.Domain]; ok && pool.key == key {
+		return pool, nil
+	}
+	pool, err := newUpstreamPool(domain.Domain, key, cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.pools[domain.Domain] = pool
+	return pool, nil
+}
+
+// balancedTransport sends a request to the chosen target of a multi-target domain. When
+// the target can't be reached and the request has no body, it is retried on the other
+// healthy targets; target records the target that answered.
+type balancedTransport struct {
+	next   http.RoundTripper
+	pool   *upstreamPool
+	domain string
+	info   *requestInfo
+	target int
+}
+
+func (t *balancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tried := make([]bool, len(t.pool.targets))
+	for {
+		upstream := t.pool.targets[t.target].url
+		attempt := &timedTransport{next: t.next, domain: t.domain, upstream: upstream.Host, info: t.info}
+		resp, err := attempt.RoundTrip(req)
+		// Requests canceled by the client say nothing about the target's health
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+		t.pool.report(t.target, err)
+		if err == nil || (req.Body != nil && req.Body != http.NoBody) {
+			return resp, err
+		}
+
+		tried[t.target] = true
+		next := t.pool.failover(t.target, tried)
+		if next < 0 {
+			return resp, err
+		}
+		logger().WarnContext(req.Context(), "Retrying request on another upstream target", "domain", t.domain,
+			"failed", upstream.Host, "upstream", t.pool.targets[next].url.Host, "error", err)
+		t.target = next
+		upstream = t.pool.targets[next].url
+		req = req.Clone(req.Context())
+		req.URL.Scheme = upstream.Scheme
+		req.URL.Host = upstream.Host
+		req.Host = upstream.Host
+	}
+}
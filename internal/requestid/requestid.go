@@ -0,0 +1,117 @@
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Header carries the request ID to backends and back to clients
+const Header = "X-Request-ID"
+
+// maxLength bounds incoming IDs so they can't bloat logs
+const maxLength = 128
+
+type contextKey struct{}
+
+// NewContext returns a context carrying a request ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request ID of a context, or an empty string
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// ParseTrusted parses a comma-separated list of CIDRs or IP addresses
+func ParseTrusted(spec string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", part)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			trusted = append(trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", part)
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+// Middleware assigns every request an ID. An incoming X-Request-ID is kept when the client
+// address is in trusted; otherwise a new ID is generated. The ID replaces the request header,
+// so it is forwarded to backends, and is set on the response and the request context.
+func Middleware(trusted []*net.IPNet) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(Header)
+			if id == "" || !valid(id) || !isTrusted(r.RemoteAddr, trusted) {
+				id = rand.Text()
+			}
+			r.Header.Set(Header, id)
+			w.Header().Set(Header, id)
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+		})
+	}
+}
+
+// Error replies with an error message followed by the request ID, so users can quote it
+func Error(w http.ResponseWriter, r *http.Request, message string, code int) {
+	if id := FromContext(r.Context()); id != "" {
+		message += "\nRequest ID: " + id
+	}
+	http.Error(w, message, code)
+}
+
+// valid reports whether an incoming ID is short and printable
+func valid(id string) bool {
+	if len(id) > maxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// isTrusted reports whether a remote address is in one of the trusted networks
+func isTrusted(remoteAddr string, trusted []*net.IPNet) bool {
+	if len(trusted) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
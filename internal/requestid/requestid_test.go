@@ -0,0 +1,87 @@
+package requestid
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	trusted, err := ParseTrusted("10.0.0.0/8, 192.168.1.5")
+	if err != nil {
+		t.Fatalf("ParseTrusted: %v", err)
+	}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		incoming   string
+		// keep is whether the incoming ID is used instead of a generated one
+		keep bool
+	}{
+		{"no incoming id", "10.1.2.3:1234", "", false},
+		{"trusted network", "10.1.2.3:1234", "upstream-lb-42", true},
+		{"trusted address", "192.168.1.5:1234", "upstream-lb-42", true},
+		{"untrusted client", "203.0.113.7:1234", "client-chosen", false},
+		{"too long", "10.1.2.3:1234", strings.Repeat("a", maxLength+1), false},
+		{"control characters", "10.1.2.3:1234", "bad\x00id", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var header, fromContext string
+			handler := Middleware(trusted)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				header, fromContext = r.Header.Get(Header), FromContext(r.Context())
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.incoming != "" {
+				r.Header.Set(Header, tt.incoming)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			id := w.Header().Get(Header)
+			if id == "" {
+				t.Fatal("response has no request ID")
+			}
+			if header != id || fromContext != id {
+				t.Errorf("request header %q and context %q, want the response ID %q", header, fromContext, id)
+			}
+			if (id == tt.incoming) != tt.keep {
+				t.Errorf("request ID = %q with incoming %q, want it kept: %v", id, tt.incoming, tt.keep)
+			}
+		})
+	}
+}
+
+func TestGeneratedIDsAreUnique(t *testing.T) {
+	handler := Middleware(nil)(http.NotFoundHandler())
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		id := w.Header().Get(Header)
+		if seen[id] {
+			t.Fatalf("request ID %q generated twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+func TestErrorIncludesRequestID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(NewContext(r.Context(), "abc123"))
+	w := httptest.NewRecorder()
+	Error(w, r, "Domain not found", http.StatusNotFound)
+	if w.Code != http.StatusNotFound || w.Body.String() != "Domain not found\nRequest ID: abc123\n" {
+		t.Errorf("got %d %q, want 404 with the request ID", w.Code, w.Body.String())
+	}
+}
+
+func TestParseTrustedRejectsInvalid(t *testing.T) {
+	for _, spec := range []string{"10.0.0.0/33", "not-an-ip"} {
+		if _, err := ParseTrusted(spec); err == nil {
+			t.Errorf("ParseTrusted(%q) succeeded, want an error", spec)
+		}
+	}
+}
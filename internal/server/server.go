@@ -0,0 +1,472 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/itsnoxius/simple-proxy/internal/logging"
+)
+
+const (
+	// listenersEnv lists the addresses of the listeners passed to a new process, in the
+	// order of their file descriptors starting at 3, e.g. "tcp::80,tcp::443,udp::443"
+	listenersEnv = "PROXY_LISTENERS"
+	// readyFDEnv is the file descriptor a new process writes to once it is serving
+	readyFDEnv = "PROXY_READY_FD"
+	// handoffTimeout bounds how long a new process may take to start serving
+	handoffTimeout = 30 * time.Second
+)
+
+// logger returns the logger for server lifecycle messages
+func logger() *slog.Logger {
+	return logging.Logger(logging.Server)
+}
+
+// Shutdowner is a server that can be stopped gracefully, such as http.Server
+type Shutdowner interface {
+	Shutdown(ctx context.Context) error
+}
+
+// PacketServer is a server of a socket returned by ListenPacket, such as http3.Server
+type PacketServer interface {
+	Shutdowner
+	// Close stops the server immediately, closing its connections
+	Close() error
+}
+
+// packetServer is a registered packet server along with the function starting it again
+type packetServer struct {
+	start func() PacketServer
+	// current is nil while the server is closed for a handoff
+	current PacketServer
+}
+
+// listener is a socket opened by the manager, kept for handing it off to a new process
+type listener struct {
+	key  string
+	file func() (*os.File, error)
+	// path is the file of a Unix socket, removed on shutdown unless handed off
+	path string
+}
+
+// Manager owns the listening sockets and servers of the process. It drains the servers
+// on shutdown and can hand the sockets off to a new process for zero-downtime upgrades.
+type Manager struct {
+	mu        sync.Mutex
+	inherited map[string]*os.File
+	readyFile *os.File
+	listeners []listener
+	servers   []Shutdowner
+	// packetServers are closed before a handoff, see ServePacket
+	packetServers []*packetServer
+	handedOff     atomic.Bool
+
+	draining atomic.Bool
+	inFlight sync.WaitGroup
+	// baseCtx is the parent of all request contexts. It is canceled when the drain timeout
+	// passes, which also ends upgraded connections such as WebSockets.
+	baseCtx    context.Context
+	cancelBase context.CancelFunc
+}
+
+// New creates a manager, taking over the sockets passed by a previous process if any
+func New() (*Manager, error) {
+	m := &Manager{inherited: make(map[string]*os.File)}
+	m.baseCtx, m.cancelBase = context.WithCancel(context.Background())
+
+	if spec := os.Getenv(listenersEnv); spec != "" {
+		for i, key := range strings.Split(spec, ",") {
+			m.inherited[key] = os.NewFile(uintptr(3+i), key)
+		}
+	}
+	if fd := os.Getenv(readyFDEnv); fd != "" {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", readyFDEnv, fd)
+		}
+		m.readyFile = os.NewFile(uintptr(n), "ready")
+	}
+	// Processes started from this one get their own variables
+	os.Unsetenv(listenersEnv)
+	os.Unsetenv(readyFDEnv)
+	return m, nil
+}
+
+// Listen returns a "tcp" or "unix" listener on addr, reusing an inherited socket if there
+// is one. Stale Unix socket files are replaced.
+func (m *Manager) Listen(network, addr string) (net.Listener, error) {
+	key := network + ":" + addr
+	var ln net.Listener
+	var err error
+	if f := m.takeInherited(key); f != nil {
+		ln, err = net.FileListener(f)
+		f.Close()
+	} else {
+		if network == "unix" {
+			if info, statErr := os.Stat(addr); statErr == nil && info.Mode()&os.ModeSocket != 0 {
+				os.Remove(addr)
+			}
+		}
+		ln, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := ln.(type) {
+	case *net.TCPListener:
+		m.addListener(listener{key: key, file: l.File})
+	case *net.UnixListener:
+		// The socket file must outlive this process when it is handed off, so Shutdown
+		// removes it instead
+		l.SetUnlinkOnClose(false)
+		m.addListener(listener{key: key, file: l.File, path: addr})
+	default:
+		ln.Close()
+		return nil, fmt.Errorf("inherited socket for %s is not a %s listener", addr, network)
+	}
+	return ln, nil
+}
+
+// ListenPacket returns a UDP socket on addr, reusing an inherited socket if there is one.
+// Its servers must be started with ServePacket.
+func (m *Manager) ListenPacket(addr string) (net.PacketConn, error) {
+	key := "udp:" + addr
+	var conn net.PacketConn
+	var err error
+	if f := m.takeInherited(key); f != nil {
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		conn, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	udp, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil, fmt.Errorf("inherited socket for %s is not a UDP socket", addr)
+	}
+	m.addListener(listener{key: key, file: udp.File})
+	return conn, nil
+}
+
+func (m *Manager) takeInherited(key string) *os.File {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.inherited[key]
+	delete(m.inherited, key)
+	if f != nil {
+		logger().Info("Reusing inherited listener", "listener", key)
+	}
+	return f
+}
+
+func (m *Manager) addListener(l listener) {
+	m.mu.Lock()
+	m.listeners = append(m.listeners, l)
+	m.mu.Unlock()
+}
+
+// Register adds a server to be drained on shutdown. HTTP servers should also use
+// BaseContext, so upgraded connections end when the drain timeout passes.
+func (m *Manager) Register(s Shutdowner) {
+	m.mu.Lock()
+	m.servers = append(m.servers, s)
+	m.mu.Unlock()
+}
+
+// ServePacket starts a server of a socket from ListenPacket by calling start, which
+// returns the server once it serves in the background. Unlike TCP connections, QUIC
+// connections arrive on the shared socket, and a process resets those it didn't accept.
+// The server is therefore closed before a handoff instead of being drained, and its clients
+// reconnect to the new process. If the handoff fails, start is called again on the same
+// socket. The server is drained like other servers on shutdown.
+func (m *Manager) ServePacket(start func() PacketServer) {
+	s := &packetServer{start: start, current: start()}
+	m.mu.Lock()
+	m.packetServers = append(m.packetServers, s)
+	m.mu.Unlock()
+}
+
+// BaseContext is used as http.Server.BaseContext
+func (m *Manager) BaseContext(net.Listener) context.Context {
+	return m.baseCtx
+}
+
+// Track counts the requests handled by next, including upgraded connections, so
+// Shutdown can wait for them
+func (m *Manager) Track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Add(1)
+		defer m.inFlight.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Draining reports whether the process is shutting down
+func (m *Manager) Draining() bool {
+	return m.draining.Load()
+}
+
+// Ready handles readiness checks, which fail once the process starts draining
+func (m *Manager) Ready(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if m.Draining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, `{"status":"draining"}`)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, `{"status":"ready"}`)
+}
+
+// NotifyReady tells the process that started this one, if any, that it is serving. Inherited
+// sockets that were not reused are closed.
+func (m *Manager) NotifyReady() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, f := range m.inherited {
+		logger().Warn("Closing unused inherited listener", "listener", key)
+		f.Close()
+	}
+	m.inherited = map[string]*os.File{}
+	if m.readyFile != nil {
+		m.readyFile.Write([]byte{1})
+		m.readyFile.Close()
+		m.readyFile = nil
+	}
+}
+
+// Shutdown fails readiness checks, waits for delay so load balancers notice, then stops the
+// servers and waits up to timeout for in-flight requests. Remaining connections are closed.
+// Unix socket files are removed, unless the sockets were handed off to a new process.
+func (m *Manager) Shutdown(delay, timeout time.Duration) error {
+	defer m.removeSocketFiles()
+	m.draining.Store(true)
+	if delay > 0 {
+		logger().Info("Failing readiness before draining", "delay", delay)
+		time.Sleep(delay)
+	}
+
+	logger().Info("Draining connections", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	m.mu.Lock()
+	servers := append([]Shutdowner(nil), m.servers...)
+	for _, s := range m.packetServers {
+		if s.current != nil {
+			servers = append(servers, s.current)
+		}
+	}
+	m.mu.Unlock()
+
+	errs := make(chan error, len(servers))
+	for _, s := range servers {
+		go func() { errs <- s.Shutdown(ctx) }()
+	}
+	var err error
+	for range servers {
+		err = errors.Join(err, <-errs)
+	}
+
+	// Servers don't wait for hijacked connections, so wait for their handlers as well
+	done := make(chan struct{})
+	go func() {
+		m.inFlight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	m.cancelBase()
+	if ctx.Err() != nil {
+		logger().Warn("Drain timeout passed, closing remaining connections")
+		return ctx.Err()
+	}
+	return err
+}
+
+// removeSocketFiles removes the files of Unix sockets that were not handed off
+func (m *Manager) removeSocketFiles() {
+	if m.handedOff.Load() {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, l := range m.listeners {
+		if l.path == "" {
+			continue
+		}
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			logger().Warn("Failed to remove socket file", "path", l.path, "error", err)
+		}
+	}
+}
+
+// Run blocks until a shutdown or handoff signal arrives, then drains the servers. Shutdown
+// signals fail readiness for delay first; after a handoff, the new process already accepts
+// connections on the same sockets, so draining starts right away. If a handoff fails, this
+// process keeps serving and waits for the next signal.
+func (m *Manager) Run(delay, timeout time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, append(append([]os.Signal(nil), shutdownSignals...), handoffSignals...)...)
+	defer signal.Stop(signals)
+
+	for sig := range signals {
+		if !slices.Contains(handoffSignals, sig) {
+			logger().Info("Shutting down", "signal", sig.String())
+			return m.Shutdown(delay, timeout)
+		}
+		logger().Info("Handing off listeners to a new process", "signal", sig.String())
+		if err := m.Handoff(); err != nil {
+			logger().Error("Listener handoff failed, continuing to serve", "error", err)
+			continue
+		}
+		logger().Info("New process is serving")
+		return m.Shutdown(0, timeout)
+	}
+	return nil
+}
+
+// Handoff starts a new instance of the running binary with the listening sockets and waits
+// until it is serving. The caller should then shut down. The packet servers are closed
+// before the new process starts. If the new process fails to start serving, it is killed
+// and an error is returned, and this process keeps serving, with its packet servers started
+// again.
+//
+// The new process is a child of this one and outlives it, so this process must not be
+// PID 1: in a container, the container would stop when it exits.
+func (m *Manager) Handoff() error {
+	if os.Getpid() == 1 {
+		return errors.New("process is PID 1, so a new process would stop with it; run it under an init such as tini")
+	}
+	m.mu.Lock()
+	listeners := append([]listener(nil), m.listeners...)
+	m.mu.Unlock()
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	keys := make([]string, 0, len(listeners))
+	for _, l := range listeners {
+		f, err := l.file()
+		if err != nil {
+			return fmt.Errorf("failed to pass listener %s: %w", l.key, err)
+		}
+		files = append(files, f)
+		keys = append(keys, l.key)
+	}
+
+	// Only one process may read from a UDP socket, so QUIC connections end here rather
+	// than being reset by the new process
+	m.closePacketServers()
+	handedOff := false
+	defer func() {
+		if !handedOff {
+			m.restartPacketServers()
+		}
+	}()
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create readiness pipe: %w", err)
+	}
+	defer readyReader.Close()
+	files = append(files, readyWriter)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		listenersEnv+"="+strings.Join(keys, ","),
+		readyFDEnv+"="+strconv.Itoa(3+len(keys)),
+	)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start new process: %w", err)
+	}
+	logger().Info("Started new process", "pid", cmd.Process.Pid, "listeners", keys)
+	// Only the new process may hold the write end, so a crash closes the pipe
+	readyWriter.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readyReader.Read(buf); err != nil {
+			ready <- fmt.Errorf("new process exited before serving")
+			return
+		}
+		ready <- nil
+	}()
+	go cmd.Wait()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Process.Kill()
+			return err
+		}
+		m.handedOff.Store(true)
+		handedOff = true
+		return nil
+	case <-time.After(handoffTimeout):
+		cmd.Process.Kill()
+		return fmt.Errorf("new process did not start serving within %s", handoffTimeout)
+	}
+}
+
+// closePacketServers closes the packet servers before a handoff
+func (m *Manager) closePacketServers() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.packetServers {
+		if err := s.current.Close(); err != nil {
+			logger().Warn("Failed to close packet server before handoff", "error", err)
+		}
+		s.current = nil
+	}
+	if len(m.packetServers) > 0 {
+		logger().Info("Closed packet servers before handoff", "servers", len(m.packetServers))
+	}
+}
+
+// restartPacketServers starts the packet servers closed for a handoff that failed
+func (m *Manager) restartPacketServers() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.packetServers {
+		if s.current == nil {
+			s.current = s.start()
+		}
+	}
+	if len(m.packetServers) > 0 {
+		logger().Info("Restarted packet servers after failed handoff", "servers", len(m.packetServers))
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failHandoffEnv makes the new process of a handoff exit before serving
+const failHandoffEnv = "SERVER_TEST_FAIL_HANDOFF"
+
+// TestMain lets the test binary act as the new process of a handoff
+func TestMain(m *testing.M) {
+	if os.Getenv(listenersEnv) != "" {
+		manager, err := New()
+		if err != nil || os.Getenv(failHandoffEnv) != "" {
+			os.Exit(1)
+		}
+		manager.NotifyReady()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakePacketServer records when it is closed or shut down
+type fakePacketServer struct {
+	closed   atomic.Bool
+	shutdown atomic.Bool
+}
+
+// servePacket starts fake packet servers with m, returning the ones started so far
+func servePacket(m *Manager) func() []*fakePacketServer {
+	var mu sync.Mutex
+	var started []*fakePacketServer
+	m.ServePacket(func() PacketServer {
+		mu.Lock()
+		defer mu.Unlock()
+		s := &fakePacketServer{}
+		started = append(started, s)
+		return s
+	})
+	return func() []*fakePacketServer {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(started)
+	}
+}
+
+func (s *fakePacketServer) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+func (s *fakePacketServer) Shutdown(context.Context) error {
+	s.shutdown.Store(true)
+	return nil
+}
+
+func TestShutdownRemovesSocketFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	m, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := m.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Register(closer{ln})
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("socket file missing while serving: %v", err)
+	}
+
+	if err := m.Shutdown(0, time.Second); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file left after shutdown: %v", err)
+	}
+}
+
+func TestShutdownDrainsPacketServers(t *testing.T) {
+	m, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := servePacket(m)()[0]
+	if err := m.Shutdown(0, time.Second); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if !s.shutdown.Load() || s.closed.Load() {
+		t.Errorf("shutdown = %v, closed = %v, want the server drained", s.shutdown.Load(), s.closed.Load())
+	}
+}
+
+func TestHandoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	m, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := m.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Register(closer{ln})
+	conn, err := m.ListenPacket("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	started := servePacket(m)
+
+	if err := m.Handoff(); err != nil {
+		t.Fatalf("Handoff: %v", err)
+	}
+	if servers := started(); len(servers) != 1 || !servers[0].closed.Load() {
+		t.Error("packet server still serving after handoff, want it closed before the new process starts")
+	}
+
+	// The new process owns the socket file now
+	if err := m.Shutdown(0, time.Second); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("socket file removed after handoff: %v", err)
+	}
+}
+
+func TestFailedHandoffRestartsPacketServers(t *testing.T) {
+	t.Setenv(failHandoffEnv, "1")
+	m, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := m.ListenPacket("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	started := servePacket(m)
+
+	if err := m.Handoff(); err == nil {
+		t.Fatal("Handoff succeeded, want the new process to fail")
+	}
+	servers := started()
+	if len(servers) != 2 || !servers[0].closed.Load() || servers[1].closed.Load() {
+		t.Fatalf("%d packet servers started, want the closed one started again", len(servers))
+	}
+
+	// The restarted server is the one drained on shutdown
+	if err := m.Shutdown(0, time.Second); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if servers[0].shutdown.Load() || !servers[1].shutdown.Load() {
+		t.Error("shutdown didn't drain the restarted packet server")
+	}
+}
+
+// closer adapts a listener to Shutdowner
+type closer struct {
+	net.Listener
+}
+
+func (c closer) Shutdown(context.Context) error {
+	return c.Close()
+}
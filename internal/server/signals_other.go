@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package server
+
+import "os"
+
+var (
+	// shutdownSignals drain the process and exit
+	shutdownSignals = []os.Signal{os.Interrupt}
+	// handoffSignals is empty, since listener handoff is not supported on this platform
+	handoffSignals []os.Signal
+)
@@ -0,0 +1,15 @@
+//go:build !windows && !plan9
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// shutdownSignals drain the process and exit
+	shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	// handoffSignals pass the listeners to a new process before draining
+	handoffSignals = []os.Signal{syscall.SIGUSR2}
+)
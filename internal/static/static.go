@@ -0,0 +1,300 @@
+package static
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/itsnoxius/simple-proxy/internal/logging"
+	"github.com/itsnoxius/simple-proxy/internal/requestid"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// defaultIndexFiles is used when a static domain doesn't configure its own index files
+var defaultIndexFiles = []string{"index.html"}
+
+// precompressedEncodings lists the sidecar file extensions served for each
+// content encoding, in order of preference
+var precompressedEncodings = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// logger returns the logger for static file errors, which are part of request handling
+func logger() *slog.Logger {
+	return logging.Logger(logging.Proxy)
+}
+
+// Validate checks that a static domain configuration is usable. When allowedRoot is set,
+// the root must be inside it once symlinks are resolved.
+func Validate(cfg *models.StaticConfig, allowedRoot string) error {
+	if cfg.Root == "" || !filepath.IsAbs(cfg.Root) {
+		return fmt.Errorf("root must be an absolute directory path")
+	}
+	info, err := os.Stat(cfg.Root)
+	if err != nil {
+		return fmt.Errorf("root is not accessible: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("root is not a directory")
+	}
+	if allowedRoot != "" {
+		if err := checkConfined(cfg.Root, allowedRoot); err != nil {
+			return err
+		}
+	}
+	for _, name := range cfg.IndexFiles {
+		if name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("invalid index file %q", name)
+		}
+	}
+	for _, rule := range cfg.CacheControl {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return fmt.Errorf("invalid cache_control pattern %q", rule.Pattern)
+		}
+	}
+	return nil
+}
+
+// checkConfined returns an error unless root resolves to allowedRoot or a directory inside it
+func checkConfined(root, allowedRoot string) error {
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return fmt.Errorf("root is not accessible: %w", err)
+	}
+	allowed, err := filepath.EvalSymlinks(allowedRoot)
+	if err != nil {
+		return fmt.Errorf("allowed root %s is not accessible: %w", allowedRoot, err)
+	}
+	if rel, err := filepath.Rel(allowed, resolved); err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("root must be inside %s", allowedRoot)
+	}
+	return nil
+}
+
+// Serve serves a request from a static domain's root directory
+func Serve(w http.ResponseWriter, r *http.Request, cfg *models.StaticConfig) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		requestid.Error(w, r, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// os.Root confines all lookups, including symlinks, to the configured directory
+	root, err := os.OpenRoot(cfg.Root)
+	if err != nil {
+		logger().ErrorContext(r.Context(), "Failed to open static root", "root", cfg.Root, "error", err)
+		requestid.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer root.Close()
+
+	urlPath := path.Clean("/" + r.URL.Path)
+	name := relativeName(urlPath)
+
+	info, err := root.Stat(name)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			logger().ErrorContext(r.Context(), "Failed to stat static file", "file", name, "error", err)
+			requestid.Error(w, r, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		// Single page apps handle their own routes, so extensionless paths fall back to
+		// the root index file while missing assets still return 404
+		if cfg.SPAFallback && path.Ext(urlPath) == "" {
+			serveIndex(w, r, root, cfg, ".", "/")
+			return
+		}
+		requestid.Error(w, r, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if info.IsDir() {
+		// Redirect to the canonical directory path so relative links resolve correctly
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := path.Base(urlPath) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		serveIndex(w, r, root, cfg, name, urlPath)
+		return
+	}
+
+	serveFile(w, r, root, cfg, name)
+}
+
+// relativeName converts a cleaned URL path into a name relative to the root
+func relativeName(urlPath string) string {
+	name := strings.TrimPrefix(urlPath, "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// serveIndex serves the first existing index file of a directory, or a listing if enabled
+func serveIndex(w http.ResponseWriter, r *http.Request, root *os.Root, cfg *models.StaticConfig, dir, urlPath string) {
+	indexFiles := cfg.IndexFiles
+	if len(indexFiles) == 0 {
+		indexFiles = defaultIndexFiles
+	}
+	for _, index := range indexFiles {
+		name := path.Join(dir, index)
+		if info, err := root.Stat(name); err == nil && !info.IsDir() {
+			serveFile(w, r, root, cfg, name)
+			return
+		}
+	}
+
+	if !cfg.DirectoryListing {
+		requestid.Error(w, r, "Forbidden", http.StatusForbidden)
+		return
+	}
+	serveListing(w, r, root, dir, urlPath)
+}
+
+// serveFile serves a single file, preferring a precompressed sidecar when the client accepts it.
+// http.ServeContent takes care of range requests and conditional headers.
+func serveFile(w http.ResponseWriter, r *http.Request, root *os.Root, cfg *models.StaticConfig, name string) {
+	if value := cacheControl(cfg, name); value != "" {
+		w.Header().Set("Cache-Control", value)
+	}
+
+	servedName := name
+	if cfg.Precompressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+		accepted := acceptedEncodings(r)
+		for _, candidate := range precompressedEncodings {
+			if !accepted[candidate.encoding] {
+				continue
+			}
+			if info, err := root.Stat(name + candidate.extension); err == nil && !info.IsDir() {
+				servedName = name + candidate.extension
+				w.Header().Set("Content-Encoding", candidate.encoding)
+				break
+			}
+		}
+	}
+
+	file, err := root.Open(servedName)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			requestid.Error(w, r, "Not found", http.StatusNotFound)
+			return
+		}
+		logger().ErrorContext(r.Context(), "Failed to open static file", "file", servedName, "error", err)
+		requestid.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		logger().ErrorContext(r.Context(), "Failed to stat static file", "file", servedName, "error", err)
+		requestid.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// The content type comes from the original name, not the compressed sidecar
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	} else if servedName != name {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	http.ServeContent(w, r, name, info.ModTime(), file)
+}
+
+// serveListing renders a simple HTML index of a directory
+func serveListing(w http.ResponseWriter, r *http.Request, root *os.Root, dir, urlPath string) {
+	f, err := root.Open(dir)
+	if err != nil {
+		logger().ErrorContext(r.Context(), "Failed to open static directory", "dir", dir, "error", err)
+		requestid.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	entries, err := f.ReadDir(-1)
+	if err != nil {
+		logger().ErrorContext(r.Context(), "Failed to read static directory", "dir", dir, "error", err)
+		requestid.Error(w, r, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if !strings.HasSuffix(urlPath, "/") {
+		urlPath += "/"
+	}
+	title := html.EscapeString(urlPath)
+	fmt.Fprintf(w, "<!doctype html>\n<title>Index of %s</title>\n<h1>Index of %s</h1>\n<pre>\n", title, title)
+	if urlPath != "/" {
+		fmt.Fprintln(w, `<a href="../">../</a>`)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		href := (&url.URL{Path: name}).String()
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	fmt.Fprintln(w, "</pre>")
+}
+
+// cacheControl returns the Cache-Control value of the first rule matching the file's
+// full path or base name
+func cacheControl(cfg *models.StaticConfig, name string) string {
+	fullPath := "/" + strings.TrimPrefix(name, "./")
+	for _, rule := range cfg.CacheControl {
+		if ok, _ := path.Match(rule.Pattern, fullPath); ok {
+			return rule.Value
+		}
+		if ok, _ := path.Match(rule.Pattern, path.Base(name)); ok {
+			return rule.Value
+		}
+	}
+	return ""
+}
+
+// acceptedEncodings parses the Accept-Encoding header, ignoring encodings with q=0
+func acceptedEncodings(r *http.Request) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		encoding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if encoding == "" {
+			continue
+		}
+		rejected := false
+		for _, param := range fields[1:] {
+			param = strings.ReplaceAll(strings.TrimSpace(param), " ", "")
+			if param == "q=0" || strings.HasPrefix(param, "q=0.") && strings.Trim(param[4:], "0") == "" {
+				rejected = true
+			}
+		}
+		accepted[encoding] = !rejected
+	}
+	return accepted
+}
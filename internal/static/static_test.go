@@ -0,0 +1,186 @@
+package static
+
+import (
+	"cmp"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+)
+
+// newTestRoot creates a site root, next to a file that must not be reachable from it
+func newTestRoot(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "site")
+	files := map[string]string{
+		"index.html":         "home",
+		"app.js":             "plain js",
+		"app.js.br":          "brotli js",
+		"app.js.gz":          "gzip js",
+		"docs/guide.txt":     "guide",
+		"docs/a<b>.txt":      "escaped",
+		"blog/start.html":    "blog start",
+		"data.unknownext":    "data",
+		"data.unknownext.gz": "gzip data",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "escape.txt")); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestServe(t *testing.T) {
+	root := newTestRoot(t)
+	tests := []struct {
+		name   string
+		cfg    models.StaticConfig
+		method string
+		target string
+		header http.Header
+		status int
+		// body is a substring of the expected body
+		body string
+		// want are expected response headers, with "" for headers that must be absent
+		want map[string]string
+	}{
+		{name: "root index", target: "/", status: http.StatusOK, body: "home",
+			want: map[string]string{"Content-Type": "text/html; charset=utf-8"}},
+		{name: "file", target: "/docs/guide.txt", status: http.StatusOK, body: "guide"},
+		{name: "head", method: http.MethodHead, target: "/docs/guide.txt", status: http.StatusOK,
+			want: map[string]string{"Content-Length": "5"}},
+		{name: "post", method: http.MethodPost, target: "/", status: http.StatusMethodNotAllowed,
+			want: map[string]string{"Allow": "GET, HEAD"}},
+		{name: "missing", target: "/missing", status: http.StatusNotFound},
+		{name: "directory redirect", target: "/docs?page=2", status: http.StatusMovedPermanently,
+			want: map[string]string{"Location": "/docs/?page=2"}},
+		{name: "directory without index", target: "/docs/", status: http.StatusForbidden},
+		{name: "directory listing", cfg: models.StaticConfig{DirectoryListing: true}, target: "/docs/", status: http.StatusOK,
+			body: `<a href="a%3Cb%3E.txt">a&lt;b&gt;.txt</a>`},
+		{name: "custom index file", cfg: models.StaticConfig{IndexFiles: []string{"start.html"}}, target: "/blog/",
+			status: http.StatusOK, body: "blog start"},
+		{name: "spa fallback", cfg: models.StaticConfig{SPAFallback: true}, target: "/settings/profile",
+			status: http.StatusOK, body: "home"},
+		{name: "spa missing asset", cfg: models.StaticConfig{SPAFallback: true}, target: "/missing.js",
+			status: http.StatusNotFound},
+		{name: "dot segments stay in root", target: "/../secret.txt", status: http.StatusNotFound},
+		{name: "symlink out of root", target: "/escape.txt", status: http.StatusInternalServerError},
+		{name: "range", target: "/docs/guide.txt", header: http.Header{"Range": {"bytes=0-1"}},
+			status: http.StatusPartialContent, body: "gu"},
+		{name: "precompressed brotli", cfg: models.StaticConfig{Precompressed: true}, target: "/app.js",
+			header: http.Header{"Accept-Encoding": {"gzip, br"}}, status: http.StatusOK, body: "brotli js",
+			want: map[string]string{"Content-Encoding": "br", "Content-Type": "text/javascript; charset=utf-8", "Vary": "Accept-Encoding"}},
+		{name: "precompressed refused encoding", cfg: models.StaticConfig{Precompressed: true}, target: "/app.js",
+			header: http.Header{"Accept-Encoding": {"br;q=0.0, gzip"}}, status: http.StatusOK, body: "gzip js",
+			want: map[string]string{"Content-Encoding": "gzip"}},
+		{name: "precompressed not accepted", cfg: models.StaticConfig{Precompressed: true}, target: "/app.js",
+			status: http.StatusOK, body: "plain js", want: map[string]string{"Content-Encoding": "", "Vary": "Accept-Encoding"}},
+		{name: "precompressed unknown type", cfg: models.StaticConfig{Precompressed: true}, target: "/data.unknownext",
+			header: http.Header{"Accept-Encoding": {"gzip"}}, status: http.StatusOK, body: "gzip data",
+			want: map[string]string{"Content-Type": "application/octet-stream"}},
+		{name: "sidecars off", target: "/app.js", header: http.Header{"Accept-Encoding": {"br"}}, status: http.StatusOK,
+			body: "plain js", want: map[string]string{"Content-Encoding": "", "Vary": ""}},
+		{name: "cache control by base name",
+			cfg:    models.StaticConfig{CacheControl: []models.CacheControlRule{{Pattern: "*.js", Value: "max-age=31536000"}}},
+			target: "/app.js", status: http.StatusOK, want: map[string]string{"Cache-Control": "max-age=31536000"}},
+		{name: "cache control by path",
+			cfg: models.StaticConfig{CacheControl: []models.CacheControlRule{
+				{Pattern: "/docs/*", Value: "no-cache"}, {Pattern: "*.txt", Value: "max-age=60"}}},
+			target: "/docs/guide.txt", status: http.StatusOK, want: map[string]string{"Cache-Control": "no-cache"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Root = root
+			r := httptest.NewRequest(cmp.Or(tt.method, http.MethodGet), tt.target, nil)
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			Serve(w, r, &cfg)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if !strings.Contains(w.Body.String(), tt.body) {
+				t.Errorf("body = %q, want it to contain %q", w.Body, tt.body)
+			}
+			if strings.Contains(w.Body.String(), "secret") {
+				t.Error("served a file outside the root")
+			}
+			for name, value := range tt.want {
+				if got := w.Header().Get(name); got != value {
+					t.Errorf("%s = %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	root := newTestRoot(t)
+	tests := []struct {
+		name string
+		cfg  models.StaticConfig
+		ok   bool
+	}{
+		{"root", models.StaticConfig{Root: root}, true},
+		{"relative root", models.StaticConfig{Root: "site"}, false},
+		{"missing root", models.StaticConfig{Root: filepath.Join(root, "missing")}, false},
+		{"file root", models.StaticConfig{Root: filepath.Join(root, "index.html")}, false},
+		{"index file with slash", models.StaticConfig{Root: root, IndexFiles: []string{"docs/index.html"}}, false},
+		{"invalid cache control pattern", models.StaticConfig{Root: root,
+			CacheControl: []models.CacheControlRule{{Pattern: "[", Value: "no-cache"}}}, false},
+		{"empty cache control pattern", models.StaticConfig{Root: root,
+			CacheControl: []models.CacheControlRule{{Value: "no-cache"}}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Validate(&tt.cfg, ""); (err == nil) != tt.ok {
+				t.Errorf("Validate error = %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestValidateAllowedRoot(t *testing.T) {
+	root := newTestRoot(t)
+	allowed := filepath.Dir(root)
+	// A symlink inside the allowed directory must not lead out of it
+	if err := os.Symlink("/", filepath.Join(allowed, "everything")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		root string
+		ok   bool
+	}{
+		{allowed, true},
+		{root, true},
+		{filepath.Join(root, "docs"), true},
+		{"/", false},
+		{"/proc/self", false},
+		{filepath.Join(allowed, "everything"), false},
+		{filepath.Join(root, "..", ".."), false},
+	}
+	for _, tt := range tests {
+		if err := Validate(&models.StaticConfig{Root: tt.root}, allowed); (err == nil) != tt.ok {
+			t.Errorf("Validate(%s) error = %v, want success %v", tt.root, err, tt.ok)
+		}
+	}
+}
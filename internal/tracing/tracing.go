@@ -0,0 +1,70 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the proxy's tracer
+const instrumentationName = "github.com/itsnoxius/simple-proxy"
+
+// NewOTLPExporter creates an exporter sending spans to an OTLP/HTTP collector. The
+// collector and its settings are configured with the standard OTEL_EXPORTER_OTLP_*
+// environment variables.
+func NewOTLPExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	return exporter, nil
+}
+
+// Setup installs a tracer provider exporting spans to exporter, along with the W3C trace
+// context and baggage propagators. The sampler follows OTEL_TRACES_SAMPLER. Tests can pass
+// tracetest.NewInMemoryExporter and call ForceFlush on the returned provider before
+// inspecting the recorded spans.
+func Setup(exporter sdktrace.SpanExporter, serviceName string) (*sdktrace.TracerProvider, error) {
+	res, err := resource.Merge(
+		resource.Default(),
+		resource.NewSchemaless(semconv.ServiceName(serviceName)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %w", err)
+	}
+	// Environment settings such as OTEL_SERVICE_NAME take precedence
+	if envRes, err := resource.New(context.Background(), resource.WithFromEnv()); err == nil {
+		if merged, err := resource.Merge(res, envRes); err == nil {
+			res = merged
+		}
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	return provider, nil
+}
+
+// Tracer returns the proxy's tracer from the installed provider. Without Setup, spans
+// are not recorded.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Propagator returns the installed propagator
+func Propagator() propagation.TextMapPropagator {
+	return otel.GetTextMapPropagator()
+}
@@ -1,21 +1,35 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
-	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/quic-go/quic-go/http3"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
 
+	"github.com/itsnoxius/simple-proxy/internal/accesslog"
 	"github.com/itsnoxius/simple-proxy/internal/api"
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+	"github.com/itsnoxius/simple-proxy/internal/cache"
 	"github.com/itsnoxius/simple-proxy/internal/config"
 	"github.com/itsnoxius/simple-proxy/internal/database"
+	"github.com/itsnoxius/simple-proxy/internal/logging"
+	"github.com/itsnoxius/simple-proxy/internal/metrics"
 	"github.com/itsnoxius/simple-proxy/internal/proxy"
+	"github.com/itsnoxius/simple-proxy/internal/requestid"
+	"github.com/itsnoxius/simple-proxy/internal/server"
+	"github.com/itsnoxius/simple-proxy/internal/tracing"
 )
 
 var (
@@ -24,35 +38,64 @@ var (
 	db   *database.DB
 )
 
-func debugLog(format string, v ...interface{}) {
-	if cfg != nil && cfg.Debug {
-		log.Printf("[DEBUG] "+format, v...)
-	}
+// logger returns the logger for server lifecycle messages
+func logger() *slog.Logger {
+	return logging.Logger(logging.Server)
+}
+
+// fatal logs an error and exits
+func fatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
 }
 
-func init() {
+// setup loads the configuration and opens the database, exiting if either fails
+func setup() {
 	cfg = config.Load()
-	debugLog("Initializing application...")
-	debugLog("Configuration loaded: Port=%d, DBPath=%s, Debug=%v", cfg.Port, cfg.DBPath, cfg.Debug)
+	setupLogging()
+	logger().Debug("Initializing application...")
+	logger().Debug("Configuration loaded", "port", cfg.Port, "db_path", cfg.DBPath)
+	logger().Debug("TLS configuration", "enabled", cfg.TLSEnabled(), "tls_port", cfg.TLSPort, "http3", cfg.HTTP3)
 
 	// Validate API key is set
 	if cfg.ProxyAPIKey == "" {
-		log.Fatal("PROXY_API_KEY environment variable is required")
+		fatal(logger(), "PROXY_API_KEY environment variable is required")
 	}
-	debugLog("API key validated")
+	logger().Debug("API key validated")
 
-	// Validate API domain is set
-	if cfg.APIDomain == "" {
-		log.Fatal("PROXY_API_DOMAIN environment variable is required")
+	// The API domain is only needed when the API shares the public listener
+	if cfg.APIDomain == "" && cfg.AdminAddr == "" {
+		fatal(logger(), "PROXY_API_DOMAIN or ADMIN_ADDR environment variable is required")
 	}
-	debugLog("API domain validated: %s", cfg.APIDomain)
+	logger().Debug("API domain validated", "api_domain", cfg.APIDomain)
 
 	var err error
 	db, err = database.New(cfg.DBPath)
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		fatal(logging.Logger(logging.Database), "Failed to initialize database", "error", err)
+	}
+	logging.Logger(logging.Database).Debug("Database initialized", "path", cfg.DBPath)
+}
+
+// setupLogging applies the log format and levels from the configuration
+func setupLogging() {
+	if err := logging.Setup(os.Stderr, cfg.LogFormat); err != nil {
+		fatal(logger(), "Invalid LOG_FORMAT", "error", err)
+	}
+	level, err := logging.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		fatal(logger(), "Invalid LOG_LEVEL", "error", err)
+	}
+	logging.SetAllLevels(level)
+	levels, err := logging.ParseLevels(cfg.LogLevels)
+	if err != nil {
+		fatal(logger(), "Invalid LOG_LEVELS", "error", err)
+	}
+	for subsystem, level := range levels {
+		if err := logging.SetLevel(subsystem, level); err != nil {
+			fatal(logger(), "Invalid LOG_LEVELS", "error", err)
+		}
 	}
-	debugLog("Database initialized at: %s", cfg.DBPath)
 }
 
 type DomainedResponse struct {
@@ -69,7 +112,8 @@ type DomainedResponse struct {
 }
 
 func main() {
-	debugLog("Starting main function...")
+	setup()
+	logger().Debug("Starting main function...")
 	defer func() {
 		if db != nil {
 			db.Close()
@@ -77,52 +121,338 @@ func main() {
 	}()
 	router := mux.NewRouter()
 
-	proxyHandler := proxy.New(db, cfg.Debug)
-	debugLog("Proxy handler created")
+	// The manager takes over listeners passed by a previous process during a handoff
+	manager, err := server.New()
+	if err != nil {
+		fatal(logger(), "Failed to initialize listeners", "error", err)
+	}
+
+	trustedProxies, err := requestid.ParseTrusted(cfg.TrustedProxies)
+	if err != nil {
+		fatal(logger(), "Invalid TRUSTED_PROXIES", "error", err)
+	}
+	router.Use(requestid.Middleware(trustedProxies))
+
+	responseCache := newResponseCache()
+	logging.Logger(logging.Cache).Debug("Response cache created", "store", cfg.CacheStore, "max_size_mb", cfg.CacheMaxSizeMB)
+
+	accessLogs, err := accesslog.NewManager(accesslog.Options{
+		Format:     cfg.AccessLogFormat,
+		Output:     cfg.AccessLogOutput,
+		Dir:        cfg.AccessLogDir,
+		MaxSizeMB:  cfg.AccessLogMaxSizeMB,
+		MaxBackups: cfg.AccessLogMaxBackups,
+	})
+	if err != nil {
+		fatal(logger(), "Failed to initialize access log", "error", err)
+	}
+	defer accessLogs.Close()
+	logger().Debug("Access log configured", "output", cfg.AccessLogOutput, "format", cfg.AccessLogFormat)
+
+	if cfg.TracingEndpoint != "" {
+		provider := setupTracing()
+		defer provider.Shutdown(context.Background())
+	}
+
+	proxyHandler := proxy.New(db, responseCache, accessLogs)
+	logger().Debug("Proxy handler created")
 
 	// Initialize API handlers
-	apiHandlers := api.NewHandlers(db, cfg.ProxyAPIKey)
-	debugLog("API handlers created")
+	apiHandlers := api.NewHandlers(db, responseCache, accessLogs, cfg.ProxyAPIKey, newJWTVerifier(), cfg.StaticRoot)
+	logger().Debug("API handlers created")
+
+	// Management routes are served on the admin listener if there is one. Otherwise they
+	// share the public listener and are restricted to the API domain.
+	metrics.RegisterRouteCount(db.CountDomains)
+	if cfg.AdminAddr != "" {
+		serveAdmin(manager, trustedProxies, apiHandlers)
+	} else {
+		registerManagementRoutes(router, apiHandlers, cfg.APIDomain)
+	}
+
+	// Register specific routes first (these take precedence)
+	registerHealthRoutes(router, manager)
+
+	// Register the proxy handler as a catch-all for all other paths
+	// PathPrefix("/") matches all paths, ensuring all requests go through the proxy handler
+	router.PathPrefix("/").Handler(proxyHandler)
+	logger().Debug("Registered catch-all proxy handler")
+
+	// Requests are tracked so shutdown can wait for them, including upgraded connections
+	handler := manager.Track(router)
+
+	// Start the TLS listener (and HTTP/3, if enabled) alongside the plain HTTP listener
+	if cfg.TLSEnabled() {
+		serveTLS(manager, handler, proxyHandler)
+	}
+
+	// Start the HTTP server on port 80
+	port := fmt.Sprintf(":%d", cfg.Port)
+	ln, err := manager.Listen("tcp", port)
+	if err != nil {
+		fatal(logger(), "Server failed to start", "error", err)
+	}
+	httpServer := &http.Server{Handler: handler, BaseContext: manager.BaseContext}
+	manager.Register(httpServer)
+	logger().Info("Starting server", "addr", port)
+	go func() {
+		if err := httpServer.Serve(ln); err != nil && !manager.Draining() {
+			fatal(logger(), "Server failed", "error", err)
+		}
+	}()
+
+	manager.NotifyReady()
+	if err := manager.Run(time.Duration(cfg.ShutdownDelay)*time.Second, time.Duration(cfg.DrainTimeout)*time.Second); err != nil {
+		logger().Warn("Shutdown did not complete cleanly", "error", err)
+	}
+	logger().Info("Server stopped")
+}
 
+// registerManagementRoutes registers the API, metrics and whoami routes. A non-empty
+// apiDomain restricts the API and metrics to requests for that host.
+func registerManagementRoutes(router *mux.Router, apiHandlers *api.Handlers, apiDomain string) {
 	// Create API subrouter with domain middleware
 	apiRouter := router.PathPrefix("/api").Subrouter()
-	apiRouter.Use(api.DomainMiddleware(cfg.APIDomain))
+	if apiDomain != "" {
+		apiRouter.Use(api.DomainMiddleware(apiDomain))
+	}
 	apiRouter.Use(apiHandlers.AuthMiddleware)
 
+	// scoped requires a scope of the authenticated key
+	scoped := func(scope string, handler http.HandlerFunc) http.Handler {
+		return api.Require(scope)(handler)
+	}
+
 	// Register API routes
 	// Note: More specific routes should be registered first
-	apiRouter.HandleFunc("/config/bulk", apiHandlers.BulkCreateDomains).Methods("POST")
-	apiRouter.HandleFunc("/config", apiHandlers.ListDomains).Methods("GET")
-	apiRouter.HandleFunc("/config", apiHandlers.CreateDomain).Methods("POST")
-	apiRouter.HandleFunc("/config/{domain}", apiHandlers.GetDomain).Methods("GET")
-	apiRouter.HandleFunc("/config/{domain}", apiHandlers.UpdateDomain).Methods("PUT")
-	apiRouter.HandleFunc("/config/{domain}", apiHandlers.DeleteDomain).Methods("DELETE")
-	debugLog("Registered API routes with domain protection: %s", cfg.APIDomain)
+	apiRouter.Handle("/config/bulk", scoped(auth.ScopeDomainsWrite, apiHandlers.BulkCreateDomains)).Methods("POST")
+	apiRouter.Handle("/config/batch", scoped(auth.ScopeDomainsWrite, apiHandlers.ApplyBatch)).Methods("POST")
+	apiRouter.Handle("/config", scoped(auth.ScopeRead, apiHandlers.ListDomains)).Methods("GET")
+	apiRouter.Handle("/config", scoped(auth.ScopeDomainsWrite, apiHandlers.CreateDomain)).Methods("POST")
+	apiRouter.Handle("/config/{domain}/history", scoped(auth.ScopeRead, apiHandlers.GetHistory)).Methods("GET")
+	apiRouter.Handle("/config/{domain}/rollback", scoped(auth.ScopeDomainsWrite, apiHandlers.RollbackDomain)).Methods("POST")
+	apiRouter.Handle("/config/{domain}", scoped(auth.ScopeRead, apiHandlers.GetDomain)).Methods("GET")
+	apiRouter.Handle("/config/{domain}", scoped(auth.ScopeDomainsWrite, apiHandlers.UpdateDomain)).Methods("PUT")
+	apiRouter.Handle("/config/{domain}", scoped(auth.ScopeDomainsWrite, apiHandlers.PatchDomain)).Methods("PATCH")
+	apiRouter.Handle("/config/{domain}", scoped(auth.ScopeDomainsWrite, apiHandlers.DeleteDomain)).Methods("DELETE")
+	apiRouter.Handle("/cache/purge", scoped(auth.ScopeDomainsWrite, apiHandlers.PurgeCache)).Methods("POST")
+	apiRouter.Handle("/snapshots", scoped(auth.ScopeRead, apiHandlers.ListSnapshots)).Methods("GET")
+	apiRouter.Handle("/snapshots", scoped(auth.ScopeDomainsWrite, apiHandlers.CreateSnapshot)).Methods("POST")
+	apiRouter.Handle("/snapshots/{id}", scoped(auth.ScopeRead, apiHandlers.GetSnapshot)).Methods("GET")
+	apiRouter.Handle("/snapshots/{id}/restore", scoped(auth.ScopeAdmin, apiHandlers.RestoreSnapshot)).Methods("POST")
+	apiRouter.Handle("/state", scoped(auth.ScopeDomainsWrite, apiHandlers.SyncState)).Methods("PUT")
+	apiRouter.Handle("/audit", scoped(auth.ScopeRead, apiHandlers.ListAudit)).Methods("GET")
+	apiRouter.Handle("/logging", api.Unrestricted(scoped(auth.ScopeRead, apiHandlers.GetLogging))).Methods("GET")
+	apiRouter.Handle("/logging", scoped(auth.ScopeAdmin, apiHandlers.UpdateLogging)).Methods("PUT")
+	apiRouter.Handle("/keys", scoped(auth.ScopeAdmin, apiHandlers.ListAPIKeys)).Methods("GET")
+	apiRouter.Handle("/keys", scoped(auth.ScopeAdmin, apiHandlers.CreateAPIKey)).Methods("POST")
+	apiRouter.Handle("/keys/{id}", scoped(auth.ScopeAdmin, apiHandlers.RevokeAPIKey)).Methods("DELETE")
+	logger().Debug("Registered API routes", "api_domain", apiDomain)
+
+	// Metrics are served behind the same API keys as the API. They cover every domain, so
+	// keys restricted to some domains can't read them.
+	metricsRoute := router.Handle("/metrics",
+		apiHandlers.AuthMiddleware(api.Require(auth.ScopeRead)(api.Unrestricted(metrics.Handler())))).Methods("GET")
+	if apiDomain != "" {
+		metricsRoute.MatcherFunc(api.HostMatcher(apiDomain))
+	}
+	logger().Debug("Registered route", "path", "/metrics")
 
-	// Register specific routes first (these take precedence)
 	router.HandleFunc("/whoami", whoamiHandler)
-	debugLog("Registered route: /whoami")
+	logger().Debug("Registered route", "path", "/whoami")
+}
+
+// registerHealthRoutes registers the liveness and readiness checks
+func registerHealthRoutes(router *mux.Router, manager *server.Manager) {
 	router.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		debugLog("Health check requested from %s", r.RemoteAddr)
+		logger().DebugContext(r.Context(), "Health check requested", "remote_addr", r.RemoteAddr)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		io.WriteString(w, `{"status":"ok"}`)
 	})
-	debugLog("Registered route: /health")
+	logger().Debug("Registered route", "path", "/health")
+	// Readiness fails while the server drains, so load balancers stop sending new requests
+	router.HandleFunc("/ready", manager.Ready)
+	logger().Debug("Registered route", "path", "/ready")
+}
 
-	// Register the proxy handler as a catch-all for all other paths
-	// PathPrefix("/") matches all paths, ensuring all requests go through the proxy handler
-	router.PathPrefix("/").Handler(proxyHandler)
-	debugLog("Registered catch-all proxy handler")
+// serveAdmin starts the admin listener serving the API, metrics, pprof and whoami, so the
+// public listeners only carry proxied traffic
+func serveAdmin(manager *server.Manager, trustedProxies []*net.IPNet, apiHandlers *api.Handlers) {
+	router := mux.NewRouter()
+	router.Use(requestid.Middleware(trustedProxies))
+	registerManagementRoutes(router, apiHandlers, "")
+	registerHealthRoutes(router, manager)
+
+	// Profiles expose internals, so they require an admin API key
+	pprofRouter := router.PathPrefix("/debug/pprof").Subrouter()
+	pprofRouter.Use(apiHandlers.AuthMiddleware, api.Require(auth.ScopeAdmin), api.Unrestricted)
+	pprofRouter.HandleFunc("/cmdline", pprof.Cmdline)
+	pprofRouter.HandleFunc("/profile", pprof.Profile)
+	pprofRouter.HandleFunc("/symbol", pprof.Symbol)
+	pprofRouter.HandleFunc("/trace", pprof.Trace)
+	pprofRouter.PathPrefix("/").HandlerFunc(pprof.Index)
+	logger().Debug("Registered route", "path", "/debug/pprof/")
+
+	network, addr := cfg.AdminListener()
+	ln, err := manager.Listen(network, addr)
+	if err != nil {
+		fatal(logger(), "Admin server failed to start", "error", err)
+	}
+	if network == "unix" {
+		// Only the owner and group may use the socket
+		if err := os.Chmod(addr, 0o660); err != nil {
+			fatal(logger(), "Failed to set admin socket permissions", "error", err)
+		}
+	}
+	adminServer := &http.Server{Handler: manager.Track(router), BaseContext: manager.BaseContext}
+	manager.Register(adminServer)
+	logger().Info("Starting admin server", "addr", addr, "network", network)
+	go func() {
+		if err := adminServer.Serve(ln); err != nil && !manager.Draining() {
+			fatal(logger(), "Admin server failed", "error", err)
+		}
+	}()
+}
 
-	// Start the HTTP server on port 80
-	port := fmt.Sprintf(":%d", cfg.Port)
+// setupTracing starts exporting trace spans to the configured OTLP collector
+func setupTracing() *sdktrace.TracerProvider {
+	exporter, err := tracing.NewOTLPExporter(context.Background())
+	if err != nil {
+		fatal(logger(), "Failed to initialize tracing", "error", err)
+	}
+	provider, err := tracing.Setup(exporter, "simple-proxy")
+	if err != nil {
+		fatal(logger(), "Failed to initialize tracing", "error", err)
+	}
+	logger().Info("Exporting traces", "endpoint", cfg.TracingEndpoint)
+	return provider
+}
 
-	log.Printf("[INFO] Starting server on port %s", port)
-	err := http.ListenAndServe(port, router) // The 'nil' argument uses the default ServeMux
+// newJWTVerifier creates the validator of JWT bearer tokens for the API, or returns nil
+// when JWT_JWKS is unset. A key set that can't be loaded yet is retried when tokens arrive, so
+// an unreachable identity provider doesn't prevent startup.
+func newJWTVerifier() *auth.JWTVerifier {
+	if cfg.JWTJWKS == "" {
+		return nil
+	}
+	logger := logging.Logger(logging.API)
+	scopeMap, err := auth.ParseScopeMap(cfg.JWTScopeMap)
 	if err != nil {
-		log.Fatalf("[FATAL] Server failed to start: %v", err)
+		fatal(logger, "Invalid JWT_SCOPE_MAP", "error", err)
 	}
+	verifier, err := auth.NewJWTVerifier(auth.JWTConfig{
+		JWKS:        cfg.JWTJWKS,
+		Issuer:      cfg.JWTIssuer,
+		Audience:    cfg.JWTAudience,
+		ScopesClaim: cfg.JWTScopesClaim,
+		ScopeMap:    scopeMap,
+		NameClaim:   cfg.JWTNameClaim,
+		Refresh:     time.Duration(cfg.JWTJWKSRefresh) * time.Second,
+	})
+	if err != nil {
+		fatal(logger, "Invalid JWT configuration", "error", err)
+	}
+	if err := verifier.Refresh(context.Background()); err != nil {
+		logger.Error("Failed to load JWKS, retrying when tokens arrive", "jwks", cfg.JWTJWKS, "error", err)
+	}
+	logger.Info("JWT authentication enabled", "jwks", cfg.JWTJWKS, "issuer", cfg.JWTIssuer, "audience", cfg.JWTAudience)
+	return verifier
+}
+
+// newResponseCache creates the response cache shared by all domains with caching enabled
+func newResponseCache() *cache.Cache {
+	maxBytes := int64(cfg.CacheMaxSizeMB) << 20
+	switch cfg.CacheStore {
+	case "memory":
+		return cache.New(cache.NewMemoryStore(maxBytes))
+	case "disk":
+		store, err := cache.NewDiskStore(cfg.CacheDir, maxBytes)
+		if err != nil {
+			fatal(logging.Logger(logging.Cache), "Failed to initialize disk cache", "error", err)
+		}
+		return cache.New(store)
+	default:
+		fatal(logging.Logger(logging.Cache), "Unknown CACHE_STORE, expected memory or disk", "store", cfg.CacheStore)
+		return nil
+	}
+}
+
+// serveTLS starts the TLS listener and, if enabled, an HTTP/3 listener on the same UDP port.
+// Both listeners share the given handler, so routing is identical regardless of transport.
+func serveTLS(manager *server.Manager, handler http.Handler, proxyHandler *proxy.Proxy) {
+	logger := logging.Logger(logging.TLS)
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		fatal(logger, "Failed to load TLS certificate", "error", err)
+	}
+	// ServeTLS only adds the ALPN protocols to its own copy of the config, so they are set
+	// here to be kept by the per-domain configs cloned from it. HTTP/3 sets its own.
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	// Request client certificates for domains with client auth configured
+	tlsConfig.GetConfigForClient = proxyHandler.TLSConfigForClient(tlsConfig.Clone())
+	addr := fmt.Sprintf(":%d", cfg.TLSPort)
+
+	if cfg.HTTP3 {
+		conn, err := manager.ListenPacket(addr)
+		if err != nil {
+			fatal(logger, "HTTP/3 server failed to start", "error", err)
+		}
+		// The server is started again on the same socket if a handoff fails, so the current
+		// one is kept for the Alt-Svc header
+		var current atomic.Pointer[http3.Server]
+		manager.ServePacket(func() server.PacketServer {
+			h3 := &http3.Server{
+				Addr:      addr,
+				Handler:   handler,
+				TLSConfig: tlsConfig,
+			}
+			current.Store(h3)
+			// A closed server leaves a read deadline on the socket
+			conn.SetReadDeadline(time.Time{})
+			logger.Info("Starting HTTP/3 server", "addr", addr, "network", "udp")
+			go func() {
+				// The server is closed before a handoff, while the process is still serving
+				if err := h3.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) && !manager.Draining() {
+					fatal(logger, "HTTP/3 server failed", "error", err)
+				}
+			}()
+			return h3
+		})
+
+		// Advertise HTTP/3 via Alt-Svc on responses served over TCP. Closed servers don't
+		// set it, so clients aren't sent to HTTP/3 while it is down for a handoff.
+		next := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := current.Load().SetQUICHeaders(w.Header()); err != nil && !errors.Is(err, http3.ErrNoAltSvcPort) {
+				logger.Debug("Failed to set Alt-Svc header", "error", err)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+
+	ln, err := manager.Listen("tcp", addr)
+	if err != nil {
+		fatal(logger, "TLS server failed to start", "error", err)
+	}
+	tlsServer := &http.Server{
+		Handler:     handler,
+		TLSConfig:   tlsConfig,
+		BaseContext: manager.BaseContext,
+		// Handshake failures are reported by the server's error log
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+	manager.Register(tlsServer)
+	logger.Info("Starting TLS server", "addr", addr)
+	go func() {
+		if err := tlsServer.ServeTLS(ln, "", ""); err != nil && !manager.Draining() {
+			fatal(logger, "TLS server failed", "error", err)
+		}
+	}()
 }
 
 func getIPs() []string {
@@ -150,18 +480,18 @@ func getIPs() []string {
 }
 
 func whoamiHandler(w http.ResponseWriter, r *http.Request) {
-	debugLog("whoami handler called from %s", r.RemoteAddr)
+	logger().DebugContext(r.Context(), "whoami handler called", "remote_addr", r.RemoteAddr)
 	queryParams := r.URL.Query()
 
 	wait := queryParams.Get("wait")
 	if wait != "" {
-		debugLog("whoami: wait parameter=%s", wait)
+		logger().DebugContext(r.Context(), "whoami: wait parameter", "wait", wait)
 		duration, err := time.ParseDuration(wait)
 		if err == nil {
-			debugLog("whoami: sleeping for %v", duration)
+			logger().DebugContext(r.Context(), "whoami: sleeping", "duration", duration)
 			time.Sleep(duration)
 		} else {
-			log.Printf("[WARN] whoami: invalid wait duration %s: %v", wait, err)
+			logger().WarnContext(r.Context(), "whoami: invalid wait duration", "wait", wait, "error", err)
 		}
 	}
 
@@ -179,6 +509,7 @@ func whoamiHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	_, _ = fmt.Fprintln(w, "RemoteAddr:", r.RemoteAddr)
+	_, _ = fmt.Fprintln(w, "RequestID:", requestid.FromContext(r.Context()))
 
 	if r.TLS != nil {
 		for i, cert := range r.TLS.PeerCertificates {
@@ -190,10 +521,4 @@ func whoamiHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-
-	if ok, _ := strconv.ParseBool(queryParams.Get("env")); ok {
-		for _, env := range os.Environ() {
-			_, _ = fmt.Fprintln(w, env)
-		}
-	}
 }
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/itsnoxius/simple-proxy/internal/accesslog"
+	"github.com/itsnoxius/simple-proxy/internal/api"
+	"github.com/itsnoxius/simple-proxy/internal/auth"
+	"github.com/itsnoxius/simple-proxy/internal/cache"
+	"github.com/itsnoxius/simple-proxy/internal/config"
+	"github.com/itsnoxius/simple-proxy/internal/database"
+	"github.com/itsnoxius/simple-proxy/internal/proxy"
+	"github.com/itsnoxius/simple-proxy/internal/server"
+	"github.com/itsnoxius/simple-proxy/pkg/models"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// testCertificate is a self-signed certificate for 127.0.0.1, usable by servers and clients
+type testCertificate struct {
+	certFile, keyFile string
+	certPEM           []byte
+	cert              tls.Certificate
+	pool              *x509.CertPool
+}
+
+func newTestCertificate(t *testing.T) *testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "simple-proxy test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost", "mtls.example.com"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &testCertificate{
+		certFile: filepath.Join(t.TempDir(), "tls.crt"),
+		keyFile:  filepath.Join(t.TempDir(), "tls.key"),
+		certPEM:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pool:     x509.NewCertPool(),
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(c.certFile, c.certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(c.keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if c.cert, err = tls.X509KeyPair(c.certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	c.pool.AppendCertsFromPEM(c.certPEM)
+	return c
+}
+
+// freePort returns a port that is free for both TCP and UDP
+func freePort(t *testing.T) int {
+	t.Helper()
+	for range 10 {
+		ln, err := net.Listen("tcp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		port := ln.Addr().(*net.TCPAddr).Port
+		conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+		ln.Close()
+		if err == nil {
+			conn.Close()
+			return port
+		}
+	}
+	t.Fatal("no free port for TCP and UDP")
+	return 0
+}
+
+// startTLS runs serveTLS with HTTP/3 enabled, answering every request with its protocol.
+// It returns the port and the database backing the proxy's client auth lookups.
+func startTLS(t *testing.T, cert *testCertificate) (int, *database.DB) {
+	t.Helper()
+	testDB, err := database.New(filepath.Join(t.TempDir(), "proxy.db"))
+	if err != nil {
+		t.Fatalf("database.New: %v", err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+
+	port := freePort(t)
+	previous := cfg
+	cfg = &config.Config{TLSCertFile: cert.certFile, TLSKeyFile: cert.keyFile, TLSPort: port, HTTP3: true}
+	t.Cleanup(func() { cfg = previous })
+
+	manager, err := server.New()
+	if err != nil {
+		t.Fatalf("server.New: %v", err)
+	}
+	t.Cleanup(func() { manager.Shutdown(0, 5*time.Second) })
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	})
+	serveTLS(manager, handler, proxy.New(testDB, nil, nil))
+	return port, testDB
+}
+
+// getProto sends a GET request and checks that it was served over proto
+func getProto(t *testing.T, client *http.Client, url, proto string) *http.Response {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	if resp.Proto != proto || string(body) != proto {
+		t.Errorf("response protocol %s, handler saw %q, want %s", resp.Proto, body, proto)
+	}
+	return resp
+}
+
+func TestServeTLS(t *testing.T) {
+	cert := newTestCertificate(t)
+	port, testDB := startTLS(t, cert)
+	url := fmt.Sprintf("https://127.0.0.1:%d/", port)
+
+	t.Run("https advertises http3", func(t *testing.T) {
+		transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: cert.pool}, ForceAttemptHTTP2: true}
+		defer transport.CloseIdleConnections()
+		resp := getProto(t, &http.Client{Transport: transport, Timeout: 5 * time.Second}, url, "HTTP/2.0")
+		want := fmt.Sprintf(`h3=":%d"`, port)
+		if altSvc := resp.Header.Get("Alt-Svc"); !strings.Contains(altSvc, want) {
+			t.Errorf("Alt-Svc = %q, want it to contain %s", altSvc, want)
+		}
+	})
+
+	t.Run("http3", func(t *testing.T) {
+		transport := &http3.Transport{TLSClientConfig: &tls.Config{RootCAs: cert.pool}}
+		defer transport.Close()
+		getProto(t, &http.Client{Transport: transport, Timeout: 5 * time.Second}, url, "HTTP/3.0")
+	})
+
+	t.Run("client auth keeps h2", func(t *testing.T) {
+		_, err := testDB.CreateDomain(models.Actor{}, models.CreateDomainRequest{
+			Domain:        "mtls.example.com",
+			IP:            "127.0.0.1",
+			Port:          8080,
+			DomainOptions: models.DomainOptions{ClientAuth: &models.ClientAuthConfig{CACert: string(cert.certPEM)}},
+		})
+		if err != nil {
+			t.Fatalf("CreateDomain: %v", err)
+		}
+		transport := &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      cert.pool,
+				ServerName:   "mtls.example.com",
+				Certificates: []tls.Certificate{cert.cert},
+			},
+			ForceAttemptHTTP2: true,
+		}
+		defer transport.CloseIdleConnections()
+		getProto(t, &http.Client{Transport: transport, Timeout: 5 * time.Second}, url, "HTTP/2.0")
+	})
+}
+
+func TestManagementRoutesRejectRestrictedKeys(t *testing.T) {
+	testDB, err := database.New(filepath.Join(t.TempDir(), "proxy.db"))
+	if err != nil {
+		t.Fatalf("database.New: %v", err)
+	}
+	t.Cleanup(func() { testDB.Close() })
+	accessLogs, err := accesslog.NewManager(accesslog.Options{})
+	if err != nil {
+		t.Fatalf("accesslog.NewManager: %v", err)
+	}
+	router := mux.NewRouter()
+	registerManagementRoutes(router, api.NewHandlers(testDB, cache.New(cache.NewMemoryStore(1<<20)), accessLogs, "", nil, ""), "")
+
+	newKey := func(domains ...string) string {
+		key, id, hash := auth.GenerateKey()
+		req := models.CreateAPIKeyRequest{Name: "test", Scopes: []string{auth.ScopeAdmin}, Domains: domains}
+		if _, err := testDB.CreateAPIKey(id, hash, req); err != nil {
+			t.Fatalf("CreateAPIKey: %v", err)
+		}
+		return key
+	}
+	unrestricted, restricted := newKey(), newKey("*.example.com")
+
+	for _, path := range []string{"/metrics", "/api/logging"} {
+		for key, status := range map[string]int{unrestricted: http.StatusOK, restricted: http.StatusForbidden} {
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			r.Header.Set("Authorization", "Bearer "+key)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+			if w.Code != status {
+				t.Errorf("GET %s with restricted = %v: status = %d, want %d", path, key == restricted, w.Code, status)
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// APIKey describes an API key. The key itself is only returned when it is created.
+type APIKey struct {
+	ID     string   `json:"id"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// Domains restricts the key to domains matching these patterns, e.g. "*.example.com"
+	Domains   []string   `json:"domains,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// CreateAPIKeyRequest represents a request to create an API key
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	Domains   []string   `json:"domains,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// CreateAPIKeyResponse returns a new API key along with its description
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
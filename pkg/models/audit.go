@@ -0,0 +1,42 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Actions recorded in the audit log and domain revisions
+const (
+	AuditCreate     = "create"
+	AuditUpdate     = "update"
+	AuditDelete     = "delete"
+	AuditBulkCreate = "bulk_create"
+	AuditRollback   = "rollback"
+	AuditRestore    = "restore"
+	AuditRename     = "rename"
+	AuditSync       = "sync"
+	// AuditImport marks the first revision of domains created before revisions were recorded
+	AuditImport = "import"
+)
+
+// Actor identifies who made a change recorded in the audit log
+type Actor struct {
+	// Name is the name of the API key or the subject of the token that made the change
+	Name      string `json:"actor"`
+	KeyID     string `json:"key_id,omitempty"`
+	SourceIP  string `json:"source_ip"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// AuditRecord describes a change of a domain mapping made through the API
+type AuditRecord struct {
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	Actor
+	Action string `json:"action"`
+	Domain string `json:"domain"`
+	// Before and After are the domain mapping before and after the change, null when it
+	// didn't exist
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
@@ -0,0 +1,53 @@
+package models
+
+// Batch modes
+const (
+	// BatchAtomic applies all operations of a batch or none of them
+	BatchAtomic = "atomic"
+	// BatchBestEffort applies every operation that succeeds and reports the others
+	BatchBestEffort = "best-effort"
+)
+
+// Batch operations
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchUpsert = "upsert"
+	BatchDelete = "delete"
+)
+
+// BatchRequest represents a request to apply several domain operations in order
+type BatchRequest struct {
+	// Mode is BatchAtomic or BatchBestEffort, defaulting to BatchAtomic
+	Mode       string           `json:"mode,omitempty"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchOperation is a single operation of a batch. Create and upsert take the whole
+// mapping; upsert replaces an existing mapping entirely. Update keeps omitted options like
+// PUT does, and delete only needs the domain.
+type BatchOperation struct {
+	Op string `json:"op"`
+	CreateDomainRequest
+	// Version, when set, must match the stored version for the operation to be applied
+	Version int64 `json:"version,omitempty"`
+}
+
+// BatchResult is the outcome of one operation of a batch
+type BatchResult struct {
+	Op     string `json:"op"`
+	Domain string `json:"domain"`
+	// Status is the HTTP status the operation would have had as a single request
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Result is the mapping after the operation, omitted for deletions and failures
+	Result *Domain `json:"result,omitempty"`
+}
+
+// BatchResponse lists the results of a batch in the order of its operations
+type BatchResponse struct {
+	Mode    string        `json:"mode"`
+	Applied int           `json:"applied"`
+	Failed  int           `json:"failed"`
+	Results []BatchResult `json:"results"`
+}
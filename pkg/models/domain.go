@@ -1,23 +1,228 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Domain represents a domain mapping configuration
 type Domain struct {
-	Domain    string    `json:"domain"`
-	IP        string    `json:"ip"`
-	Port      int       `json:"port"`
-	Protocol  string    `json:"protocol"`
+	Domain   string `json:"domain"`
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	// Target is an alternative backend address, e.g. "unix:///run/app.sock",
+	// used instead of IP and Port when set
+	Target string `json:"target,omitempty"`
+	DomainOptions
+	// Version is incremented on every write of the mapping and is served as its ETag
+	Version   int64     `json:"version"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// DomainOptions holds the optional per-domain settings shared by the domain model and
+// API requests. Each option is stored in its own column named after its JSON key.
+type DomainOptions struct {
+	UpstreamTLS *UpstreamTLSConfig `json:"upstream_tls,omitempty"`
+	ClientAuth  *ClientAuthConfig  `json:"client_auth,omitempty"`
+	Static      *StaticConfig      `json:"static,omitempty"`
+	Cache       *CacheConfig       `json:"cache,omitempty"`
+	Compression *CompressionConfig `json:"compression,omitempty"`
+	AccessLog   *AccessLogConfig   `json:"access_log,omitempty"`
+	Mirror      *MirrorConfig      `json:"mirror,omitempty"`
+	Canary      *CanaryConfig      `json:"canary,omitempty"`
+	Upstreams   *UpstreamsConfig   `json:"upstreams,omitempty"`
+}
+
+// UpstreamTLSConfig holds the TLS settings used when connecting to an https backend.
+// Certificates and keys are PEM encoded. The client key is write-only: it is stored in the
+// database but left out of the JSON encoding, so API responses never return it.
+type UpstreamTLSConfig struct {
+	CACert             string `json:"ca_cert,omitempty"`
+	ServerName         string `json:"server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+	ClientCert         string `json:"client_cert,omitempty"`
+	ClientKey          string `json:"client_key,omitempty"`
+}
+
+// MarshalJSON encodes the settings without the client key
+func (c UpstreamTLSConfig) MarshalJSON() ([]byte, error) {
+	type settings UpstreamTLSConfig
+	redacted := settings(c)
+	redacted.ClientKey = ""
+	return json.Marshal(redacted)
+}
+
+// IsZero reports whether no upstream TLS settings are configured
+func (c *UpstreamTLSConfig) IsZero() bool {
+	return c == nil || *c == UpstreamTLSConfig{}
+}
+
+// KeepClientKey copies the client key of the previous settings when c has the same client
+// certificate but no key, as settings read back from the API do
+func (c *UpstreamTLSConfig) KeepClientKey(previous *UpstreamTLSConfig) {
+	if c != nil && previous != nil && c.ClientKey == "" && c.ClientCert != "" && c.ClientCert == previous.ClientCert {
+		c.ClientKey = previous.ClientKey
+	}
+}
+
+// ClientAuthConfig requires clients of a domain to present a certificate on the TLS listener.
+// Patterns use path.Match syntax; deny patterns take precedence over allow patterns, and
+// when any allow pattern is set the certificate must match at least one of them.
+type ClientAuthConfig struct {
+	CACert        string            `json:"ca_cert,omitempty"`
+	AllowSubjects []string          `json:"allow_subjects,omitempty"`
+	AllowSANs     []string          `json:"allow_sans,omitempty"`
+	DenySubjects  []string          `json:"deny_subjects,omitempty"`
+	DenySANs      []string          `json:"deny_sans,omitempty"`
+	Headers       ClientAuthHeaders `json:"headers,omitzero"`
+}
+
+// IsZero reports whether no client auth settings are configured
+func (c *ClientAuthConfig) IsZero() bool {
+	return c == nil || (c.CACert == "" && len(c.AllowSubjects) == 0 && len(c.AllowSANs) == 0 &&
+		len(c.DenySubjects) == 0 && len(c.DenySANs) == 0 && c.Headers == ClientAuthHeaders{})
+}
+
+// ClientAuthHeaders names the headers used to pass the verified client identity to the backend
+type ClientAuthHeaders struct {
+	Subject     string `json:"subject,omitempty"`
+	SANs        string `json:"sans,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+}
+
+// StaticConfig makes a domain serve files from a local directory instead of proxying
+type StaticConfig struct {
+	Root             string             `json:"root"`
+	IndexFiles       []string           `json:"index_files,omitempty"`
+	SPAFallback      bool               `json:"spa_fallback,omitempty"`
+	DirectoryListing bool               `json:"directory_listing,omitempty"`
+	Precompressed    bool               `json:"precompressed,omitempty"`
+	CacheControl     []CacheControlRule `json:"cache_control,omitempty"`
+}
+
+// IsZero reports whether no static settings are configured
+func (c *StaticConfig) IsZero() bool {
+	return c == nil || (c.Root == "" && len(c.IndexFiles) == 0 && !c.SPAFallback &&
+		!c.DirectoryListing && !c.Precompressed && len(c.CacheControl) == 0)
+}
+
+// CacheControlRule sets the Cache-Control header for static files whose path or
+// base name matches Pattern
+type CacheControlRule struct {
+	Pattern string `json:"pattern"`
+	Value   string `json:"value"`
+}
+
+// CacheConfig enables the shared response cache for a domain. Backend Cache-Control and
+// Expires headers take precedence over the defaults configured here.
+type CacheConfig struct {
+	Enabled bool `json:"enabled"`
+	// DefaultTTL is the freshness lifetime in seconds of responses without explicit caching headers.
+	// When zero, such responses are not cached.
+	DefaultTTL int `json:"default_ttl,omitempty"`
+	// MaxObjectSize is the largest body in bytes that is cached
+	MaxObjectSize int `json:"max_object_size,omitempty"`
+	// StaleWhileRevalidate and StaleIfError are defaults in seconds for the Cache-Control extensions
+	StaleWhileRevalidate int `json:"stale_while_revalidate,omitempty"`
+	StaleIfError         int `json:"stale_if_error,omitempty"`
+}
+
+// CompressionConfig enables on-the-fly response compression for a domain
+type CompressionConfig struct {
+	Enabled bool `json:"enabled"`
+	// Encodings lists the allowed encodings ("br", "zstd", "gzip") in order of preference
+	Encodings []string `json:"encodings,omitempty"`
+	// MimeTypes lists content type patterns eligible for compression, e.g. "text/*"
+	MimeTypes []string `json:"mime_types,omitempty"`
+	// MinSize is the smallest Content-Length in bytes that is compressed
+	MinSize int `json:"min_size,omitempty"`
+}
+
+// AccessLogConfig overrides the global access log settings for a domain.
+// Empty fields fall back to the global settings.
+type AccessLogConfig struct {
+	Disabled bool `json:"disabled,omitempty"`
+	// Format is "json", "common" or "combined"
+	Format string `json:"format,omitempty"`
+	// Output is "stdout", "file:<path>" or "syslog[:<network>://<address>]"
+	Output string `json:"output,omitempty"`
+}
+
+// MirrorConfig sends a copy of a share of a domain's requests to a shadow backend.
+// Shadow responses are discarded.
+type MirrorConfig struct {
+	// Target is the shadow backend URL, e.g. "http://10.0.0.5:8080"
+	Target string `json:"target"`
+	// Percent is the share of requests mirrored, from 0 to 100
+	Percent float64 `json:"percent"`
+	// MaxBodyBytes is the largest request body mirrored; requests with larger bodies are not mirrored
+	MaxBodyBytes int `json:"max_body_bytes,omitempty"`
+	// Timeout bounds shadow requests in seconds
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// CanaryConfig routes a share of a domain's requests to a canary backend. Clients can
+// force either backend with an X-Canary header or cookie set to "1" or "0".
+type CanaryConfig struct {
+	// Target is the canary backend URL, e.g. "http://10.0.0.6:8080"
+	Target string `json:"target"`
+	// Weight is the share of requests routed to the canary, from 0 to 100
+	Weight float64 `json:"weight"`
+	// StickyCookie names the cookie remembering the backend chosen for a client.
+	// When empty, every request is routed independently.
+	StickyCookie string `json:"sticky_cookie,omitempty"`
+	// StickyTTL is the lifetime of the sticky cookie in seconds; zero makes it a session cookie
+	StickyTTL int `json:"sticky_ttl,omitempty"`
+}
+
+// UpstreamsConfig spreads a domain's requests across several backends, replacing its
+// ip, port and target. Targets that keep failing are skipped for a while.
+type UpstreamsConfig struct {
+	// Targets are the backend URLs, e.g. "http://10.0.0.5:8080"
+	Targets []string `json:"targets"`
+	// MaxFailures is the number of consecutive failed requests after which a target is unhealthy
+	MaxFailures int `json:"max_failures,omitempty"`
+	// FailTimeout is how long in seconds an unhealthy target receives no requests
+	FailTimeout int             `json:"fail_timeout,omitempty"`
+	Affinity    *AffinityConfig `json:"affinity,omitempty"`
+}
+
+// IsZero reports whether no upstream targets are configured
+func (c *UpstreamsConfig) IsZero() bool {
+	return c == nil || (len(c.Targets) == 0 && c.MaxFailures == 0 && c.FailTimeout == 0 && c.Affinity == nil)
+}
+
+// AffinityConfig pins clients to one of a domain's upstream targets
+type AffinityConfig struct {
+	// Mode is "cookie" for a proxy-issued cookie or "ip_hash" for the client address
+	Mode string `json:"mode"`
+	// CookieName names the affinity cookie
+	CookieName string `json:"cookie_name,omitempty"`
+	// CookieTTL is the lifetime of the affinity cookie in seconds; zero makes it a session cookie
+	CookieTTL int  `json:"cookie_ttl,omitempty"`
+	Secure    bool `json:"secure,omitempty"`
+	// SameSite is "lax", "strict" or "none"
+	SameSite string `json:"same_site,omitempty"`
+}
+
+// PurgeCacheRequest represents a request to purge cached responses.
+// At least one field must be set; all set fields must match.
+type PurgeCacheRequest struct {
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+	Prefix string `json:"prefix"`
+}
+
 // CreateDomainRequest represents a request to create a new domain mapping
 type CreateDomainRequest struct {
 	Domain   string `json:"domain"`
 	IP       string `json:"ip"`
 	Port     int    `json:"port"`
 	Protocol string `json:"protocol"`
+	Target   string `json:"target,omitempty"`
+	DomainOptions
 }
 
 // UpdateDomainRequest represents a request to update a domain mapping
@@ -25,6 +230,10 @@ type UpdateDomainRequest struct {
 	IP       string `json:"ip"`
 	Port     int    `json:"port"`
 	Protocol string `json:"protocol"`
+	Target   string `json:"target,omitempty"`
+	DomainOptions
+	// Version, when set, must match the stored version for the update to be applied
+	Version int64 `json:"version,omitempty"`
 }
 
 // BulkCreateDomainsRequest represents a request to create multiple domain mappings
@@ -0,0 +1,13 @@
+package models
+
+// LoggingConfig describes the current log level of each subsystem
+type LoggingConfig struct {
+	Levels map[string]string `json:"levels"`
+}
+
+// UpdateLoggingRequest changes log levels at runtime. Level is applied to every subsystem
+// before the per-subsystem Levels.
+type UpdateLoggingRequest struct {
+	Level  string            `json:"level,omitempty"`
+	Levels map[string]string `json:"levels,omitempty"`
+}
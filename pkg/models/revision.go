@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// Revision is an immutable record of a domain mapping after a change
+type Revision struct {
+	Domain   string    `json:"domain"`
+	Revision int       `json:"revision"`
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	// Config is the domain mapping after the change, null when it was deleted
+	Config *Domain `json:"config"`
+}
+
+// RollbackRequest selects the revision a domain is rolled back to. When Revision is
+// zero, the revision before the latest one is restored.
+type RollbackRequest struct {
+	Revision int `json:"revision"`
+}
+
+// Snapshot is a copy of the whole routing table
+type Snapshot struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	CreatedAt   time.Time `json:"created_at"`
+	DomainCount int       `json:"domain_count"`
+	// Domains is only returned when a single snapshot is requested
+	Domains []Domain `json:"domains,omitempty"`
+}
+
+// CreateSnapshotRequest represents a request to take a snapshot of the routing table
+type CreateSnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+// DomainChange describes how a domain mapping was changed, with a null Before when it was
+// created and a null After when it was deleted
+type DomainChange struct {
+	Domain string  `json:"domain"`
+	Before *Domain `json:"before"`
+	After  *Domain `json:"after"`
+}
+
+// StateDiff describes the changes that make the routing table match a desired state
+type StateDiff struct {
+	DryRun    bool           `json:"dry_run"`
+	Prune     bool           `json:"prune"`
+	Added     []DomainChange `json:"added"`
+	Changed   []DomainChange `json:"changed"`
+	Removed   []DomainChange `json:"removed"`
+	Unchanged int            `json:"unchanged"`
+	// Unlisted names the mapped domains missing from the desired state, kept without prune
+	Unlisted []string `json:"unlisted,omitempty"`
+}